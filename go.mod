@@ -4,6 +4,12 @@ go 1.21
 
 require (
 	github.com/go-sql-driver/mysql v1.7.1
+	github.com/pkg/sftp v1.13.7
 	github.com/robfig/cron/v3 v3.0.1
 	golang.org/x/crypto v0.17.0
 )
+
+require (
+	github.com/kr/fs v0.1.0 // indirect
+	golang.org/x/sys v0.15.0 // indirect
+)
@@ -0,0 +1,626 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"mysql-backup/internal/auth"
+	"mysql-backup/internal/config"
+)
+
+const (
+	sessionCookie      = "mysql_backup_session"
+	sessionIdleTimeout = 12 * time.Hour
+
+	// Failed logins before a username is locked out for the client address
+	// they came from, and for how long
+	loginMaxFailures = 5
+	loginLockout     = 5 * time.Minute
+
+	// Failed logins from one address, whatever the usernames, before the
+	// address is locked out
+	loginMaxAddressFailures = 20
+)
+
+type contextKey string
+
+const sessionKey contextKey = "session"
+
+// publicPaths are reachable without a session.
+var publicPaths = map[string]bool{
+	"/login":          true,
+	"/setup":          true,
+	"/api/auth/login": true,
+	"/api/auth/setup": true,
+}
+
+// Authenticate protects every route but the login and setup pages. Requests
+// either present an API token in an "Authorization: Bearer" header or the
+// session cookie. Without either, pages redirect to the login (or, before any
+// user exists, to the setup) while the API answers 401. Session requests that
+// change state must carry the session's CSRF token in the X-CSRF-Token header.
+//
+// The handlers check the user's role through the access stored in the request
+// context.
+func (h *Handler) Authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if publicPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// API tokens carry no cookie, so they need no CSRF token either
+		if token, ok := bearerToken(r); ok {
+			a, err := h.tokenAccess(token)
+			if err != nil {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), accessKey, a)))
+			return
+		}
+
+		session, ok := h.currentSession(r)
+		if !ok {
+			switch {
+			case strings.HasPrefix(r.URL.Path, "/api/"):
+				http.Error(w, "authentication required", http.StatusUnauthorized)
+			case !h.config.HasUsers():
+				http.Redirect(w, r, "/setup", http.StatusSeeOther)
+			default:
+				http.Redirect(w, r, "/login", http.StatusSeeOther)
+			}
+			return
+		}
+
+		if r.Method != http.MethodGet && r.Method != http.MethodHead &&
+			!auth.TokensEqual(r.Header.Get("X-CSRF-Token"), session.CSRFToken) {
+			http.Error(w, "invalid CSRF token", http.StatusForbidden)
+			return
+		}
+
+		user, err := h.config.GetUser(session.UserID)
+		if err != nil {
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), sessionKey, session)
+		ctx = context.WithValue(ctx, accessKey, newUserAccess(*user))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// currentSession returns the session of the request's cookie, as long as its
+// user still exists.
+func (h *Handler) currentSession(r *http.Request) (auth.Session, bool) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return auth.Session{}, false
+	}
+
+	session, ok := h.sessions.Get(cookie.Value)
+	if !ok {
+		return auth.Session{}, false
+	}
+	if _, err := h.config.GetUser(session.UserID); err != nil {
+		h.sessions.Delete(cookie.Value)
+		return auth.Session{}, false
+	}
+	return session, true
+}
+
+func sessionFromContext(ctx context.Context) auth.Session {
+	session, _ := ctx.Value(sessionKey).(auth.Session)
+	return session
+}
+
+// startSession logs a user in and sets the session cookie.
+func (h *Handler) startSession(w http.ResponseWriter, r *http.Request, user config.User) auth.Session {
+	user.LastLoginAt = time.Now().Format(time.RFC3339)
+	if err := h.config.UpdateUser(user.ID, user); err != nil {
+		fmt.Printf("WARNING: Failed to record login of %s: %v\n", user.Username, err)
+	}
+
+	session := h.sessions.Create(user.ID)
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    session.Token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return session
+}
+
+// decodeJSONForm decodes a JSON body, refusing other content types so that a
+// plain HTML form on another site cannot post to the public endpoints.
+func decodeJSONForm(r *http.Request, v interface{}) error {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/json" {
+		return fmt.Errorf("expected a JSON body")
+	}
+	return json.NewDecoder(r.Body).Decode(v)
+}
+
+type sessionResponse struct {
+	UserID      string   `json:"user_id"`
+	Username    string   `json:"username"`
+	CSRFToken   string   `json:"csrf_token"`
+	Role        string   `json:"role"`
+	Permissions []string `json:"permissions"`
+	MachineIDs  []string `json:"machine_ids,omitempty"` // Vazio = todas
+}
+
+func newSessionResponse(user config.User, csrfToken string, a access) sessionResponse {
+	return sessionResponse{
+		UserID:      user.ID,
+		Username:    user.Username,
+		CSRFToken:   csrfToken,
+		Role:        a.Role,
+		Permissions: a.Permissions,
+		MachineIDs:  a.MachineIDs,
+	}
+}
+
+// userResponse is a user without its password hash.
+type userResponse struct {
+	ID          string   `json:"id"`
+	Username    string   `json:"username"`
+	Role        string   `json:"role"`
+	MachineIDs  []string `json:"machine_ids"`
+	CreatedAt   string   `json:"created_at"`
+	LastLoginAt string   `json:"last_login_at,omitempty"`
+}
+
+func newUserResponse(user config.User) userResponse {
+	machineIDs := user.MachineIDs
+	if machineIDs == nil {
+		machineIDs = []string{}
+	}
+	return userResponse{
+		ID:          user.ID,
+		Username:    user.Username,
+		Role:        user.EffectiveRole(),
+		MachineIDs:  machineIDs,
+		CreatedAt:   user.CreatedAt,
+		LastLoginAt: user.LastLoginAt,
+	}
+}
+
+func (h *Handler) LoginHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := decodeJSONForm(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Lockouts are per client address, so failures from elsewhere never keep
+	// a user out
+	address := clientAddress(r)
+	account := address + " " + req.Username
+	if h.addressThrottle.Locked(address) || h.loginThrottle.Locked(account) {
+		http.Error(w, "too many failed logins, try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	user, err := h.config.GetUserByUsername(req.Username)
+	hash := ""
+	if err == nil {
+		hash = user.PasswordHash
+	}
+	if !auth.CheckPassword(hash, req.Password) {
+		h.addressThrottle.Fail(address)
+		h.loginThrottle.Fail(account)
+		http.Error(w, "invalid username or password", http.StatusUnauthorized)
+		return
+	}
+	h.loginThrottle.Succeed(account)
+
+	session := h.startSession(w, r, *user)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newSessionResponse(*user, session.CSRFToken, newUserAccess(*user)))
+}
+
+// clientAddress returns the IP address a request came from. Forwarding
+// headers are ignored, since any client can set them.
+func clientAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func (h *Handler) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	h.sessions.Delete(sessionFromContext(r.Context()).Token)
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: "", Path: "/", MaxAge: -1, HttpOnly: true})
+	w.WriteHeader(http.StatusOK)
+}
+
+// SetupHandler creates the first admin account. It only works while no user
+// exists and requires the setup token printed at startup, so whoever reaches
+// the port first cannot claim the instance.
+func (h *Handler) SetupHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Username   string `json:"username"`
+		Password   string `json:"password"`
+		SetupToken string `json:"setup_token"`
+	}
+	if err := decodeJSONForm(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	h.setupMu.Lock()
+	defer h.setupMu.Unlock()
+
+	if h.config.HasUsers() {
+		http.Error(w, "setup already completed", http.StatusConflict)
+		return
+	}
+	if !auth.TokensEqual(strings.TrimSpace(req.SetupToken), h.setupToken) {
+		http.Error(w, "invalid setup token", http.StatusForbidden)
+		return
+	}
+
+	user, err := h.newUser(req.Username, req.Password)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	user.Role = auth.RoleAdmin
+	if user, err = h.config.AddUser(user); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	session := h.startSession(w, r, user)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(newSessionResponse(user, session.CSRFToken, newUserAccess(user)))
+}
+
+// CurrentUserHandler describes the logged-in user, or the owner of the API
+// token, with the permissions the request has.
+func (h *Handler) CurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	a := accessFromContext(r.Context())
+	user, err := h.config.GetUser(a.UserID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newSessionResponse(*user, sessionFromContext(r.Context()).CSRFToken, a))
+}
+
+// ChangePasswordHandler changes the password of the logged-in user and ends
+// their other sessions.
+func (h *Handler) ChangePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireSession(w, r) {
+		return
+	}
+
+	var req struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	session := sessionFromContext(r.Context())
+	user, err := h.config.GetUser(session.UserID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if !auth.CheckPassword(user.PasswordHash, req.CurrentPassword) {
+		http.Error(w, "current password is incorrect", http.StatusForbidden)
+		return
+	}
+
+	hash, err := auth.HashPassword(req.NewPassword)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	user.PasswordHash = hash
+	if err := h.config.UpdateUser(user.ID, *user); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.sessions.DeleteUser(user.ID, session.Token)
+	w.WriteHeader(http.StatusOK)
+}
+
+// User management handlers
+func (h *Handler) GetUsersHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireSession(w, r) || !authorize(w, r, auth.PermAdmin) {
+		return
+	}
+
+	allUsers := h.config.GetUsers()
+	users := make([]userResponse, 0, len(allUsers))
+	for _, user := range allUsers {
+		users = append(users, newUserResponse(user))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(users)
+}
+
+// CreateUserHandler adds an account. Without a role the user is a viewer.
+func (h *Handler) CreateUserHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireSession(w, r) || !authorize(w, r, auth.PermAdmin) {
+		return
+	}
+
+	var req struct {
+		Username   string   `json:"username"`
+		Password   string   `json:"password"`
+		Role       string   `json:"role"`
+		MachineIDs []string `json:"machine_ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Role == "" {
+		req.Role = auth.RoleViewer
+	}
+	if err := h.validateUserAccess(req.Role, req.MachineIDs); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, err := h.newUser(req.Username, req.Password)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	user.Role = req.Role
+	user.MachineIDs = req.MachineIDs
+	if user, err = h.config.AddUser(user); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(newUserResponse(user))
+}
+
+// UpdateUserHandler changes the role and machines of a user. The change
+// applies to their open sessions right away.
+func (h *Handler) UpdateUserHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireSession(w, r) || !authorize(w, r, auth.PermAdmin) {
+		return
+	}
+
+	userID := strings.TrimPrefix(r.URL.Path, "/api/users/")
+
+	var req struct {
+		Role       string   `json:"role"`
+		MachineIDs []string `json:"machine_ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := h.validateUserAccess(req.Role, req.MachineIDs); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, err := h.config.GetUser(userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if user.EffectiveRole() == auth.RoleAdmin && req.Role != auth.RoleAdmin && h.config.AdminCount() <= 1 {
+		http.Error(w, "at least one admin is required", http.StatusBadRequest)
+		return
+	}
+
+	user.Role = req.Role
+	user.MachineIDs = req.MachineIDs
+	if err := h.config.UpdateUser(userID, *user); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newUserResponse(*user))
+}
+
+func (h *Handler) DeleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireSession(w, r) || !authorize(w, r, auth.PermAdmin) {
+		return
+	}
+
+	userID := strings.TrimPrefix(r.URL.Path, "/api/users/")
+
+	if userID == sessionFromContext(r.Context()).UserID {
+		http.Error(w, "cannot delete the logged-in user", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.config.DeleteUser(userID); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	h.sessions.DeleteUser(userID, "")
+	w.WriteHeader(http.StatusOK)
+}
+
+// validateUserAccess checks a role and the machines it is limited to.
+// Admins always see every machine.
+func (h *Handler) validateUserAccess(role string, machineIDs []string) error {
+	if !auth.ValidRole(role) {
+		return fmt.Errorf("role must be admin, operator or viewer")
+	}
+	if role == auth.RoleAdmin && len(machineIDs) > 0 {
+		return fmt.Errorf("admins cannot be limited to machines")
+	}
+	for _, machineID := range machineIDs {
+		if _, err := h.config.GetMachine(machineID); err != nil {
+			return fmt.Errorf("unknown machine: %s", machineID)
+		}
+	}
+	return nil
+}
+
+func (h *Handler) newUser(username, password string) (config.User, error) {
+	username = strings.TrimSpace(username)
+	if username == "" {
+		return config.User{}, fmt.Errorf("username is required")
+	}
+
+	hash, err := auth.HashPassword(password)
+	if err != nil {
+		return config.User{}, err
+	}
+	return config.User{Username: username, PasswordHash: hash}, nil
+}
+
+// LoginPageHandler serves the login form, or the first-run setup form when
+// no user exists yet.
+func (h *Handler) LoginPageHandler(w http.ResponseWriter, r *http.Request) {
+	setup := !h.config.HasUsers()
+	switch {
+	case r.URL.Path == "/setup" && !setup:
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	case r.URL.Path == "/login" && setup:
+		http.Redirect(w, r, "/setup", http.StatusSeeOther)
+		return
+	}
+	if _, ok := h.currentSession(r); ok {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	loginPage.Execute(w, map[string]bool{"Setup": setup})
+}
+
+var loginPage = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html lang="pt-BR">
+<head>
+   <meta charset="UTF-8">
+   <meta name="viewport" content="width=device-width, initial-scale=1.0">
+   <title>MySQL Backup System</title>
+   <script src="https://cdn.tailwindcss.com"></script>
+   <link href="https://cdnjs.cloudflare.com/ajax/libs/font-awesome/6.0.0/css/all.min.css" rel="stylesheet">
+   <script>
+       if (localStorage.getItem('theme') === 'dark') {
+           document.documentElement.classList.add('dark');
+       }
+   </script>
+</head>
+<body class="bg-gray-50 dark:bg-gray-900 min-h-screen flex items-center justify-center">
+   <div class="w-full max-w-sm bg-white dark:bg-gray-800 rounded-lg shadow-lg border border-gray-200 dark:border-gray-700 p-8">
+       <div class="flex items-center justify-center mb-6">
+           <i class="fas fa-database text-blue-600 dark:text-blue-400 text-2xl mr-3"></i>
+           <h1 class="text-xl font-bold text-gray-900 dark:text-white">MySQL Backup System</h1>
+       </div>
+       {{if .Setup}}
+       <p class="text-sm text-gray-600 dark:text-gray-300 mb-4">Primeiro acesso: crie a conta de administrador. O token de configuração foi exibido no log do servidor ao iniciar.</p>
+       {{end}}
+       <form id="auth-form" class="space-y-4">
+           {{if .Setup}}
+           <div>
+               <label class="block text-sm font-medium text-gray-700 dark:text-gray-300 mb-1">Token de configuração:</label>
+               <input type="text" name="setup_token" required autocomplete="off"
+                      class="w-full border border-gray-300 dark:border-gray-600 rounded-lg px-3 py-2 bg-white dark:bg-gray-700 text-gray-900 dark:text-white">
+           </div>
+           {{end}}
+           <div>
+               <label class="block text-sm font-medium text-gray-700 dark:text-gray-300 mb-1">Usuário:</label>
+               <input type="text" name="username" required autocomplete="username"
+                      class="w-full border border-gray-300 dark:border-gray-600 rounded-lg px-3 py-2 bg-white dark:bg-gray-700 text-gray-900 dark:text-white">
+           </div>
+           <div>
+               <label class="block text-sm font-medium text-gray-700 dark:text-gray-300 mb-1">Senha:</label>
+               <input type="password" name="password" required {{if .Setup}}minlength="8" autocomplete="new-password"{{else}}autocomplete="current-password"{{end}}
+                      class="w-full border border-gray-300 dark:border-gray-600 rounded-lg px-3 py-2 bg-white dark:bg-gray-700 text-gray-900 dark:text-white">
+           </div>
+           {{if .Setup}}
+           <div>
+               <label class="block text-sm font-medium text-gray-700 dark:text-gray-300 mb-1">Confirmar senha:</label>
+               <input type="password" name="confirm" required minlength="8" autocomplete="new-password"
+                      class="w-full border border-gray-300 dark:border-gray-600 rounded-lg px-3 py-2 bg-white dark:bg-gray-700 text-gray-900 dark:text-white">
+           </div>
+           {{end}}
+           <p id="auth-error" class="text-sm text-red-600 hidden"></p>
+           <button type="submit" class="w-full bg-blue-500 hover:bg-blue-600 text-white font-medium py-2 px-4 rounded-lg transition-colors">
+               {{if .Setup}}<i class="fas fa-user-shield mr-2"></i>Criar administrador{{else}}<i class="fas fa-sign-in-alt mr-2"></i>Entrar{{end}}
+           </button>
+       </form>
+   </div>
+   <script>
+       document.getElementById('auth-form').addEventListener('submit', async (event) => {
+           event.preventDefault();
+           const form = new FormData(event.target);
+           const error = document.getElementById('auth-error');
+           const setup = form.has('setup_token');
+           if (setup && form.get('password') !== form.get('confirm')) {
+               error.textContent = 'As senhas não conferem.';
+               error.classList.remove('hidden');
+               return;
+           }
+
+           const body = { username: form.get('username'), password: form.get('password') };
+           if (setup) body.setup_token = form.get('setup_token');
+           const response = await fetch(setup ? '/api/auth/setup' : '/api/auth/login', {
+               method: 'POST',
+               headers: { 'Content-Type': 'application/json' },
+               body: JSON.stringify(body)
+           });
+           if (response.ok) {
+               window.location.href = '/';
+               return;
+           }
+           error.textContent = response.status === 429 ? 'Muitas tentativas. Aguarde alguns minutos.' :
+               (response.status === 401 ? 'Usuário ou senha inválidos.' : await response.text());
+           error.classList.remove('hidden');
+       });
+   </script>
+</body>
+</html>`))
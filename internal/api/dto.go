@@ -0,0 +1,417 @@
+package api
+
+import (
+	"fmt"
+
+	"mysql-backup/internal/config"
+)
+
+// secretMask stands in for a stored secret in responses. Sent back in an
+// update, it keeps the stored value, as does leaving the field out; an empty
+// string clears it. Once the host, port or user of a connection changes,
+// its stored secrets are no longer kept and must be sent again, so that
+// they are never handed to a server they were not meant for.
+const secretMask = "********"
+
+func maskSecret(value string) string {
+	if value == "" {
+		return ""
+	}
+	return secretMask
+}
+
+// updateSecret returns the secret to store given the value sent in an update.
+// With retargeted set, the connection points somewhere else and a stored
+// secret can only be replaced or cleared.
+func updateSecret(field string, sent *string, current string, retargeted bool) (string, error) {
+	if sent != nil && *sent != secretMask {
+		return *sent, nil
+	}
+	if retargeted && current != "" {
+		return "", fmt.Errorf("%s must be entered again when the host, port or user changes", field)
+	}
+	return current, nil
+}
+
+// configResponse is the configuration as returned by GET /api/config, with
+// every secret masked and without the accounts.
+type configResponse struct {
+	Machines  []machineResponse      `json:"machines"`
+	Storages  []storageResponse      `json:"storages"`
+	Google    googleResponse         `json:"google"`
+	S3        s3Response             `json:"s3"`
+	Scheduler config.SchedulerConfig `json:"scheduler"`
+	Backup    config.BackupConfig    `json:"backup"`
+	Jobs      config.JobsConfig      `json:"jobs"`
+	Service   config.ServiceConfig   `json:"service"`
+}
+
+func newConfigResponse(cfg *config.Config) configResponse {
+	response := configResponse{
+		Machines:  make([]machineResponse, 0, len(cfg.Machines)),
+		Storages:  make([]storageResponse, 0, len(cfg.Storages)),
+		Google:    newGoogleResponse(cfg.Google),
+		S3:        newS3Response(cfg.S3),
+		Scheduler: cfg.Scheduler,
+		Backup:    cfg.Backup,
+		Jobs:      cfg.Jobs,
+		Service:   cfg.Service,
+	}
+	for _, machine := range cfg.Machines {
+		response.Machines = append(response.Machines, newMachineResponse(machine))
+	}
+	for _, storageConfig := range cfg.Storages {
+		response.Storages = append(response.Storages, newStorageResponse(storageConfig))
+	}
+	return response
+}
+
+type googleResponse struct {
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	SheetID      string `json:"sheet_id"`
+	DriveFolder  string `json:"drive_folder"`
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenExpiry  string `json:"token_expiry"`
+}
+
+func newGoogleResponse(google config.GoogleConfig) googleResponse {
+	return googleResponse{
+		ClientID:     google.ClientID,
+		ClientSecret: maskSecret(google.ClientSecret),
+		SheetID:      google.SheetID,
+		DriveFolder:  google.DriveFolder,
+		AccessToken:  maskSecret(google.AccessToken),
+		RefreshToken: maskSecret(google.RefreshToken),
+		TokenExpiry:  google.TokenExpiry,
+	}
+}
+
+type s3Response struct {
+	Endpoint             string `json:"endpoint"`
+	Region               string `json:"region"`
+	Bucket               string `json:"bucket"`
+	Prefix               string `json:"prefix,omitempty"`
+	AccessKeyID          string `json:"access_key_id"`
+	SecretAccessKey      string `json:"secret_access_key"`
+	PathStyle            bool   `json:"path_style"`
+	ServerSideEncryption string `json:"server_side_encryption,omitempty"`
+	KMSKeyID             string `json:"kms_key_id,omitempty"`
+	PartSizeMB           int    `json:"part_size_mb,omitempty"`
+}
+
+func newS3Response(s3 config.S3Config) s3Response {
+	return s3Response{
+		Endpoint:             s3.Endpoint,
+		Region:               s3.Region,
+		Bucket:               s3.Bucket,
+		Prefix:               s3.Prefix,
+		AccessKeyID:          s3.AccessKeyID,
+		SecretAccessKey:      maskSecret(s3.SecretAccessKey),
+		PathStyle:            s3.PathStyle,
+		ServerSideEncryption: s3.ServerSideEncryption,
+		KMSKeyID:             s3.KMSKeyID,
+		PartSizeMB:           s3.PartSizeMB,
+	}
+}
+
+// s3Request is an S3 connection sent to create or update a storage.
+type s3Request struct {
+	Endpoint             string  `json:"endpoint"`
+	Region               string  `json:"region"`
+	Bucket               string  `json:"bucket"`
+	Prefix               string  `json:"prefix"`
+	AccessKeyID          string  `json:"access_key_id"`
+	SecretAccessKey      *string `json:"secret_access_key"`
+	PathStyle            bool    `json:"path_style"`
+	ServerSideEncryption string  `json:"server_side_encryption"`
+	KMSKeyID             string  `json:"kms_key_id"`
+	PartSizeMB           int     `json:"part_size_mb"`
+}
+
+// apply returns the connection described by the request, keeping the secret
+// of current when masked or left out and the endpoint and key are the same.
+func (req s3Request) apply(current config.S3Config) (config.S3Config, error) {
+	retargeted := req.Endpoint != current.Endpoint || req.AccessKeyID != current.AccessKeyID
+	secret, err := updateSecret("S3 secret access key", req.SecretAccessKey, current.SecretAccessKey, retargeted)
+	if err != nil {
+		return config.S3Config{}, err
+	}
+
+	return config.S3Config{
+		Endpoint:             req.Endpoint,
+		Region:               req.Region,
+		Bucket:               req.Bucket,
+		Prefix:               req.Prefix,
+		AccessKeyID:          req.AccessKeyID,
+		SecretAccessKey:      secret,
+		PathStyle:            req.PathStyle,
+		ServerSideEncryption: req.ServerSideEncryption,
+		KMSKeyID:             req.KMSKeyID,
+		PartSizeMB:           req.PartSizeMB,
+	}, nil
+}
+
+type mysqlResponse struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Database string `json:"database"`
+}
+
+type mysqlRequest struct {
+	Host     string  `json:"host"`
+	Port     int     `json:"port"`
+	Username string  `json:"username"`
+	Password *string `json:"password"`
+	Database string  `json:"database"`
+}
+
+func (req mysqlRequest) apply(current config.MySQLConfig) (config.MySQLConfig, error) {
+	retargeted := req.Host != current.Host || req.Port != current.Port || req.Username != current.Username
+	password, err := updateSecret("MySQL password", req.Password, current.Password, retargeted)
+	if err != nil {
+		return config.MySQLConfig{}, err
+	}
+
+	return config.MySQLConfig{
+		Host:     req.Host,
+		Port:     req.Port,
+		Username: req.Username,
+		Password: password,
+		Database: req.Database,
+	}, nil
+}
+
+type sshResponse struct {
+	Host       string `json:"host"`
+	Port       int    `json:"port"`
+	Username   string `json:"username"`
+	Password   string `json:"password,omitempty"`
+	PrivateKey string `json:"private_key"`
+	Passphrase string `json:"passphrase,omitempty"`
+	KeyPath    string `json:"key_path,omitempty"`
+}
+
+func newSSHResponse(ssh config.SSHConfig) sshResponse {
+	return sshResponse{
+		Host:       ssh.Host,
+		Port:       ssh.Port,
+		Username:   ssh.Username,
+		Password:   maskSecret(ssh.Password),
+		PrivateKey: maskSecret(ssh.PrivateKey),
+		Passphrase: maskSecret(ssh.Passphrase),
+		KeyPath:    ssh.KeyPath,
+	}
+}
+
+type sshRequest struct {
+	Host       string  `json:"host"`
+	Port       int     `json:"port"`
+	Username   string  `json:"username"`
+	Password   *string `json:"password"`
+	PrivateKey *string `json:"private_key"`
+	Passphrase *string `json:"passphrase"`
+	KeyPath    string  `json:"key_path"`
+}
+
+func (req sshRequest) apply(current config.SSHConfig) (config.SSHConfig, error) {
+	retargeted := req.Host != current.Host || req.Port != current.Port || req.Username != current.Username
+
+	password, err := updateSecret("SSH password", req.Password, current.Password, retargeted)
+	if err != nil {
+		return config.SSHConfig{}, err
+	}
+	privateKey, err := updateSecret("SSH private key", req.PrivateKey, current.PrivateKey, retargeted)
+	if err != nil {
+		return config.SSHConfig{}, err
+	}
+	passphrase, err := updateSecret("SSH key passphrase", req.Passphrase, current.Passphrase, retargeted)
+	if err != nil {
+		return config.SSHConfig{}, err
+	}
+
+	return config.SSHConfig{
+		Host:       req.Host,
+		Port:       req.Port,
+		Username:   req.Username,
+		Password:   password,
+		PrivateKey: privateKey,
+		Passphrase: passphrase,
+		KeyPath:    req.KeyPath,
+	}, nil
+}
+
+type machineResponse struct {
+	ID          string                  `json:"id"`
+	Name        string                  `json:"name"`
+	Type        string                  `json:"type"`
+	Description string                  `json:"description"`
+	MySQL       mysqlResponse           `json:"mysql"`
+	SSH         sshResponse             `json:"ssh"`
+	StorageIDs  []string                `json:"storage_ids,omitempty"`
+	Retention   *config.RetentionPolicy `json:"retention,omitempty"`
+	Enabled     bool                    `json:"enabled"`
+	CreatedAt   string                  `json:"created_at"`
+	UpdatedAt   string                  `json:"updated_at"`
+}
+
+func newMachineResponse(machine config.Machine) machineResponse {
+	return machineResponse{
+		ID:          machine.ID,
+		Name:        machine.Name,
+		Type:        machine.Type,
+		Description: machine.Description,
+		MySQL: mysqlResponse{
+			Host:     machine.MySQL.Host,
+			Port:     machine.MySQL.Port,
+			Username: machine.MySQL.Username,
+			Password: maskSecret(machine.MySQL.Password),
+			Database: machine.MySQL.Database,
+		},
+		SSH:        newSSHResponse(machine.SSH),
+		StorageIDs: machine.StorageIDs,
+		Retention:  machine.Retention,
+		Enabled:    machine.Enabled,
+		CreatedAt:  machine.CreatedAt,
+		UpdatedAt:  machine.UpdatedAt,
+	}
+}
+
+// machineRequest is a machine sent to create, update or test it. ID is only
+// read by the connection test, to fill in the secrets of the machine being
+// edited.
+type machineRequest struct {
+	ID          string                  `json:"id"`
+	Name        string                  `json:"name"`
+	Type        string                  `json:"type"`
+	Description string                  `json:"description"`
+	MySQL       mysqlRequest            `json:"mysql"`
+	SSH         sshRequest              `json:"ssh"`
+	StorageIDs  []string                `json:"storage_ids"`
+	Retention   *config.RetentionPolicy `json:"retention"`
+	Enabled     bool                    `json:"enabled"`
+}
+
+// apply returns the machine described by the request, keeping the secrets
+// of current that were masked or left out. It fails when such a secret
+// belongs to a connection whose target changed.
+func (req machineRequest) apply(current config.Machine) (config.Machine, error) {
+	mysql, err := req.MySQL.apply(current.MySQL)
+	if err != nil {
+		return config.Machine{}, err
+	}
+	ssh, err := req.SSH.apply(current.SSH)
+	if err != nil {
+		return config.Machine{}, err
+	}
+
+	return config.Machine{
+		ID:          current.ID,
+		Name:        req.Name,
+		Type:        req.Type,
+		Description: req.Description,
+		MySQL:       mysql,
+		SSH:         ssh,
+		StorageIDs:  req.StorageIDs,
+		Retention:   req.Retention,
+		Enabled:     req.Enabled,
+		CreatedAt:   current.CreatedAt,
+		UpdatedAt:   current.UpdatedAt,
+	}, nil
+}
+
+type storageResponse struct {
+	ID            string                  `json:"id"`
+	Name          string                  `json:"name"`
+	Type          string                  `json:"type"`
+	Path          string                  `json:"path,omitempty"`
+	PathTemplate  string                  `json:"path_template,omitempty"`
+	S3            *s3Response             `json:"s3,omitempty"`
+	SSH           *sshResponse            `json:"ssh,omitempty"`
+	RetentionDays int                     `json:"retention_days,omitempty"`
+	Retention     *config.RetentionPolicy `json:"retention,omitempty"`
+	Enabled       bool                    `json:"enabled"`
+	CreatedAt     string                  `json:"created_at"`
+	UpdatedAt     string                  `json:"updated_at"`
+}
+
+func newStorageResponse(storageConfig config.StorageConfig) storageResponse {
+	response := storageResponse{
+		ID:            storageConfig.ID,
+		Name:          storageConfig.Name,
+		Type:          storageConfig.Type,
+		Path:          storageConfig.Path,
+		PathTemplate:  storageConfig.PathTemplate,
+		RetentionDays: storageConfig.RetentionDays,
+		Retention:     storageConfig.Retention,
+		Enabled:       storageConfig.Enabled,
+		CreatedAt:     storageConfig.CreatedAt,
+		UpdatedAt:     storageConfig.UpdatedAt,
+	}
+	if storageConfig.S3 != nil {
+		s3 := newS3Response(*storageConfig.S3)
+		response.S3 = &s3
+	}
+	if storageConfig.SSH != nil {
+		ssh := newSSHResponse(*storageConfig.SSH)
+		response.SSH = &ssh
+	}
+	return response
+}
+
+// storageRequest is a storage sent to create or update it.
+type storageRequest struct {
+	Name          string                  `json:"name"`
+	Type          string                  `json:"type"`
+	Path          string                  `json:"path"`
+	PathTemplate  string                  `json:"path_template"`
+	S3            *s3Request              `json:"s3"`
+	SSH           *sshRequest             `json:"ssh"`
+	RetentionDays int                     `json:"retention_days"`
+	Retention     *config.RetentionPolicy `json:"retention"`
+	Enabled       bool                    `json:"enabled"`
+}
+
+// apply returns the storage described by the request, keeping the secrets
+// of current that were masked or left out. It fails when such a secret
+// belongs to a connection whose target changed.
+func (req storageRequest) apply(current config.StorageConfig) (config.StorageConfig, error) {
+	storageConfig := config.StorageConfig{
+		ID:            current.ID,
+		Name:          req.Name,
+		Type:          req.Type,
+		Path:          req.Path,
+		PathTemplate:  req.PathTemplate,
+		RetentionDays: req.RetentionDays,
+		Retention:     req.Retention,
+		Enabled:       req.Enabled,
+		CreatedAt:     current.CreatedAt,
+		UpdatedAt:     current.UpdatedAt,
+	}
+	if req.S3 != nil {
+		var s3 config.S3Config
+		if current.S3 != nil {
+			s3 = *current.S3
+		}
+		s3, err := req.S3.apply(s3)
+		if err != nil {
+			return config.StorageConfig{}, err
+		}
+		storageConfig.S3 = &s3
+	}
+	if req.SSH != nil {
+		var ssh config.SSHConfig
+		if current.SSH != nil {
+			ssh = *current.SSH
+		}
+		ssh, err := req.SSH.apply(ssh)
+		if err != nil {
+			return config.StorageConfig{}, err
+		}
+		storageConfig.SSH = &ssh
+	}
+	return storageConfig, nil
+}
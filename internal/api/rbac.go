@@ -0,0 +1,128 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"mysql-backup/internal/auth"
+	"mysql-backup/internal/backup"
+	"mysql-backup/internal/config"
+	"mysql-backup/internal/history"
+)
+
+const accessKey contextKey = "access"
+
+// access is what a request may do: the permissions of the user's role and
+// the machines it is limited to.
+type access struct {
+	UserID      string
+	Role        string
+	Permissions []string
+	MachineIDs  []string // nil = todas as máquinas
+	TokenID     string   // Token de API da requisição; vazio = sessão do navegador
+}
+
+// newUserAccess returns the access of a user. Admins are never limited to
+// machines.
+func newUserAccess(user config.User) access {
+	role := user.EffectiveRole()
+	a := access{UserID: user.ID, Role: role, Permissions: auth.RolePermissions(role)}
+	if role != auth.RoleAdmin && len(user.MachineIDs) > 0 {
+		a.MachineIDs = user.MachineIDs
+	}
+	return a
+}
+
+func (a access) can(permission string) bool {
+	for _, p := range a.Permissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+func (a access) canMachine(machineID string) bool {
+	if a.MachineIDs == nil {
+		return true
+	}
+	for _, id := range a.MachineIDs {
+		if id == machineID {
+			return true
+		}
+	}
+	return false
+}
+
+func accessFromContext(ctx context.Context) access {
+	a, _ := ctx.Value(accessKey).(access)
+	return a
+}
+
+// authorize answers 403 unless the request has permission.
+func authorize(w http.ResponseWriter, r *http.Request, permission string) bool {
+	if !accessFromContext(r.Context()).can(permission) {
+		http.Error(w, "permission denied", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// authorizeMachine answers 403 unless the request has permission on the
+// machine.
+func authorizeMachine(w http.ResponseWriter, r *http.Request, permission, machineID string) bool {
+	a := accessFromContext(r.Context())
+	if !a.can(permission) || !a.canMachine(machineID) {
+		http.Error(w, "permission denied", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// storageSummary is a storage as seen by non-admins: enough to name the
+// destinations of a backup, without paths or credentials.
+type storageSummary struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Enabled bool   `json:"enabled"`
+}
+
+// restoreSourceAllowed reports whether a user limited to machines may restore
+// from the backup a request points at: a working copy under the directory of
+// one of their machines, or a stored copy catalogued for one of them.
+func (h *Handler) restoreSourceAllowed(a access, req backup.RestoreRequest) bool {
+	if a.MachineIDs == nil {
+		return true
+	}
+
+	if req.DriveID == "" && req.StorageID == "" {
+		dir, _, _ := strings.Cut(strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(req.FilePath)), "/"), "/")
+		return a.canMachine(dir)
+	}
+
+	// The restore reads DriveID first, so that is what has to match
+	page := h.historyStore.Query(history.Filter{MachineIDs: a.MachineIDs, Kind: "backup", Status: "success"})
+	for _, entry := range page.Logs {
+		if req.DriveID != "" {
+			if entry.DriveID == req.DriveID {
+				return true
+			}
+			for _, location := range entry.Locations {
+				if location.Type == "drive" && location.ID == req.DriveID {
+					return true
+				}
+			}
+			continue
+		}
+		for _, location := range entry.Locations {
+			if location.Storage == req.StorageID && location.Path == req.Key {
+				return true
+			}
+		}
+	}
+	return false
+}
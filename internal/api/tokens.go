@@ -0,0 +1,258 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"mysql-backup/internal/auth"
+	"mysql-backup/internal/config"
+)
+
+// tokenFlushInterval is how often the last use of tokens, kept in memory by
+// tokenAccess, is written to the config file.
+const tokenFlushInterval = 5 * time.Minute
+
+// bearerToken returns the token of an "Authorization: Bearer" header.
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+// tokenAccess checks an API token and returns what it may do: its scopes,
+// as far as the owner's role still grants them, on the owner's machines.
+func (h *Handler) tokenAccess(raw string) (access, error) {
+	hash := auth.HashToken(raw)
+
+	var token *config.APIToken
+	for _, t := range h.config.GetAPITokens() {
+		if auth.TokensEqual(t.TokenHash, hash) {
+			token = &t
+			break
+		}
+	}
+	if token == nil {
+		return access{}, fmt.Errorf("invalid API token")
+	}
+
+	now := time.Now()
+	if token.Expired(now) {
+		return access{}, fmt.Errorf("API token expired")
+	}
+
+	owner, err := h.config.GetUser(token.UserID)
+	if err != nil {
+		return access{}, fmt.Errorf("invalid API token")
+	}
+
+	a := newUserAccess(*owner)
+	a.TokenID = token.ID
+	var permissions []string
+	for _, scope := range token.Scopes {
+		if a.can(scope) {
+			permissions = append(permissions, scope)
+		}
+	}
+	a.Permissions = permissions
+
+	h.tokenUsesMu.Lock()
+	h.tokenUses[token.ID] = now.Format(time.RFC3339)
+	h.tokenUsesMu.Unlock()
+
+	return a, nil
+}
+
+// flushTokenUsesLoop writes the last use of tokens every tokenFlushInterval,
+// so requests never rewrite the config file themselves.
+func (h *Handler) flushTokenUsesLoop() {
+	ticker := time.NewTicker(tokenFlushInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		h.FlushTokenUses()
+	}
+}
+
+// FlushTokenUses writes the pending last use of tokens to the config file.
+func (h *Handler) FlushTokenUses() {
+	h.tokenUsesMu.Lock()
+	pending := h.tokenUses
+	h.tokenUses = make(map[string]string)
+	h.tokenUsesMu.Unlock()
+
+	if len(pending) == 0 {
+		return
+	}
+	if err := h.config.TouchAPITokens(pending); err != nil {
+		fmt.Printf("WARNING: Failed to record use of API tokens: %v\n", err)
+	}
+}
+
+// lastUsed returns when a token was last used, including uses not yet
+// written to the config file.
+func (h *Handler) lastUsed(token config.APIToken) string {
+	h.tokenUsesMu.Lock()
+	defer h.tokenUsesMu.Unlock()
+	if at, ok := h.tokenUses[token.ID]; ok {
+		return at
+	}
+	return token.LastUsedAt
+}
+
+// requireSession answers 403 to requests made with an API token. Accounts
+// and tokens are only managed from a logged-in browser, so a leaked token
+// cannot mint new credentials.
+func requireSession(w http.ResponseWriter, r *http.Request) bool {
+	if accessFromContext(r.Context()).TokenID != "" {
+		http.Error(w, "not available to API tokens", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// apiTokenResponse is a token without its hash. Token is only set when the
+// token is created.
+type apiTokenResponse struct {
+	ID         string   `json:"id"`
+	Name       string   `json:"name"`
+	UserID     string   `json:"user_id"`
+	Username   string   `json:"username"`
+	Prefix     string   `json:"prefix"`
+	Scopes     []string `json:"scopes"`
+	ExpiresAt  string   `json:"expires_at,omitempty"`
+	Expired    bool     `json:"expired"`
+	CreatedAt  string   `json:"created_at"`
+	LastUsedAt string   `json:"last_used_at,omitempty"`
+	Token      string   `json:"token,omitempty"`
+}
+
+func (h *Handler) newAPITokenResponse(token config.APIToken) apiTokenResponse {
+	response := apiTokenResponse{
+		ID:         token.ID,
+		Name:       token.Name,
+		UserID:     token.UserID,
+		Prefix:     token.Prefix,
+		Scopes:     token.Scopes,
+		ExpiresAt:  token.ExpiresAt,
+		Expired:    token.Expired(time.Now()),
+		CreatedAt:  token.CreatedAt,
+		LastUsedAt: h.lastUsed(token),
+	}
+	if owner, err := h.config.GetUser(token.UserID); err == nil {
+		response.Username = owner.Username
+	}
+	return response
+}
+
+// GetAPITokensHandler lists the user's own tokens, or every token for admins.
+func (h *Handler) GetAPITokensHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireSession(w, r) {
+		return
+	}
+
+	a := accessFromContext(r.Context())
+	tokens := []apiTokenResponse{}
+	for _, token := range h.config.GetAPITokens() {
+		if token.UserID == a.UserID || a.can(auth.PermAdmin) {
+			tokens = append(tokens, h.newAPITokenResponse(token))
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokens)
+}
+
+// CreateAPITokenHandler creates a token for the logged-in user. The token is
+// only returned in this response.
+func (h *Handler) CreateAPITokenHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireSession(w, r) {
+		return
+	}
+
+	var req struct {
+		Name          string   `json:"name"`
+		Scopes        []string `json:"scopes"`
+		ExpiresInDays int      `json:"expires_in_days"` // 0 = não expira
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	if len(req.Scopes) == 0 {
+		http.Error(w, "at least one scope is required", http.StatusBadRequest)
+		return
+	}
+	a := accessFromContext(r.Context())
+	for _, scope := range req.Scopes {
+		if !auth.ValidPermission(scope) {
+			http.Error(w, "unknown scope: "+scope, http.StatusBadRequest)
+			return
+		}
+		if !a.can(scope) {
+			http.Error(w, "scope not granted by your role: "+scope, http.StatusForbidden)
+			return
+		}
+	}
+	if req.ExpiresInDays < 0 {
+		http.Error(w, "expires_in_days must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	raw := auth.NewAPIToken()
+	token := config.APIToken{
+		Name:      req.Name,
+		UserID:    a.UserID,
+		TokenHash: auth.HashToken(raw),
+		Prefix:    raw[:len(auth.APITokenPrefix)+6],
+		Scopes:    req.Scopes,
+	}
+	if req.ExpiresInDays > 0 {
+		token.ExpiresAt = time.Now().AddDate(0, 0, req.ExpiresInDays).Format(time.RFC3339)
+	}
+
+	token, err := h.config.AddAPIToken(token)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := h.newAPITokenResponse(token)
+	response.Token = raw
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
+
+// DeleteAPITokenHandler revokes a token of the user; admins may revoke any.
+func (h *Handler) DeleteAPITokenHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireSession(w, r) {
+		return
+	}
+
+	tokenID := strings.TrimPrefix(r.URL.Path, "/api/tokens/")
+	a := accessFromContext(r.Context())
+
+	token, err := h.config.GetAPIToken(tokenID)
+	if err != nil || (token.UserID != a.UserID && !a.can(auth.PermAdmin)) {
+		http.Error(w, "token not found", http.StatusNotFound)
+		return
+	}
+
+	if err := h.config.DeleteAPIToken(tokenID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
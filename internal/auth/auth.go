@@ -0,0 +1,242 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// MinPasswordLength is the shortest password accepted for a user.
+const MinPasswordLength = 8
+
+// dummyHash is compared against when a username does not exist, so a failed
+// login takes the same time whether or not the user exists.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("mysql-backup-dummy"), bcrypt.DefaultCost)
+
+// HashPassword returns the bcrypt hash stored for a user.
+func HashPassword(password string) (string, error) {
+	if len(password) < MinPasswordLength {
+		return "", fmt.Errorf("password must have at least %d characters", MinPasswordLength)
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash password: %w", err)
+	}
+	return string(hash), nil
+}
+
+// CheckPassword reports whether password matches hash. An empty hash (unknown
+// user) never matches but costs as much as a real comparison.
+func CheckPassword(hash, password string) bool {
+	if hash == "" {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// NewToken returns a random hex token of n bytes.
+func NewToken(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("failed to read random bytes: %v", err))
+	}
+	return hex.EncodeToString(b)
+}
+
+// TokensEqual compares two secrets in constant time.
+func TokensEqual(a, b string) bool {
+	return a != "" && subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// APITokenPrefix starts every API token, so leaked tokens are easy to spot.
+const APITokenPrefix = "mbk_"
+
+// NewAPIToken returns a new API token. Only its hash is stored.
+func NewAPIToken() string {
+	return APITokenPrefix + NewToken(32)
+}
+
+// HashToken returns the stored form of an API token. Tokens are random, so a
+// plain SHA-256 is enough; bcrypt would only slow every API request down.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Session is a logged-in browser. CSRFToken must accompany every request
+// that changes state.
+type Session struct {
+	Token     string
+	UserID    string
+	CSRFToken string
+	CreatedAt time.Time
+	LastSeen  time.Time
+}
+
+// SessionStore keeps sessions in memory; a restart logs everyone out.
+// Sessions expire after idleTimeout without requests.
+type SessionStore struct {
+	mu          sync.Mutex
+	sessions    map[string]*Session
+	idleTimeout time.Duration
+}
+
+func NewSessionStore(idleTimeout time.Duration) *SessionStore {
+	return &SessionStore{
+		sessions:    make(map[string]*Session),
+		idleTimeout: idleTimeout,
+	}
+}
+
+// Create starts a session for a user.
+func (s *SessionStore) Create(userID string) Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	session := &Session{
+		Token:     NewToken(32),
+		UserID:    userID,
+		CSRFToken: NewToken(32),
+		CreatedAt: now,
+		LastSeen:  now,
+	}
+	s.sessions[session.Token] = session
+	s.expire(now)
+	return *session
+}
+
+// Get returns the session of a token and marks it as used.
+func (s *SessionStore) Get(token string) (Session, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.sessions[token]
+	if !ok {
+		return Session{}, false
+	}
+	if time.Since(session.LastSeen) > s.idleTimeout {
+		delete(s.sessions, token)
+		return Session{}, false
+	}
+	session.LastSeen = time.Now()
+	return *session, true
+}
+
+// Delete ends a session.
+func (s *SessionStore) Delete(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.sessions, token)
+}
+
+// DeleteUser ends every session of a user except keepToken (may be empty).
+func (s *SessionStore) DeleteUser(userID, keepToken string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for token, session := range s.sessions {
+		if session.UserID == userID && token != keepToken {
+			delete(s.sessions, token)
+		}
+	}
+}
+
+// expire drops idle sessions. Callers hold s.mu.
+func (s *SessionStore) expire(now time.Time) {
+	for token, session := range s.sessions {
+		if now.Sub(session.LastSeen) > s.idleTimeout {
+			delete(s.sessions, token)
+		}
+	}
+}
+
+// Throttle locks a key, such as a client address or an address and username,
+// out for a while after repeated failed logins. Keys are case-insensitive,
+// and failures older than the lockout are forgotten.
+type Throttle struct {
+	mu          sync.Mutex
+	failures    map[string]throttleFailures
+	lockedUntil map[string]time.Time
+	maxFailures int
+	lockout     time.Duration
+}
+
+type throttleFailures struct {
+	count int
+	since time.Time // First failure still counted
+}
+
+func NewThrottle(maxFailures int, lockout time.Duration) *Throttle {
+	return &Throttle{
+		failures:    make(map[string]throttleFailures),
+		lockedUntil: make(map[string]time.Time),
+		maxFailures: maxFailures,
+		lockout:     lockout,
+	}
+}
+
+// Locked reports whether logins for key are refused right now.
+func (t *Throttle) Locked(key string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return time.Now().Before(t.lockedUntil[strings.ToLower(key)])
+}
+
+// Fail records a failed login.
+func (t *Throttle) Fail(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	t.expire(now)
+
+	key = strings.ToLower(key)
+	failures, ok := t.failures[key]
+	if !ok {
+		failures.since = now
+	}
+	failures.count++
+	if failures.count >= t.maxFailures {
+		t.lockedUntil[key] = now.Add(t.lockout)
+		delete(t.failures, key)
+		return
+	}
+	t.failures[key] = failures
+}
+
+// Succeed clears the failures of a key.
+func (t *Throttle) Succeed(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key = strings.ToLower(key)
+	delete(t.failures, key)
+	delete(t.lockedUntil, key)
+}
+
+// expire drops lockouts that ended and failures older than the lockout.
+// Callers hold t.mu.
+func (t *Throttle) expire(now time.Time) {
+	for key, until := range t.lockedUntil {
+		if !now.Before(until) {
+			delete(t.lockedUntil, key)
+		}
+	}
+	for key, failures := range t.failures {
+		if now.Sub(failures.since) > t.lockout {
+			delete(t.failures, key)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package auth
+
+// Roles of a user. Each role grants a fixed set of permissions.
+const (
+	RoleAdmin    = "admin"
+	RoleOperator = "operator"
+	RoleViewer   = "viewer"
+)
+
+// Permissions checked by the API.
+const (
+	PermHistoryRead  = "history:read"  // Logs, jobs and restores
+	PermMachinesRead = "machines:read" // Machines, storages and schedules without credentials
+	PermBackupRun    = "backup:run"    // Manual backups, connection tests and cancelling jobs
+	PermRestoreRun   = "restore:run"
+	PermAdmin        = "admin" // Configuration, credentials, users and editing machines
+)
+
+var rolePermissions = map[string][]string{
+	RoleAdmin:    {PermHistoryRead, PermMachinesRead, PermBackupRun, PermRestoreRun, PermAdmin},
+	RoleOperator: {PermHistoryRead, PermMachinesRead, PermBackupRun, PermRestoreRun},
+	RoleViewer:   {PermHistoryRead, PermMachinesRead},
+}
+
+// ValidRole reports whether role is one of the known roles.
+func ValidRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// RolePermissions returns the permissions granted by a role. Unknown roles
+// grant nothing.
+func RolePermissions(role string) []string {
+	return append([]string(nil), rolePermissions[role]...)
+}
+
+// ValidPermission reports whether permission is granted by any role, which
+// makes it usable as an API token scope.
+func ValidPermission(permission string) bool {
+	for _, p := range rolePermissions[RoleAdmin] {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,270 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"mysql-backup/internal/config"
+	"mysql-backup/internal/google"
+	"mysql-backup/internal/history"
+)
+
+// Names of the files the service uploads: backup_<machine>_<database>_<time>
+// for dumps and backup_<machine>_<time> for run manifests.
+var (
+	driveDumpName     = regexp.MustCompile(`^backup_(.+)_(\d{8}_\d{6})\.(sql|sql\.gz|zip)(\.gpg)?$`)
+	driveManifestName = regexp.MustCompile(`^backup_(.+)_(\d{8}_\d{6})` + regexp.QuoteMeta(ManifestExtension) + `$`)
+)
+
+// driveFile is a dump found in the Drive folder, with the catalog entry that
+// references it when there is one.
+type driveFile struct {
+	file      google.DriveFile
+	run       string // backup_<machine>_<database>, groups the backups of a database
+	timestamp time.Time
+	entry     *config.BackupLog
+	location  config.BackupLocation
+}
+
+// PlanDriveRetention lists the files in the Drive folder that the retention
+// policies would delete. The folder is listed rather than the catalog so that
+// backups uploaded before the history existed are cleaned up too.
+//
+// Files sent to a configured Drive storage are left to that storage's own
+// retention. The other dumps follow the GFS policy of their machine, applied
+// to catalogued and unknown files together. Without one, Backup.RetentionDays
+// only removes catalogued dumps: files the history does not know about are
+// never deleted unless a GFS policy was configured for them.
+func (s *Service) PlanDriveRetention() ([]RetentionDeletion, error) {
+	files, err := google.NewClient(s.config).ListFiles("")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list Drive folder: %w", err)
+	}
+	dumps := s.driveDumps(files)
+
+	var cutoff time.Time
+	if s.config.Backup.RetentionDays > 0 {
+		cutoff = time.Now().AddDate(0, 0, -s.config.Backup.RetentionDays)
+	}
+
+	var deletions []RetentionDeletion
+	groups := make(map[string][]driveFile)
+	var order []string
+	for _, dump := range dumps {
+		storageID := "drive"
+		if dump.entry != nil {
+			storageID = dump.location.Storage
+		}
+		if _, err := s.config.GetStorage(storageID); err == nil {
+			continue
+		}
+
+		machineID, _ := s.driveDumpOwner(dump)
+		if policy := s.retentionPolicyFor(machineID, storageID); policy.Enabled() {
+			if _, ok := groups[dump.run]; !ok {
+				order = append(order, dump.run)
+			}
+			groups[dump.run] = append(groups[dump.run], dump)
+			continue
+		}
+
+		if dump.entry != nil && !cutoff.IsZero() && dump.timestamp.Before(cutoff) {
+			deletions = append(deletions, s.driveDeletion(dump))
+		}
+	}
+
+	for _, run := range order {
+		group := groups[run]
+		sort.SliceStable(group, func(i, j int) bool { return group[i].timestamp.After(group[j].timestamp) })
+
+		machineID, _ := s.driveDumpOwner(group[0])
+		policy := s.retentionPolicyFor(machineID, "drive")
+		times := make([]time.Time, len(group))
+		for i, dump := range group {
+			times[i] = dump.timestamp
+		}
+		for i, keep := range selectGFS(times, policy) {
+			if !keep {
+				deletions = append(deletions, s.driveDeletion(group[i]))
+			}
+		}
+	}
+
+	return deletions, nil
+}
+
+// ApplyDriveRetention deletes the files listed by PlanDriveRetention, logs
+// each deletion and drops the manifests left without any dump of their run.
+func (s *Service) ApplyDriveRetention(ctx context.Context) ([]RetentionDeletion, error) {
+	deletions, err := s.PlanDriveRetention()
+	if err != nil {
+		return nil, err
+	}
+
+	client := google.NewClient(s.config)
+	failed := 0
+	for i := range deletions {
+		if ctx.Err() != nil {
+			return deletions[:i], ctx.Err()
+		}
+
+		deletion := &deletions[i]
+		err := client.DeleteFile(deletion.location.ID)
+		if err == google.ErrFileNotFound {
+			err = nil
+		}
+		s.recordDeletion(*deletion, err)
+		if err != nil {
+			deletion.Error = err.Error()
+			failed++
+			fmt.Printf("WARNING: Retention failed to remove %s from Google Drive: %v\n", deletion.Path, err)
+			continue
+		}
+
+		fmt.Printf("Retention removed %s from Google Drive\n", deletion.Path)
+		if deletion.BackupID != "" {
+			s.forgetLocations(deletion.BackupID, []config.BackupLocation{deletion.location})
+		}
+	}
+
+	if len(deletions) > 0 {
+		s.removeOrphanDriveManifests(client)
+	}
+
+	if failed > 0 {
+		return deletions, fmt.Errorf("failed to remove %d of %d backups from Google Drive", failed, len(deletions))
+	}
+	return deletions, nil
+}
+
+// driveDumps picks the dumps out of a Drive folder listing and matches them
+// with the catalog, by file ID or, for copies recorded without one, by name.
+func (s *Service) driveDumps(files []google.DriveFile) []driveFile {
+	type catalogRef struct {
+		entry    config.BackupLog
+		location config.BackupLocation
+	}
+	byID := make(map[string]catalogRef)
+	byName := make(map[string]catalogRef)
+	page := s.history.Query(history.Filter{Kind: "backup", Status: "success"})
+	for _, entry := range page.Logs {
+		for _, location := range entryLocations(entry) {
+			if location.Type != "drive" {
+				continue
+			}
+			if location.ID != "" {
+				byID[location.ID] = catalogRef{entry, location}
+			} else {
+				byName[location.Path] = catalogRef{entry, location}
+			}
+		}
+	}
+
+	var dumps []driveFile
+	for _, file := range files {
+		match := driveDumpName.FindStringSubmatch(file.Name)
+		if match == nil {
+			continue
+		}
+
+		dump := driveFile{
+			file:      file,
+			run:       match[1],
+			timestamp: file.CreatedTime,
+			location:  config.BackupLocation{Storage: "drive", Type: "drive", Path: file.Name, ID: file.ID},
+		}
+		if t, err := time.ParseInLocation("20060102_150405", match[2], time.Local); err == nil {
+			dump.timestamp = t
+		}
+
+		ref, ok := byID[file.ID]
+		if !ok {
+			ref, ok = byName[file.Name]
+		}
+		if ok {
+			entry := ref.entry
+			dump.entry = &entry
+			dump.location = ref.location
+			dump.location.ID = file.ID
+			dump.timestamp = entry.Timestamp
+		}
+		dumps = append(dumps, dump)
+	}
+	return dumps
+}
+
+// driveDumpOwner returns the machine and database of a dump, from the catalog
+// or by matching the start of its name with the configured machines.
+func (s *Service) driveDumpOwner(dump driveFile) (string, string) {
+	if dump.entry != nil {
+		return dump.entry.MachineID, dump.entry.TableName
+	}
+
+	machineID, database, matched := "", "", 0
+	for _, machine := range s.config.Machines {
+		prefix := sanitizeName(machine.Name) + "_"
+		if strings.HasPrefix(dump.run, prefix) && len(prefix) > matched {
+			machineID, database, matched = machine.ID, strings.TrimPrefix(dump.run, prefix), len(prefix)
+		}
+	}
+	return machineID, database
+}
+
+func (s *Service) driveDeletion(dump driveFile) RetentionDeletion {
+	machineID, database := s.driveDumpOwner(dump)
+	deletion := RetentionDeletion{
+		MachineID: machineID,
+		Database:  database,
+		FileName:  dump.file.Name,
+		Timestamp: dump.timestamp,
+		Storage:   dump.location.Storage,
+		Path:      dump.file.Name,
+		location:  dump.location,
+	}
+	if dump.entry != nil {
+		deletion.BackupID = dump.entry.ID
+	}
+	return deletion
+}
+
+// removeOrphanDriveManifests deletes the run manifests in the Drive folder
+// once no dump of their run remains there.
+func (s *Service) removeOrphanDriveManifests(client *google.Client) {
+	files, err := client.ListFiles("")
+	if err != nil {
+		fmt.Printf("WARNING: Failed to list Drive folder: %v\n", err)
+		return
+	}
+
+	runs := make(map[string]bool)
+	for _, file := range files {
+		if match := driveDumpName.FindStringSubmatch(file.Name); match != nil {
+			runs[match[2]+"\x00"+match[1]] = true
+		}
+	}
+
+	for _, file := range files {
+		match := driveManifestName.FindStringSubmatch(file.Name)
+		if match == nil {
+			continue
+		}
+
+		orphan := true
+		for run := range runs {
+			timestamp, dumpRun, _ := strings.Cut(run, "\x00")
+			if timestamp == match[2] && strings.HasPrefix(dumpRun, match[1]+"_") {
+				orphan = false
+				break
+			}
+		}
+		if orphan {
+			if err := client.DeleteFile(file.ID); err != nil && err != google.ErrFileNotFound {
+				fmt.Printf("WARNING: Retention failed to remove manifest %s from Google Drive: %v\n", file.Name, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"mysql-backup/internal/config"
+	"mysql-backup/internal/google"
+	"mysql-backup/internal/history"
+)
+
+const (
+	fakeDriveFolder = "folder-1"
+	fakeDriveToken  = "access-token"
+	fakeSheetID     = "sheet-1"
+	fakeDrivePage   = 2
+)
+
+// fakeGoogle is an in-process Drive v3 and Sheets v4 server holding one
+// folder of files. It records every deletion and every row appended to the
+// sheet.
+type fakeGoogle struct {
+	t *testing.T
+
+	mu         sync.Mutex
+	files      []google.DriveFile
+	deleted    []string
+	rows       [][]string
+	failDelete map[string]bool // IDs cuja remoção responde 500
+}
+
+// newFakeGoogle starts the fake and points the Drive and Sheets endpoints of
+// the google package at it for the rest of the test.
+func newFakeGoogle(t *testing.T, files []google.DriveFile) *fakeGoogle {
+	fake := &fakeGoogle{t: t, files: files, failDelete: make(map[string]bool)}
+	server := httptest.NewServer(fake)
+
+	driveEndpoint, sheetsEndpoint := google.DriveEndpoint, google.SheetsEndpoint
+	google.DriveEndpoint, google.SheetsEndpoint = server.URL, server.URL
+	t.Cleanup(func() {
+		google.DriveEndpoint, google.SheetsEndpoint = driveEndpoint, sheetsEndpoint
+		server.Close()
+	})
+	return fake
+}
+
+func (f *fakeGoogle) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer "+fakeDriveToken {
+		http.Error(w, "missing token", http.StatusUnauthorized)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/drive/v3/files":
+		f.list(w, r)
+
+	case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/drive/v3/files/"):
+		id := strings.TrimPrefix(r.URL.Path, "/drive/v3/files/")
+		if f.failDelete[id] {
+			http.Error(w, "backend error", http.StatusInternalServerError)
+			return
+		}
+		for i, file := range f.files {
+			if file.ID == id {
+				f.files = append(f.files[:i], f.files[i+1:]...)
+				f.deleted = append(f.deleted, id)
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		http.Error(w, "file not found", http.StatusNotFound)
+
+	case r.Method == http.MethodPost && r.URL.Path == "/v4/spreadsheets/"+fakeSheetID+"/values/A:D:append":
+		var body struct {
+			Values [][]string `json:"values"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			f.t.Errorf("decode sheets row: %v", err)
+		}
+		f.rows = append(f.rows, body.Values...)
+		w.Write([]byte("{}"))
+
+	default:
+		f.t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		http.NotFound(w, r)
+	}
+}
+
+// list answers files.list in pages of fakeDrivePage files; the page token is
+// the offset of the next page.
+func (f *fakeGoogle) list(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query().Get("q")
+	if !strings.Contains(query, "trashed = false") || !strings.Contains(query, "'"+fakeDriveFolder+"' in parents") {
+		f.t.Errorf("list query = %q, want the non-trashed files of the folder", query)
+	}
+
+	offset := 0
+	if token := r.URL.Query().Get("pageToken"); token != "" {
+		offset, _ = strconv.Atoi(token)
+	}
+	end := offset + fakeDrivePage
+	if end > len(f.files) {
+		end = len(f.files)
+	}
+
+	page := map[string]interface{}{"files": f.files[offset:end]}
+	if end < len(f.files) {
+		page["nextPageToken"] = strconv.Itoa(end)
+	}
+	json.NewEncoder(w).Encode(page)
+}
+
+func TestApplyDriveRetention(t *testing.T) {
+	now := time.Now()
+	stamp := func(daysAgo int) string {
+		return now.AddDate(0, 0, -daysAgo).Format("20060102_150405")
+	}
+	file := func(id, name string) google.DriveFile {
+		return google.DriveFile{ID: id, Name: name, CreatedTime: now}
+	}
+
+	fake := newFakeGoogle(t, []google.DriveFile{
+		// Web Server: Backup.RetentionDays applies to catalogued files only
+		file("old-unknown", "backup_Web_Server_app_"+stamp(41)+".sql.gz"),
+		file("old-catalogued", "backup_Web_Server_shop_"+stamp(40)+".sql.gz.gpg"),
+		file("old-manifest", "backup_Web_Server_"+stamp(40)+ManifestExtension),
+		file("recent", "backup_Web_Server_app_"+stamp(1)+".sql.gz"),
+		file("recent-manifest", "backup_Web_Server_"+stamp(1)+ManifestExtension),
+		file("archived", "backup_Web_Server_app_"+stamp(50)+".sql.gz"),
+		file("notes", "notes.txt"),
+		// DB: its GFS policy keeps the newest backup of the last 2 days
+		file("db-3", "backup_DB_main_"+stamp(3)+".sql.gz"),
+		file("db-2", "backup_DB_main_"+stamp(2)+".sql.gz"),
+		file("db-1", "backup_DB_main_"+stamp(1)+".sql.gz"),
+	})
+	fake.failDelete["db-3"] = true
+
+	cfg := &config.Config{
+		Machines: []config.Machine{
+			{ID: "m1", Name: "Web Server"},
+			{ID: "m2", Name: "DB", Retention: &config.RetentionPolicy{Daily: 2}},
+		},
+		// Files sent to a configured Drive storage follow that storage's retention
+		Storages: []config.StorageConfig{{ID: "archive", Name: "Arquivo", Type: "drive", Enabled: true}},
+		Google: config.GoogleConfig{
+			SheetID:      fakeSheetID,
+			DriveFolder:  fakeDriveFolder,
+			AccessToken:  fakeDriveToken,
+			RefreshToken: "refresh-token",
+		},
+		Backup: config.BackupConfig{RetentionDays: 30},
+	}
+
+	store, err := history.NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	catalogued, err := store.Add(config.BackupLog{
+		ID:        "backup-shop",
+		Timestamp: now.AddDate(0, 0, -40),
+		MachineID: "m1",
+		TableName: "shop",
+		FileName:  "backup_Web_Server_shop_" + stamp(40) + ".sql.gz.gpg",
+		Success:   true,
+		Locations: []config.BackupLocation{{Storage: "drive", Type: "drive", Path: "backup_Web_Server_shop_" + stamp(40) + ".sql.gz.gpg", ID: "old-catalogued"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Add(config.BackupLog{
+		ID:        "backup-archived",
+		Timestamp: now.AddDate(0, 0, -50),
+		MachineID: "m1",
+		TableName: "app",
+		FileName:  "backup_Web_Server_app_" + stamp(50) + ".sql.gz",
+		Success:   true,
+		Locations: []config.BackupLocation{{Storage: "archive", Type: "drive", Path: "backup_Web_Server_app_" + stamp(50) + ".sql.gz", ID: "archived"}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	service := NewService(cfg, store)
+
+	planned, err := service.PlanDriveRetention()
+	if err != nil {
+		t.Fatalf("PlanDriveRetention: %v", err)
+	}
+	if len(fake.deleted) != 0 {
+		t.Fatalf("the plan deleted %v", fake.deleted)
+	}
+
+	deletions, err := service.ApplyDriveRetention(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "1 of 2") {
+		t.Errorf("ApplyDriveRetention error = %v, want the failed deletion reported", err)
+	}
+	if len(deletions) != len(planned) {
+		t.Errorf("applied %d deletions, planned %d", len(deletions), len(planned))
+	}
+
+	deleted := append([]string(nil), fake.deleted...)
+	sort.Strings(deleted)
+	if want := []string{"old-catalogued", "old-manifest"}; strings.Join(deleted, ",") != strings.Join(want, ",") {
+		t.Errorf("deleted files = %v, want %v", deleted, want)
+	}
+
+	// Every deletion of a dump, failed or not, is logged; manifests are not
+	prunes := store.Query(history.Filter{Kind: "prune"}).Logs
+	results := make(map[string]config.BackupLog)
+	for _, entry := range prunes {
+		results[entry.Locations[0].ID] = entry
+	}
+	if len(prunes) != 2 || len(results) != 2 {
+		t.Fatalf("prune entries = %+v, want one per deleted dump", prunes)
+	}
+	if entry := results["old-catalogued"]; !entry.Success || entry.PrunedID != catalogued.ID || entry.TableName != "shop" {
+		t.Errorf("prune of the catalogued dump = %+v", entry)
+	}
+	if entry := results["db-3"]; entry.Success || entry.Status != "failed" || !strings.Contains(entry.Error, "500") || entry.MachineID != "m2" || entry.TableName != "main" || entry.PrunedID != "" {
+		t.Errorf("prune of the failed deletion = %+v", entry)
+	}
+
+	var sheetRows []string
+	for _, row := range fake.rows {
+		if len(row) != 4 {
+			t.Fatalf("sheets row = %q, want 4 columns", row)
+		}
+		sheetRows = append(sheetRows, row[0]+" "+row[2])
+	}
+	sort.Strings(sheetRows)
+	wantRows := []string{
+		"ERRO backup_DB_main_" + stamp(3) + ".sql.gz",
+		"REMOVIDO backup_Web_Server_shop_" + stamp(40) + ".sql.gz.gpg",
+	}
+	if strings.Join(sheetRows, "\n") != strings.Join(wantRows, "\n") {
+		t.Errorf("sheets rows = %q, want %q", sheetRows, wantRows)
+	}
+
+	// The catalogued backup lost its only copy
+	entry, err := store.Get(catalogued.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.PrunedAt == nil || len(entry.Locations) != 0 {
+		t.Errorf("catalogued backup after retention = %+v, want pruned", entry)
+	}
+	if entry, _ := store.Get("backup-archived"); entry == nil || entry.PrunedAt != nil {
+		t.Errorf("backup in the archive storage was pruned: %+v", entry)
+	}
+}
@@ -0,0 +1,187 @@
+package backup
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// ManifestExtension is appended to the run name for the manifest file that
+// is stored next to the backup files of a run.
+const ManifestExtension = ".manifest.json"
+
+// Manifest describes one backup run: where it came from, what it contains and
+// how to check that each file is intact.
+type Manifest struct {
+	FormatVersion    int                `json:"format_version"`
+	MachineID        string             `json:"machine_id"`
+	MachineName      string             `json:"machine_name"`
+	ScheduleID       string             `json:"schedule_id,omitempty"`
+	Databases        []string           `json:"databases"`
+	MysqldumpVersion string             `json:"mysqldump_version,omitempty"`
+	ServerVersion    string             `json:"server_version,omitempty"`
+	Encrypted        bool               `json:"encrypted"`
+	StartedAt        time.Time          `json:"started_at"`
+	FinishedAt       time.Time          `json:"finished_at"`
+	Artifacts        []ManifestArtifact `json:"artifacts"`
+}
+
+// ManifestArtifact is a backup file produced by the run. The replication
+// coordinates are read right before the database is dumped.
+type ManifestArtifact struct {
+	Database         string          `json:"database"`
+	FileName         string          `json:"file_name"`
+	UncompressedSize int64           `json:"uncompressed_size"`
+	CompressedSize   int64           `json:"compressed_size"`
+	SHA256           string          `json:"sha256"`
+	GTIDExecuted     string          `json:"gtid_executed,omitempty"`
+	BinlogFile       string          `json:"binlog_file,omitempty"`
+	BinlogPosition   int64           `json:"binlog_position,omitempty"`
+	Tables           []ManifestTable `json:"tables,omitempty"`
+	StartedAt        time.Time       `json:"started_at"`
+	FinishedAt       time.Time       `json:"finished_at"`
+}
+
+// ManifestTable is the row count of a base table, taken right before the
+// dump. Restore drills compare restored tables against it. Counting rows
+// exactly would scan every table of the production server, so the count is
+// the estimate of information_schema, marked by Estimated.
+type ManifestTable struct {
+	Name      string `json:"name"`
+	Rows      int64  `json:"rows"`
+	Estimated bool   `json:"estimated,omitempty"`
+}
+
+// replicationPosition is the server's binlog/GTID state at a point in time.
+type replicationPosition struct {
+	GTIDExecuted   string
+	BinlogFile     string
+	BinlogPosition int64
+}
+
+func (m *Manifest) WriteFile(path string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %w", err)
+	}
+
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return nil
+}
+
+// ReadManifest decodes a manifest written by WriteFile.
+func ReadManifest(data []byte) (*Manifest, error) {
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to decode manifest: %w", err)
+	}
+	return &manifest, nil
+}
+
+// Artifact returns the entry for a backup file, or nil.
+func (m *Manifest) Artifact(fileName string) *ManifestArtifact {
+	for i := range m.Artifacts {
+		if m.Artifacts[i].FileName == fileName {
+			return &m.Artifacts[i]
+		}
+	}
+	return nil
+}
+
+func mysqldumpVersion() string {
+	output, err := exec.Command("mysqldump", "--version").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(output))
+}
+
+func serverVersion(db *sql.DB) string {
+	var version string
+	if err := db.QueryRow("SELECT VERSION()").Scan(&version); err != nil {
+		fmt.Printf("WARNING: Failed to read server version: %v\n", err)
+	}
+	return version
+}
+
+// readReplicationPosition collects what the server exposes; servers without
+// binary logging or GTIDs simply leave the fields empty.
+func readReplicationPosition(db *sql.DB) replicationPosition {
+	var position replicationPosition
+
+	var gtid sql.NullString
+	if err := db.QueryRow("SELECT @@GLOBAL.gtid_executed").Scan(&gtid); err == nil {
+		position.GTIDExecuted = strings.ReplaceAll(gtid.String, "\n", "")
+	}
+
+	// MySQL 8.4 replaced SHOW MASTER STATUS with SHOW BINARY LOG STATUS
+	for _, query := range []string{"SHOW BINARY LOG STATUS", "SHOW MASTER STATUS"} {
+		rows, err := db.Query(query)
+		if err != nil {
+			continue
+		}
+
+		columns, _ := rows.Columns()
+		if rows.Next() && len(columns) >= 2 {
+			values := make([]sql.RawBytes, len(columns))
+			pointers := make([]interface{}, len(columns))
+			for i := range values {
+				pointers[i] = &values[i]
+			}
+			if err := rows.Scan(pointers...); err == nil {
+				position.BinlogFile = string(values[0])
+				fmt.Sscanf(string(values[1]), "%d", &position.BinlogPosition)
+			}
+		}
+		rows.Close()
+		break
+	}
+
+	return position
+}
+
+// readTableStats lists the base tables of database with their row counts:
+// exact counts, which scan every table, or the estimates of
+// information_schema.
+func readTableStats(db *sql.DB, database string, exact bool) ([]ManifestTable, error) {
+	rows, err := db.Query("SELECT TABLE_NAME, COALESCE(TABLE_ROWS, 0) FROM information_schema.TABLES WHERE TABLE_SCHEMA = ? AND TABLE_TYPE = 'BASE TABLE' ORDER BY TABLE_NAME", database)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tables: %w", err)
+	}
+
+	var tables []ManifestTable
+	for rows.Next() {
+		table := ManifestTable{Estimated: !exact}
+		if err := rows.Scan(&table.Name, &table.Rows); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		tables = append(tables, table)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if !exact {
+		return tables, nil
+	}
+
+	for i := range tables {
+		query := fmt.Sprintf("SELECT COUNT(*) FROM %s.%s", quoteIdentifier(database), quoteIdentifier(tables[i].Name))
+		if err := db.QueryRow(query).Scan(&tables[i].Rows); err != nil {
+			return nil, fmt.Errorf("failed to count rows of %s: %w", tables[i].Name, err)
+		}
+	}
+
+	return tables, nil
+}
+
+func quoteIdentifier(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
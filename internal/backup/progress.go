@@ -0,0 +1,128 @@
+package backup
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// Phases reported while a backup runs. Dumping and compression happen in one
+// stream; "compressing" covers finishing the compressed (and encrypted) file
+// once mysqldump is done.
+const (
+	PhaseTunnel      = "tunnel"
+	PhaseDumping     = "dumping"
+	PhaseCompressing = "compressing"
+	PhaseUploading   = "uploading"
+	PhaseDone        = "done"
+)
+
+// progressInterval throttles byte count updates.
+const progressInterval = 500 * time.Millisecond
+
+// Progress is the state of one database of a running backup, passed to
+// BackupOptions.Progress whenever it changes.
+type Progress struct {
+	Database     string        `json:"database,omitempty"` // Vazio durante a abertura do túnel
+	Phase        string        `json:"phase"`
+	BytesDumped  int64         `json:"bytes_dumped"`      // Saída do mysqldump (sem compressão)
+	BytesWritten int64         `json:"bytes_written"`     // Tamanho do arquivo gerado até agora
+	Storage      string        `json:"storage,omitempty"` // Destino sendo enviado
+	Result       *BackupResult `json:"result,omitempty"`  // Preenchido na fase "done"
+}
+
+// progressReporter tracks the progress of the current database and hands
+// copies to the callback. A nil reporter or callback discards updates.
+type progressReporter struct {
+	report  func(Progress)
+	mu      sync.Mutex
+	current Progress
+	last    time.Time
+}
+
+func newProgressReporter(report func(Progress)) *progressReporter {
+	if report == nil {
+		return nil
+	}
+	return &progressReporter{report: report}
+}
+
+// start begins a new database (or the tunnel, with an empty database).
+func (p *progressReporter) start(database, phase string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	p.current = Progress{Database: database, Phase: phase}
+	p.mu.Unlock()
+	p.flush()
+}
+
+func (p *progressReporter) phase(phase, storage string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	p.current.Phase = phase
+	p.current.Storage = storage
+	p.mu.Unlock()
+	p.flush()
+}
+
+func (p *progressReporter) done(result BackupResult) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	p.current.Phase = PhaseDone
+	p.current.Storage = ""
+	p.current.Result = &result
+	p.mu.Unlock()
+	p.flush()
+}
+
+func (p *progressReporter) add(dumped, written int64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	p.current.BytesDumped += dumped
+	p.current.BytesWritten += written
+	due := time.Since(p.last) >= progressInterval
+	p.mu.Unlock()
+	if due {
+		p.flush()
+	}
+}
+
+func (p *progressReporter) flush() {
+	p.mu.Lock()
+	progress := p.current
+	p.last = time.Now()
+	p.mu.Unlock()
+	p.report(progress)
+}
+
+// progressReader counts the mysqldump output.
+type progressReader struct {
+	io.Reader
+	progress *progressReporter
+}
+
+func (r progressReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	r.progress.add(int64(n), 0)
+	return n, err
+}
+
+// progressWriter counts the bytes of the backup file.
+type progressWriter struct {
+	io.Writer
+	progress *progressReporter
+}
+
+func (w progressWriter) Write(b []byte) (int, error) {
+	n, err := w.Writer.Write(b)
+	w.progress.add(0, int64(n))
+	return n, err
+}
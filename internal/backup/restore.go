@@ -0,0 +1,423 @@
+package backup
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"mysql-backup/internal/config"
+	"mysql-backup/internal/encryption"
+	"mysql-backup/internal/google"
+	"mysql-backup/internal/storage"
+)
+
+// RestoreService replays backup files produced by Service into any registered
+// machine. Restores run as jobs of the job manager, which owns their progress
+// and cancellation.
+type RestoreService struct {
+	config        *config.Config
+	backupService *Service
+}
+
+type RestoreRequest struct {
+	FilePath       string `json:"file_path,omitempty"` // Relative to Backup.LocalPath
+	DriveID        string `json:"drive_id,omitempty"`
+	StorageID      string `json:"storage_id,omitempty"` // Read Key from a configured storage
+	Key            string `json:"key,omitempty"`
+	TargetDatabase string `json:"target_database,omitempty"` // Empty keeps the database name from the dump
+	// Encrypted backups need the ASCII-armored private key. It is only held in
+	// memory for the duration of the restore.
+	PrivateKey string `json:"private_key,omitempty"`
+	Passphrase string `json:"passphrase,omitempty"`
+}
+
+type RestoreStatus struct {
+	ID             string    `json:"id"`
+	MachineID      string    `json:"machine_id"`
+	Source         string    `json:"source"`
+	TargetDatabase string    `json:"target_database,omitempty"`
+	Encrypted      bool      `json:"encrypted,omitempty"`
+	Status         string    `json:"status"` // "running", "completed" or "failed"
+	BytesRead      int64     `json:"bytes_read"`
+	TotalBytes     int64     `json:"total_bytes"`
+	BytesRestored  int64     `json:"bytes_restored"`
+	StartedAt      time.Time `json:"started_at"`
+	FinishedAt     time.Time `json:"finished_at,omitempty"`
+	Duration       string    `json:"duration,omitempty"`
+	Error          string    `json:"error,omitempty"`
+}
+
+type restoreRun struct {
+	status        RestoreStatus
+	bytesRead     atomic.Int64
+	bytesRestored atomic.Int64
+}
+
+// restoreProgressInterval is how often a running restore reports progress.
+const restoreProgressInterval = 2 * time.Second
+
+var (
+	createDatabaseLine = regexp.MustCompile("^(CREATE DATABASE (?:/\\*!32312 IF NOT EXISTS\\*/ )?)`(?:[^`]|``)+`")
+	useDatabaseLine    = regexp.MustCompile("^USE `(?:[^`]|``)+`;")
+)
+
+func NewRestoreService(cfg *config.Config, backupService *Service) *RestoreService {
+	return &RestoreService{
+		config:        cfg,
+		backupService: backupService,
+	}
+}
+
+// CheckRestore validates a request before it is queued, so that a missing
+// backup or private key is reported right away instead of by a failed job.
+func (r *RestoreService) CheckRestore(ctx context.Context, machineID string, req RestoreRequest) error {
+	if _, err := r.config.GetMachine(machineID); err != nil {
+		return err
+	}
+	if err := checkRestoreRequest(req); err != nil {
+		return err
+	}
+
+	source, _, err := r.openSource(ctx, req)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	encrypted, _, err := encryption.IsEncrypted(source)
+	if err != nil {
+		return fmt.Errorf("failed to read backup: %w", err)
+	}
+	if encrypted && req.PrivateKey == "" {
+		return fmt.Errorf("backup is encrypted, private_key is required")
+	}
+	return nil
+}
+
+// Restore replays a backup into a machine and returns its final status. It
+// stops when ctx is done. progress, if set, is called periodically with the
+// bytes read and restored so far.
+func (r *RestoreService) Restore(ctx context.Context, id, machineID string, req RestoreRequest, progress func(RestoreStatus)) (RestoreStatus, error) {
+	run := &restoreRun{
+		status: RestoreStatus{
+			ID:             id,
+			MachineID:      machineID,
+			Source:         restoreSource(req),
+			TargetDatabase: req.TargetDatabase,
+			Status:         "running",
+			StartedAt:      time.Now(),
+		},
+	}
+
+	fmt.Printf("Starting restore %s from %s into machine %s\n", id, run.status.Source, machineID)
+
+	err := r.run(ctx, run, req, progress)
+
+	run.status.BytesRead = run.bytesRead.Load()
+	run.status.BytesRestored = run.bytesRestored.Load()
+	run.status.FinishedAt = time.Now()
+	run.status.Duration = run.status.FinishedAt.Sub(run.status.StartedAt).Round(time.Second).String()
+	if err != nil {
+		run.status.Status = "failed"
+		run.status.Error = err.Error()
+		fmt.Printf("ERROR: Restore %s failed: %v\n", id, err)
+		return run.status, err
+	}
+
+	run.status.Status = "completed"
+	fmt.Printf("Restore %s completed in %s\n", id, run.status.Duration)
+	return run.status, nil
+}
+
+func (r *RestoreService) run(ctx context.Context, run *restoreRun, req RestoreRequest, progress func(RestoreStatus)) error {
+	machine, err := r.config.GetMachine(run.status.MachineID)
+	if err != nil {
+		return err
+	}
+	if err := checkRestoreRequest(req); err != nil {
+		return err
+	}
+
+	source, totalBytes, err := r.openSource(ctx, req)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	encrypted, input, err := encryption.IsEncrypted(source)
+	if err != nil {
+		return fmt.Errorf("failed to read backup: %w", err)
+	}
+	if encrypted && req.PrivateKey == "" {
+		return fmt.Errorf("backup is encrypted, private_key is required")
+	}
+	run.status.Encrypted = encrypted
+	run.status.TotalBytes = totalBytes
+
+	if progress != nil {
+		done := make(chan struct{})
+		stopped := make(chan struct{})
+		go func() {
+			defer close(stopped)
+			ticker := time.NewTicker(restoreProgressInterval)
+			defer ticker.Stop()
+			for {
+				progress(run.snapshot())
+				select {
+				case <-ticker.C:
+				case <-done:
+					return
+				}
+			}
+		}()
+		defer func() {
+			close(done)
+			<-stopped
+		}()
+	}
+
+	return r.restore(ctx, run, machine, input, req)
+}
+
+// snapshot returns the status with the current byte counts. The rest of the
+// status must not change while the restore is running.
+func (run *restoreRun) snapshot() RestoreStatus {
+	status := run.status
+	status.BytesRead = run.bytesRead.Load()
+	status.BytesRestored = run.bytesRestored.Load()
+	return status
+}
+
+func checkRestoreRequest(req RestoreRequest) error {
+	sources := 0
+	for _, set := range []bool{req.FilePath != "", req.DriveID != "", req.StorageID != ""} {
+		if set {
+			sources++
+		}
+	}
+	if sources != 1 {
+		return fmt.Errorf("exactly one of file_path, drive_id or storage_id is required")
+	}
+	if req.StorageID != "" && req.Key == "" {
+		return fmt.Errorf("key is required when restoring from a storage")
+	}
+	return nil
+}
+
+func restoreSource(req RestoreRequest) string {
+	switch {
+	case req.DriveID != "":
+		return "drive:" + req.DriveID
+	case req.StorageID != "":
+		return req.StorageID + ":" + req.Key
+	default:
+		return "local:" + req.FilePath
+	}
+}
+
+func (r *RestoreService) openSource(ctx context.Context, req RestoreRequest) (io.ReadCloser, int64, error) {
+	if req.DriveID != "" {
+		if !r.config.IsGoogleAuthenticated() {
+			return nil, 0, fmt.Errorf("Google Drive not authenticated")
+		}
+		return google.NewClient(r.config).DownloadFile(ctx, req.DriveID)
+	}
+
+	if req.StorageID != "" {
+		storageConfig, err := r.config.GetStorage(req.StorageID)
+		if err != nil {
+			return nil, 0, err
+		}
+		backend, err := storage.New(r.config, *storageConfig)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		obj, err := backend.Stat(ctx, req.Key)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to find %s in storage %s: %w", req.Key, storageConfig.Name, err)
+		}
+		reader, err := backend.Get(ctx, req.Key)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to open %s in storage %s: %w", req.Key, storageConfig.Name, err)
+		}
+		return reader, obj.Size, nil
+	}
+
+	// Only allow files inside the configured backup directory
+	root := filepath.Clean(r.config.Backup.LocalPath)
+	path := filepath.Join(root, filepath.Clean("/"+req.FilePath))
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to open backup file: %w", err)
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, fmt.Errorf("failed to stat backup file: %w", err)
+	}
+
+	return file, stat.Size(), nil
+}
+
+func (r *RestoreService) restore(ctx context.Context, run *restoreRun, machine *config.Machine, source io.Reader, req RestoreRequest) error {
+	if _, err := exec.LookPath("mysql"); err != nil {
+		return fmt.Errorf("mysql client not found in PATH: %w", err)
+	}
+
+	var input io.Reader = &countingReader{reader: source, count: &run.bytesRead}
+	if run.status.Encrypted {
+		decrypted, err := encryption.DecryptReader(input, req.PrivateKey, req.Passphrase)
+		if err != nil {
+			return err
+		}
+		input = decrypted
+	}
+
+	gz, err := gzip.NewReader(bufio.NewReaderSize(input, 1<<20))
+	if err != nil {
+		return fmt.Errorf("failed to open gzip stream: %w", err)
+	}
+	defer gz.Close()
+
+	mysqlHost := machine.MySQL.Host
+	mysqlPort := machine.MySQL.Port
+
+	if machine.Type == "remote" {
+		localPort, cleanup, err := r.backupService.createSSHTunnel(ctx, machine)
+		if err != nil {
+			return fmt.Errorf("failed to create SSH tunnel: %w", err)
+		}
+		defer cleanup()
+
+		mysqlHost = "localhost"
+		mysqlPort, _ = strconv.Atoi(localPort)
+	}
+
+	args := []string{
+		"--protocol=TCP",
+		"-h", mysqlHost,
+		"-P", fmt.Sprintf("%d", mysqlPort),
+		"-u", machine.MySQL.Username,
+		fmt.Sprintf("-p%s", machine.MySQL.Password),
+		"--default-character-set=utf8mb4",
+		"--skip-ssl",
+	}
+
+	cmd := exec.CommandContext(ctx, "mysql", args...)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("failed to open mysql input: %w", err)
+	}
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start mysql client: %w", err)
+	}
+
+	output := &countingWriter{writer: stdin, count: &run.bytesRestored}
+	copyErr := copyRenamingDatabase(output, gz, run.status.TargetDatabase)
+	stdin.Close()
+
+	waitErr := cmd.Wait()
+
+	if stderr.Len() > 0 {
+		fmt.Printf("mysql warnings/errors: %s\n", stderr.String())
+	}
+
+	if waitErr != nil {
+		return fmt.Errorf("mysql client failed: %w: %s", waitErr, strings.TrimSpace(stderr.String()))
+	}
+	if copyErr != nil {
+		return fmt.Errorf("failed to replay backup: %w", copyErr)
+	}
+
+	return nil
+}
+
+// copyRenamingDatabase streams a dump into dst line by line. When target is set,
+// the CREATE DATABASE and USE statements emitted by mysqldump --databases are
+// rewritten to point at it; every other line passes through untouched.
+func copyRenamingDatabase(dst io.Writer, src io.Reader, target string) error {
+	if target == "" {
+		_, err := io.Copy(dst, src)
+		return err
+	}
+
+	quoted := "`" + strings.ReplaceAll(target, "`", "``") + "`"
+	reader := bufio.NewReaderSize(src, 64*1024)
+	atLineStart := true
+
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if len(chunk) > 0 {
+			if atLineStart {
+				chunk = rewriteDatabaseLine(chunk, quoted)
+			}
+			if _, werr := dst.Write(chunk); werr != nil {
+				return werr
+			}
+			atLineStart = chunk[len(chunk)-1] == '\n'
+		}
+
+		switch err {
+		case nil, bufio.ErrBufferFull:
+			continue
+		case io.EOF:
+			return nil
+		default:
+			return err
+		}
+	}
+}
+
+func rewriteDatabaseLine(line []byte, quoted string) []byte {
+	if loc := createDatabaseLine.FindSubmatchIndex(line); loc != nil {
+		rewritten := append([]byte{}, line[:loc[3]]...)
+		rewritten = append(rewritten, quoted...)
+		return append(rewritten, line[loc[1]:]...)
+	}
+
+	if loc := useDatabaseLine.FindIndex(line); loc != nil {
+		rewritten := []byte("USE " + quoted + ";")
+		return append(rewritten, line[loc[1]:]...)
+	}
+
+	return line
+}
+
+type countingReader struct {
+	reader io.Reader
+	count  *atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	c.count.Add(int64(n))
+	return n, err
+}
+
+type countingWriter struct {
+	writer io.Writer
+	count  *atomic.Int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.writer.Write(p)
+	c.count.Add(int64(n))
+	return n, err
+}
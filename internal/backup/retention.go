@@ -0,0 +1,341 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"mysql-backup/internal/config"
+	"mysql-backup/internal/google"
+	"mysql-backup/internal/history"
+	"mysql-backup/internal/storage"
+)
+
+// RetentionDeletion is a stored copy of a backup that the retention policy
+// removes, or would remove in a dry run.
+type RetentionDeletion struct {
+	BackupID  string    `json:"backup_id"`
+	MachineID string    `json:"machine_id"`
+	Database  string    `json:"database"`
+	FileName  string    `json:"file_name"`
+	Timestamp time.Time `json:"timestamp"`
+	Storage   string    `json:"storage"`
+	Path      string    `json:"path"`
+	Error     string    `json:"error,omitempty"` // Falha ao remover
+
+	location config.BackupLocation
+}
+
+// storedManifest is a run manifest in one storage.
+type storedManifest struct {
+	name    string
+	storage string
+}
+
+// retentionPolicyFor returns the policy for a machine's backups in a storage:
+// the storage's own, then the machine's, then the global one. The working
+// copies in Backup.LocalPath use the storage "local".
+func (s *Service) retentionPolicyFor(machineID, storageID string) config.RetentionPolicy {
+	if storageConfig, err := s.config.GetStorage(storageID); err == nil && storageConfig.Retention != nil {
+		return *storageConfig.Retention
+	}
+	if machine, err := s.config.GetMachine(machineID); err == nil && machine.Retention != nil {
+		return *machine.Retention
+	}
+	return s.config.Backup.Retention
+}
+
+// gfsConfigured reports whether a GFS policy is set at any level. Once it is,
+// it replaces the age-based RetentionDays cleanup.
+func (s *Service) gfsConfigured() bool {
+	if s.config.Backup.Retention.Enabled() {
+		return true
+	}
+	for _, machine := range s.config.Machines {
+		if machine.Retention != nil && machine.Retention.Enabled() {
+			return true
+		}
+	}
+	for _, storageConfig := range s.config.Storages {
+		if storageConfig.Retention != nil && storageConfig.Retention.Enabled() {
+			return true
+		}
+	}
+	return false
+}
+
+// PlanRetention lists the copies the GFS policies would delete, without
+// deleting anything. Backups are grouped per machine and database from the
+// history, and each destination holding copies is evaluated on its own.
+func (s *Service) PlanRetention() []RetentionDeletion {
+	// Newest first, which is the order selectGFS expects
+	page := s.history.Query(history.Filter{Kind: "backup", Status: "success"})
+
+	type group struct {
+		policy config.RetentionPolicy
+		copies []RetentionDeletion
+	}
+	groups := make(map[string]*group)
+	var order []string
+
+	for _, entry := range page.Logs {
+		if entry.PrunedAt != nil {
+			continue
+		}
+		for _, location := range entryLocations(entry) {
+			key := entry.MachineID + "\x00" + entry.TableName + "\x00" + location.Storage
+			g, ok := groups[key]
+			if !ok {
+				g = &group{policy: s.retentionPolicyFor(entry.MachineID, location.Storage)}
+				groups[key] = g
+				order = append(order, key)
+			}
+			g.copies = append(g.copies, RetentionDeletion{
+				BackupID:  entry.ID,
+				MachineID: entry.MachineID,
+				Database:  entry.TableName,
+				FileName:  entry.FileName,
+				Timestamp: entry.Timestamp,
+				Storage:   location.Storage,
+				Path:      location.Path,
+				location:  location,
+			})
+		}
+	}
+
+	var deletions []RetentionDeletion
+	for _, key := range order {
+		g := groups[key]
+		if !g.policy.Enabled() {
+			continue
+		}
+
+		times := make([]time.Time, len(g.copies))
+		for i, c := range g.copies {
+			times[i] = c.Timestamp
+		}
+		for i, keep := range selectGFS(times, g.policy) {
+			if !keep {
+				deletions = append(deletions, g.copies[i])
+			}
+		}
+	}
+	return deletions
+}
+
+// ApplyRetention deletes the copies listed by PlanRetention and removes them
+// from the history entries; an entry left without copies is marked pruned.
+// A run's manifest goes once no kept backup of that run remains next to it.
+func (s *Service) ApplyRetention(ctx context.Context) ([]RetentionDeletion, error) {
+	deletions := s.PlanRetention()
+
+	removed := make(map[string][]config.BackupLocation)
+	failed := 0
+	for i := range deletions {
+		deletion := &deletions[i]
+		err := deleteLocation(ctx, s.config, deletion.location)
+		s.recordDeletion(*deletion, err)
+		if err != nil {
+			deletion.Error = err.Error()
+			failed++
+			fmt.Printf("WARNING: Retention failed to remove %s from storage %s: %v\n", deletion.Path, deletion.Storage, err)
+			continue
+		}
+		fmt.Printf("Retention removed %s from storage %s\n", deletion.Path, deletion.Storage)
+		removed[deletion.BackupID] = append(removed[deletion.BackupID], deletion.location)
+	}
+
+	manifests := make(map[storedManifest]config.BackupLocation)
+	for id, locations := range removed {
+		entry := s.forgetLocations(id, locations)
+		if entry == nil || entry.Manifest == "" {
+			continue
+		}
+		for _, location := range locations {
+			manifests[storedManifest{entry.Manifest, location.Storage}] = location
+		}
+	}
+
+	for manifest, location := range manifests {
+		s.removeOrphanManifest(ctx, manifest.name, location)
+	}
+
+	if failed > 0 {
+		return deletions, fmt.Errorf("failed to remove %d of %d backups", failed, len(deletions))
+	}
+	return deletions, nil
+}
+
+// forgetLocations removes deleted copies from a history entry, marking it
+// pruned once none is left, and returns the updated entry.
+func (s *Service) forgetLocations(id string, locations []config.BackupLocation) *config.BackupLog {
+	entry, err := s.history.Get(id)
+	if err != nil {
+		return nil
+	}
+
+	entry.Locations = withoutLocations(entryLocations(*entry), locations)
+	for _, location := range locations {
+		if location.Type == "drive" && location.ID == entry.DriveID {
+			entry.DriveID = ""
+		}
+	}
+	if len(entry.Locations) == 0 {
+		now := time.Now()
+		entry.PrunedAt = &now
+	}
+
+	if err := s.history.Update(*entry); err != nil {
+		fmt.Printf("WARNING: Failed to update history entry %s: %v\n", id, err)
+	}
+	return entry
+}
+
+// recordDeletion logs a retention deletion, or the failure to delete, to the
+// history and the Sheets log.
+func (s *Service) recordDeletion(deletion RetentionDeletion, deleteErr error) {
+	entry := config.BackupLog{
+		Timestamp: time.Now(),
+		MachineID: deletion.MachineID,
+		Kind:      "prune",
+		PrunedID:  deletion.BackupID,
+		TableName: deletion.Database,
+		FileName:  deletion.FileName,
+		Success:   deleteErr == nil,
+		Locations: []config.BackupLocation{deletion.location},
+	}
+	if deleteErr != nil {
+		entry.Error = deleteErr.Error()
+	}
+
+	if _, err := s.history.Add(entry); err != nil {
+		fmt.Printf("WARNING: Failed to record retention history: %v\n", err)
+	}
+
+	if s.config.IsGoogleAuthenticated() {
+		google.NewClient(s.config).LogToSheets(entry)
+	}
+}
+
+// removeOrphanManifest deletes a run manifest from a storage once none of the
+// run's backups is kept there.
+func (s *Service) removeOrphanManifest(ctx context.Context, manifestName string, removed config.BackupLocation) {
+	page := s.history.Query(history.Filter{Kind: "backup", Status: "success"})
+	for _, entry := range page.Logs {
+		if entry.Manifest != manifestName {
+			continue
+		}
+		for _, location := range entryLocations(entry) {
+			if location.Storage == removed.Storage {
+				return
+			}
+		}
+	}
+
+	manifest := config.BackupLocation{Storage: removed.Storage, Type: removed.Type, Path: path.Join(path.Dir(removed.Path), manifestName)}
+	if removed.Storage == "local" {
+		manifest.Path = filepath.Join(filepath.Dir(removed.Path), manifestName)
+	}
+	if err := deleteLocation(ctx, s.config, manifest); err != nil {
+		fmt.Printf("WARNING: Retention failed to remove manifest %s from storage %s: %v\n", manifest.Path, manifest.Storage, err)
+	}
+}
+
+// selectGFS returns which of the backups (timestamps newest first) a policy
+// keeps: the newest one of each of the last N days, ISO weeks, months and
+// years that have backups.
+func selectGFS(times []time.Time, policy config.RetentionPolicy) []bool {
+	rules := []struct {
+		count  int
+		bucket func(time.Time) string
+	}{
+		{policy.Daily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{policy.Weekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+		{policy.Monthly, func(t time.Time) string { return t.Format("2006-01") }},
+		{policy.Yearly, func(t time.Time) string { return t.Format("2006") }},
+	}
+
+	keep := make([]bool, len(times))
+	for _, rule := range rules {
+		seen := make(map[string]bool)
+		for i, t := range times {
+			if len(seen) >= rule.count {
+				break
+			}
+			bucket := rule.bucket(t.In(time.Local))
+			if !seen[bucket] {
+				seen[bucket] = true
+				keep[i] = true
+			}
+		}
+	}
+	return keep
+}
+
+// entryLocations returns where a history entry's backup is stored, including
+// backups sent to Drive before locations were recorded.
+func entryLocations(entry config.BackupLog) []config.BackupLocation {
+	if len(entry.Locations) == 0 && entry.DriveID != "" {
+		return []config.BackupLocation{{Storage: "drive", Type: "drive", Path: entry.FileName, ID: entry.DriveID}}
+	}
+	return entry.Locations
+}
+
+func withoutLocations(locations, removed []config.BackupLocation) []config.BackupLocation {
+	var kept []config.BackupLocation
+	for _, location := range locations {
+		gone := false
+		for _, r := range removed {
+			gone = gone || (r.Storage == location.Storage && r.Path == location.Path)
+		}
+		if !gone {
+			kept = append(kept, location)
+		}
+	}
+	return kept
+}
+
+// deleteLocation removes one stored copy; a copy that is already gone counts
+// as removed.
+func deleteLocation(ctx context.Context, cfg *config.Config, location config.BackupLocation) error {
+	backend, key, err := locationBackend(cfg, location)
+	if err != nil {
+		return err
+	}
+	if err := backend.Delete(ctx, key); err != nil && err != storage.ErrNotFound {
+		return err
+	}
+	if location.Storage == "local" {
+		// Pending Drive upload session of a working copy
+		os.Remove(location.Path + ".upload")
+	}
+	return nil
+}
+
+// locationBackend opens the backend holding a stored copy and returns the key
+// of the copy in it.
+func locationBackend(cfg *config.Config, location config.BackupLocation) (storage.Backend, string, error) {
+	if location.Storage == "local" {
+		backend, err := storage.NewLocalBackend("local", filepath.Dir(location.Path))
+		return backend, filepath.Base(location.Path), err
+	}
+
+	storageConfig, err := cfg.GetStorage(location.Storage)
+	if err != nil {
+		// Backups sent to Drive before storages existed
+		if location.Type == "drive" {
+			backend, err := storage.NewDriveBackend(location.Storage, cfg)
+			return backend, location.Path, err
+		}
+		return nil, "", err
+	}
+
+	backend, err := storage.New(cfg, *storageConfig)
+	return backend, location.Path, err
+}
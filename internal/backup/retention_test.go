@@ -0,0 +1,132 @@
+package backup
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"mysql-backup/internal/config"
+)
+
+func TestSelectGFS(t *testing.T) {
+	// Buckets are computed in local time, so the backups are too
+	at := func(year int, month time.Month, day, hour, min int) time.Time {
+		return time.Date(year, month, day, hour, min, 0, 0, time.Local)
+	}
+
+	tests := []struct {
+		name   string
+		policy config.RetentionPolicy
+		times  []time.Time // Mais recentes primeiro
+		keep   []int
+	}{
+		{
+			name:   "daily keeps the newest backup of each day",
+			policy: config.RetentionPolicy{Daily: 3},
+			times: []time.Time{
+				at(2024, 3, 5, 23, 0),
+				at(2024, 3, 5, 2, 0),
+				at(2024, 3, 4, 12, 0),
+				at(2024, 3, 3, 12, 0),
+				at(2024, 3, 2, 12, 0),
+			},
+			keep: []int{0, 2, 3},
+		},
+		{
+			name:   "daily counts days with backups, not calendar days",
+			policy: config.RetentionPolicy{Daily: 2},
+			times:  []time.Time{at(2024, 3, 10, 2, 0), at(2024, 3, 5, 2, 0), at(2024, 3, 1, 2, 0)},
+			keep:   []int{0, 1},
+		},
+		{
+			name:   "daily boundary is midnight",
+			policy: config.RetentionPolicy{Daily: 1},
+			times:  []time.Time{at(2024, 3, 5, 0, 0), at(2024, 3, 4, 23, 59)},
+			keep:   []int{0},
+		},
+		{
+			name:   "ties keep only the first backup of the bucket",
+			policy: config.RetentionPolicy{Daily: 2},
+			times:  []time.Time{at(2024, 3, 5, 2, 0), at(2024, 3, 5, 2, 0), at(2024, 3, 4, 2, 0)},
+			keep:   []int{0, 2},
+		},
+		{
+			name:   "weekly uses ISO weeks starting on Monday",
+			policy: config.RetentionPolicy{Weekly: 3},
+			times: []time.Time{
+				at(2024, 3, 11, 1, 0),  // Segunda, semana 11
+				at(2024, 3, 10, 23, 0), // Domingo, semana 10
+				at(2024, 3, 9, 12, 0),
+				at(2024, 3, 4, 0, 0), // Segunda, semana 10
+				at(2024, 3, 3, 23, 59),
+			},
+			keep: []int{0, 1, 4},
+		},
+		{
+			name:   "weekly across the year boundary",
+			policy: config.RetentionPolicy{Weekly: 2},
+			times: []time.Time{
+				at(2025, 1, 2, 2, 0),
+				at(2024, 12, 30, 2, 0), // Já é a semana 1 de 2025
+				at(2024, 12, 29, 2, 0),
+			},
+			keep: []int{0, 2},
+		},
+		{
+			name:   "monthly boundary",
+			policy: config.RetentionPolicy{Monthly: 3},
+			times: []time.Time{
+				at(2024, 4, 1, 0, 0),
+				at(2024, 3, 31, 23, 59),
+				at(2024, 3, 15, 2, 0),
+				at(2024, 2, 29, 2, 0),
+				at(2024, 2, 1, 2, 0),
+			},
+			keep: []int{0, 1, 3},
+		},
+		{
+			name:   "yearly keeps the newest backup of each year",
+			policy: config.RetentionPolicy{Yearly: 2},
+			times:  []time.Time{at(2024, 1, 1, 0, 0), at(2023, 12, 31, 23, 59), at(2023, 6, 1, 2, 0), at(2022, 6, 1, 2, 0)},
+			keep:   []int{0, 1},
+		},
+		{
+			name:   "rules add up",
+			policy: config.RetentionPolicy{Daily: 2, Weekly: 2, Monthly: 3},
+			times: []time.Time{
+				at(2024, 3, 12, 10, 0),
+				at(2024, 3, 12, 8, 0),
+				at(2024, 3, 11, 2, 0),
+				at(2024, 3, 5, 2, 0),
+				at(2024, 2, 20, 2, 0),
+				at(2024, 1, 10, 2, 0),
+			},
+			keep: []int{0, 2, 3, 4, 5},
+		},
+		{
+			name:   "more buckets than backups",
+			policy: config.RetentionPolicy{Daily: 10},
+			times:  []time.Time{at(2024, 3, 5, 2, 0), at(2024, 3, 4, 2, 0)},
+			keep:   []int{0, 1},
+		},
+		{
+			name:   "empty policy keeps nothing",
+			policy: config.RetentionPolicy{},
+			times:  []time.Time{at(2024, 3, 5, 2, 0), at(2024, 3, 4, 2, 0)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := make([]bool, len(tt.times))
+			for _, i := range tt.keep {
+				want[i] = true
+			}
+
+			got := selectGFS(tt.times, tt.policy)
+			if fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("selectGFS = %v, want %v", got, want)
+			}
+		})
+	}
+}
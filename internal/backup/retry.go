@@ -0,0 +1,143 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+
+	"mysql-backup/internal/config"
+)
+
+// Error classes a retry policy can list in RetryOn. Errors of no class, such
+// as a missing mysqldump or bad credentials, are never retried.
+const (
+	ErrorNetwork = "network" // SSH, túnel ou conexão recusada/perdida
+	ErrorTimeout = "timeout"
+	ErrorServer  = "server" // Resposta 5xx ou 429 de um destino
+	ErrorDump    = "dump"   // mysqldump terminou com erro
+)
+
+// ErrorClasses lists the valid RetryOn values.
+var ErrorClasses = []string{ErrorNetwork, ErrorTimeout, ErrorServer, ErrorDump}
+
+// serverStatus matches the HTTP status the storage clients put in their errors.
+var serverStatus = regexp.MustCompile(`status:? (5\d\d|429)\b`)
+
+// classifyError returns the class of err, or "" when retrying cannot help.
+func classifyError(err error) string {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return ""
+	}
+
+	message := strings.ToLower(err.Error())
+	var netErr net.Error
+	var exitErr *exec.ExitError
+	switch {
+	case strings.Contains(message, "unable to authenticate"):
+		return ""
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return ErrorTimeout
+	case errors.As(err, &netErr):
+		return ErrorNetwork
+	case errors.As(err, &exitErr):
+		// mysqldump reports lost connections through its exit status
+		if containsAny(message, "2002", "2003", "2006", "2013", "lost connection", "can't connect") {
+			return ErrorNetwork
+		}
+		return ErrorDump
+	case strings.Contains(message, "timeout") || strings.Contains(message, "timed out"):
+		return ErrorTimeout
+	case containsAny(message, "connection refused", "connection reset", "broken pipe", "no route to host",
+		"unexpected eof", "connect failed"):
+		return ErrorNetwork
+	case serverStatus.MatchString(message):
+		return ErrorServer
+	}
+	return ""
+}
+
+func containsAny(s string, substrings ...string) bool {
+	for _, substring := range substrings {
+		if strings.Contains(s, substring) {
+			return true
+		}
+	}
+	return false
+}
+
+// retry runs fn until it succeeds, the policy gives up or ctx is done. Once a
+// second attempt has run, every attempt of the stage is appended to attempts
+// (if not nil); a stage that ran once leaves none.
+func retry(ctx context.Context, policy config.RetryPolicy, stage, storageName string, attempts *[]config.BackupAttempt, fn func(attempt int) error) error {
+	maxAttempts := policy.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+
+	var tries []config.BackupAttempt
+	for attempt := 1; ; attempt++ {
+		startedAt := time.Now()
+		err := fn(attempt)
+
+		try := config.BackupAttempt{
+			Stage:      stage,
+			Storage:    storageName,
+			Attempt:    attempt,
+			StartedAt:  startedAt,
+			DurationMs: time.Since(startedAt).Milliseconds(),
+		}
+		if err != nil {
+			try.Class = classifyError(err)
+			try.Error = err.Error()
+		}
+		tries = append(tries, try)
+
+		if err == nil || attempt >= maxAttempts || ctx.Err() != nil || !retries(policy, try.Class) {
+			if attempts != nil && len(tries) > 1 {
+				*attempts = append(*attempts, tries...)
+			}
+			return err
+		}
+
+		wait := backoff(policy, attempt)
+		fmt.Printf("WARNING: %s attempt %d/%d failed (%s): %v, retrying in %s\n", stage, attempt, maxAttempts, try.Class, err, wait)
+		select {
+		case <-ctx.Done():
+			if attempts != nil && len(tries) > 1 {
+				*attempts = append(*attempts, tries...)
+			}
+			return err
+		case <-time.After(wait):
+		}
+	}
+}
+
+func retries(policy config.RetryPolicy, class string) bool {
+	if class == "" {
+		return false
+	}
+	for _, retryable := range policy.RetryOn {
+		if retryable == class {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff is the wait before the retry that follows the given attempt.
+func backoff(policy config.RetryPolicy, attempt int) time.Duration {
+	maxBackoff := time.Duration(policy.MaxBackoff) * time.Second
+	wait := time.Duration(policy.InitialBackoff) * time.Second
+	for i := 1; i < attempt && (maxBackoff <= 0 || wait < maxBackoff); i++ {
+		wait *= 2
+	}
+	if maxBackoff > 0 && wait > maxBackoff {
+		wait = maxBackoff
+	}
+	return wait
+}
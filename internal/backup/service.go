@@ -2,8 +2,13 @@ package backup
 
 import (
 	"archive/zip"
+	"bufio"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -16,14 +21,40 @@ import (
 	"time"
 
 	"mysql-backup/internal/config"
+	"mysql-backup/internal/encryption"
 	"mysql-backup/internal/google"
+	"mysql-backup/internal/history"
 	"mysql-backup/internal/ssh"
+	"mysql-backup/internal/storage"
 
 	_ "github.com/go-sql-driver/mysql"
+	"golang.org/x/crypto/openpgp"
 )
 
 type Service struct {
-	config *config.Config
+	config  *config.Config
+	history *history.Store
+}
+
+// BackupOptions carries per-run metadata that is recorded in the history.
+type BackupOptions struct {
+	ScheduleID string
+	CatchUp    bool           // Recovers a run missed while the process was down
+	StorageIDs []string       // Overrides the machine destinations when set
+	Progress   func(Progress) // Optional, called as the run advances
+}
+
+// destination is a storage backend selected for a backup run, tagged with its
+// configured type for the history and the layout of its keys.
+type destination struct {
+	storage.Backend
+	kind         string
+	pathTemplate string
+}
+
+type dumpStats struct {
+	Uncompressed int64
+	Checksum     string
 }
 
 type BackupResult struct {
@@ -42,9 +73,10 @@ type MachineBackupResult struct {
 	Error     string         `json:"error,omitempty"`
 }
 
-func NewService(cfg *config.Config) *Service {
+func NewService(cfg *config.Config, historyStore *history.Store) *Service {
 	return &Service{
-		config: cfg,
+		config:  cfg,
+		history: historyStore,
 	}
 }
 
@@ -75,6 +107,12 @@ func (s *Service) TestMachineConnection(machineID string) error {
 		return err
 	}
 
+	return s.TestMachine(machine)
+}
+
+// TestMachine checks that a machine can be reached, whether or not it is
+// saved in the configuration.
+func (s *Service) TestMachine(machine *config.Machine) error {
 	fmt.Printf("Testing connection for machine: %s (%s)\n", machine.Name, machine.Type)
 
 	if machine.Type == "remote" {
@@ -138,13 +176,13 @@ func (s *Service) GetMachineDatabases(machineID string) ([]string, error) {
 	return s.getDatabasesForMachine(machine)
 }
 
-func (s *Service) CreateMachineBackup(ctx context.Context, machineID string, databases []string) ([]BackupResult, error) {
+func (s *Service) CreateMachineBackup(ctx context.Context, machineID string, databases []string, opts BackupOptions) ([]BackupResult, error) {
 	machine, err := s.config.GetMachine(machineID)
 	if err != nil {
 		return nil, err
 	}
 
-	return s.createBackupForMachine(ctx, machine, databases)
+	return s.createBackupForMachine(ctx, machine, databases, opts)
 }
 
 func (s *Service) testMySQLConnection(machine *config.Machine) error {
@@ -153,7 +191,7 @@ func (s *Service) testMySQLConnection(machine *config.Machine) error {
 
 	if machine.Type == "remote" {
 		// Create SSH tunnel for remote connection
-		localPort, tunnelCleanup, err := s.createSSHTunnel(machine)
+		localPort, tunnelCleanup, err := s.createSSHTunnel(context.Background(), machine)
 		if err != nil {
 			return fmt.Errorf("failed to create SSH tunnel: %w", err)
 		}
@@ -205,7 +243,7 @@ func (s *Service) getDatabasesForMachine(machine *config.Machine) ([]string, err
 
 	if machine.Type == "remote" {
 		// Create SSH tunnel for remote connection
-		localPort, tunnelCleanup, err := s.createSSHTunnel(machine)
+		localPort, tunnelCleanup, err := s.createSSHTunnel(context.Background(), machine)
 		if err != nil {
 			return nil, fmt.Errorf("failed to create SSH tunnel: %w", err)
 		}
@@ -274,7 +312,7 @@ func (s *Service) getDatabasesForMachine(machine *config.Machine) ([]string, err
 	return databases, nil
 }
 
-func (s *Service) createBackupForMachine(ctx context.Context, machine *config.Machine, databases []string) ([]BackupResult, error) {
+func (s *Service) createBackupForMachine(ctx context.Context, machine *config.Machine, databases []string, opts BackupOptions) ([]BackupResult, error) {
 	fmt.Printf("Starting backup process for machine %s (%s) for %d databases: %v\n", machine.ID, machine.Name, len(databases), databases)
 
 	// Sanitize machine name for file naming
@@ -288,45 +326,161 @@ func (s *Service) createBackupForMachine(ctx context.Context, machine *config.Ma
 	}
 	fmt.Printf("Backup directory: %s\n", backupPath)
 
+	// Never fall back to plain files when encryption is enabled but unusable
+	var recipients openpgp.EntityList
+	if s.config.Backup.Encryption.Enabled {
+		parsed, err := encryption.ParseRecipients(s.config.Backup.Encryption.Recipients)
+		if err != nil {
+			return nil, fmt.Errorf("backup encryption is enabled but not usable: %w", err)
+		}
+		recipients = parsed
+	}
+
 	var results []BackupResult
 	timestamp := time.Now().Format("20060102_150405")
+	destinations := s.resolveDestinations(machine, opts)
+	progress := newProgressReporter(opts.Progress)
+
+	retryConfig := s.config.Backup.Retry
 
 	// Setup connection parameters
 	var mysqlHost string
 	var mysqlPort int
-	var cleanup func()
+	cleanup := func() {}
+	defer func() { cleanup() }()
+
+	// connect opens the SSH tunnel of remote machines, replacing the previous
+	// one when a dump is retried after a dropped connection
+	connect := func() error {
+		if machine.Type != "remote" {
+			mysqlHost = machine.MySQL.Host
+			mysqlPort = machine.MySQL.Port
+			fmt.Printf("Direct MySQL connection: %s:%d\n", mysqlHost, mysqlPort)
+			return nil
+		}
 
-	if machine.Type == "remote" {
-		// Create SSH tunnel for remote connection
-		localPort, tunnelCleanup, err := s.createSSHTunnel(machine)
+		cleanup()
+		cleanup = func() {}
+		localPort, tunnelCleanup, err := s.createSSHTunnel(ctx, machine)
 		if err != nil {
-			return nil, fmt.Errorf("failed to create SSH tunnel: %w", err)
+			return fmt.Errorf("failed to create SSH tunnel: %w", err)
 		}
 		cleanup = tunnelCleanup
-		defer cleanup()
 
 		mysqlHost = "localhost"
 		port, _ := strconv.Atoi(localPort)
 		mysqlPort = port
 		fmt.Printf("Using SSH tunnel: localhost:%d -> %s:%d\n", mysqlPort, machine.MySQL.Host, machine.MySQL.Port)
-	} else {
-		mysqlHost = machine.MySQL.Host
-		mysqlPort = machine.MySQL.Port
-		fmt.Printf("Direct MySQL connection: %s:%d\n", mysqlHost, mysqlPort)
+		return nil
+	}
+
+	if machine.Type == "remote" {
+		progress.start("", PhaseTunnel)
+	}
+	// Retried connections are recorded with the first database; when the
+	// server cannot be reached at all, every database gets a failed entry
+	var connectAttempts []config.BackupAttempt
+	connectStartedAt := time.Now()
+	if err := retry(ctx, retryConfig.Dump, "connect", "", &connectAttempts, func(int) error { return connect() }); err != nil {
+		status := ""
+		if errors.Is(ctx.Err(), context.Canceled) {
+			status = "cancelled"
+		}
+		for _, database := range databases {
+			if _, err := s.history.Add(config.BackupLog{
+				Timestamp:  connectStartedAt,
+				MachineID:  machine.ID,
+				ScheduleID: opts.ScheduleID,
+				TableName:  database,
+				DurationMs: time.Since(connectStartedAt).Milliseconds(),
+				Encrypted:  recipients != nil,
+				Success:    false,
+				Status:     status,
+				Error:      err.Error(),
+				Attempts:   connectAttempts,
+				CatchUp:    opts.CatchUp,
+			}); err != nil {
+				fmt.Printf("WARNING: Failed to record backup history: %v\n", err)
+			}
+		}
+		return nil, err
+	}
+
+	manifestName := fmt.Sprintf("backup_%s_%s%s", sanitizedMachineName, timestamp, ManifestExtension)
+	manifest := &Manifest{
+		FormatVersion:    1,
+		MachineID:        machine.ID,
+		MachineName:      machine.Name,
+		ScheduleID:       opts.ScheduleID,
+		Databases:        databases,
+		MysqldumpVersion: mysqldumpVersion(),
+		Encrypted:        recipients != nil,
+		StartedAt:        time.Now(),
 	}
 
-	for _, database := range databases {
+	// Server metadata only feeds the manifest; backups proceed without it
+	metadataDB := s.openMetadataConnection(machine, mysqlHost, mysqlPort)
+	if metadataDB != nil {
+		defer metadataDB.Close()
+		manifest.ServerVersion = serverVersion(metadataDB)
+	}
+
+	for i, database := range databases {
+		if ctx.Err() != nil {
+			// Databases not started yet are reported but leave no history
+			for _, skipped := range databases[i:] {
+				results = append(results, BackupResult{Database: skipped, Error: interruptedError(ctx)})
+			}
+			break
+		}
+
 		fmt.Printf("\n=== Processing database: %s on machine %s ===\n", database, machine.Name)
+		progress.start(database, PhaseDumping)
 		result := BackupResult{Database: database}
+		startedAt := time.Now()
+		var stats dumpStats
+		var driveID string
+		var locations []config.BackupLocation
+		var interrupted bool
 
 		// Create backup for this database using machine name instead of ID
-		fileName := fmt.Sprintf("backup_%s_%s_%s.sql", sanitizedMachineName, database, timestamp)
+		fileName := fmt.Sprintf("backup_%s_%s_%s.sql.gz", sanitizedMachineName, database, timestamp)
+		if recipients != nil {
+			fileName += encryption.Extension
+		}
 		filePath := filepath.Join(backupPath, fileName)
 
-		if err := s.dumpDatabaseForMachine(machine, database, filePath, mysqlHost, mysqlPort); err != nil {
+		var position replicationPosition
+		var tables []ManifestTable
+		if metadataDB != nil {
+			position = readReplicationPosition(metadataDB)
+			tableStats, err := readTableStats(metadataDB, database, false)
+			if err != nil {
+				fmt.Printf("WARNING: Failed to read table statistics of %s: %v\n", database, err)
+			}
+			tables = tableStats
+		}
+
+		attempts := connectAttempts
+		connectAttempts = nil
+		err := retry(ctx, retryConfig.Dump, "dump", "", &attempts, func(attempt int) error {
+			if attempt > 1 {
+				progress.start(database, PhaseDumping)
+				if machine.Type == "remote" {
+					if err := connect(); err != nil {
+						return err
+					}
+				}
+			}
+			dumped, err := s.dumpDatabaseForMachine(ctx, machine, database, filePath, mysqlHost, mysqlPort, recipients, progress)
+			stats = dumped
+			return err
+		})
+		if err != nil {
 			fmt.Printf("ERROR: Failed to dump database %s on machine %s: %v\n", database, machine.Name, err)
 			result.Success = false
 			result.Error = err.Error()
+			interrupted = ctx.Err() != nil
 		} else {
 			result.Success = true
 			result.FileName = fileName
@@ -334,85 +488,303 @@ func (s *Service) createBackupForMachine(ctx context.Context, machine *config.Ma
 			// Get file size
 			if stat, err := os.Stat(filePath); err == nil {
 				result.FileSize = stat.Size()
-				fmt.Printf("Backup file created: %s (%.2f MB)\n", fileName, float64(result.FileSize)/(1024*1024))
+				fmt.Printf("Compressed file: %s (%.2f MB, %.2f MB uncompressed)\n", fileName,
+					float64(result.FileSize)/(1024*1024), float64(stats.Uncompressed)/(1024*1024))
 			}
 
-			// Compress file (sempre comprimir para .sql.gz)
-			compressedPath := filePath + ".gz"
-			if err := s.compressFileGzip(filePath, compressedPath); err == nil {
-				os.Remove(filePath) // Remove uncompressed file
-				result.FileName = fileName + ".gz"
-				filePath = compressedPath
-
-				// Update file size
-				if stat, err := os.Stat(filePath); err == nil {
-					result.FileSize = stat.Size()
-					fmt.Printf("Compressed file: %s (%.2f MB)\n", result.FileName, float64(result.FileSize)/(1024*1024))
+			manifest.Artifacts = append(manifest.Artifacts, ManifestArtifact{
+				Database:         database,
+				FileName:         fileName,
+				UncompressedSize: stats.Uncompressed,
+				CompressedSize:   result.FileSize,
+				SHA256:           stats.Checksum,
+				GTIDExecuted:     position.GTIDExecuted,
+				BinlogFile:       position.BinlogFile,
+				BinlogPosition:   position.BinlogPosition,
+				Tables:           tables,
+				StartedAt:        startedAt,
+				FinishedAt:       time.Now(),
+			})
+
+			uploadErrors := 0
+			for _, dest := range destinations {
+				key := storage.KeyFor(dest.pathTemplate, machine.ID, database, startedAt, result.FileName)
+				fmt.Printf("Uploading %s to storage %s...\n", result.FileName, dest.Name())
+				progress.phase(PhaseUploading, dest.Name())
+				var obj storage.Object
+				err := retry(ctx, retryConfig.Upload, "upload", dest.Name(), &attempts, func(int) error {
+					var err error
+					obj, err = dest.Put(ctx, key, filePath)
+					return err
+				})
+				if err != nil {
+					fmt.Printf("WARNING: Failed to upload %s to storage %s: %v\n", result.FileName, dest.Name(), err)
+					uploadErrors++
+					continue
 				}
-			} else {
-				fmt.Printf("WARNING: Failed to compress file %s: %v\n", filePath, err)
-				// Continue without compression
-			}
 
-			// Upload to Google Drive if configured
-			if s.config.IsGoogleAuthenticated() {
-				fmt.Printf("Uploading to Google Drive...\n")
-				googleClient := google.NewClient(s.config)
-				if driveID, err := googleClient.UploadFile(filePath, result.FileName); err == nil {
-					fmt.Printf("Successfully uploaded %s to Google Drive (ID: %s)\n", result.FileName, driveID)
-
-					// Log to Google Sheets
-					googleClient.LogToSheets(config.BackupLog{
-						Timestamp: time.Now(),
-						MachineID: machine.ID,
-						TableName: database,
-						FileName:  result.FileName,
-						FileSize:  result.FileSize,
-						Success:   true,
-						DriveID:   driveID,
-					})
-
-					// SEMPRE remover arquivo local após upload bem-sucedido
-					os.Remove(filePath)
-					fmt.Printf("Local file %s removed after successful upload\n", filePath)
-				} else {
-					fmt.Printf("WARNING: Failed to upload %s to Google Drive: %v\n", result.FileName, err)
-					// Log error to Google Sheets
-					googleClient.LogToSheets(config.BackupLog{
-						Timestamp: time.Now(),
-						MachineID: machine.ID,
-						TableName: database,
-						FileName:  result.FileName,
-						FileSize:  result.FileSize,
-						Success:   false,
-						Error:     err.Error(),
-					})
+				location := config.BackupLocation{Storage: dest.Name(), Type: dest.kind, Path: obj.Key, ID: obj.ID}
+				if location.Type == "drive" {
+					driveID = obj.ID
 				}
+				locations = append(locations, location)
+				fmt.Printf("Successfully uploaded %s to storage %s\n", result.FileName, dest.Name())
+			}
+
+			if uploadErrors > 0 {
+				result.Error = fmt.Sprintf("upload failed for %d of %d destinations", uploadErrors, len(destinations))
+				interrupted = ctx.Err() != nil
+			}
+
+			// Log to Google Sheets
+			if s.config.IsGoogleAuthenticated() && !interrupted {
+				google.NewClient(s.config).LogToSheets(config.BackupLog{
+					Timestamp: time.Now(),
+					MachineID: machine.ID,
+					TableName: database,
+					FileName:  result.FileName,
+					FileSize:  result.FileSize,
+					Success:   uploadErrors == 0,
+					Error:     result.Error,
+					DriveID:   driveID,
+				})
+			}
+
+			// Only drop the working copy once every destination holds the file
+			if len(destinations) > 0 && uploadErrors == 0 && !s.config.Backup.KeepLocal {
+				os.Remove(filePath)
+				fmt.Printf("Local file %s removed after successful upload\n", filePath)
 			} else {
-				fmt.Printf("Google Drive not configured, keeping file locally\n")
+				locations = append(locations, config.BackupLocation{Storage: "local", Type: "local", Path: filePath})
+			}
+		}
+
+		status := ""
+		if interrupted {
+			// Cancelled or timed out midway: nothing of this database is kept
+			fmt.Printf("Backup of %s interrupted: %v\n", database, ctx.Err())
+			s.discardBackup(filePath, locations, destinations)
+			if result.Success {
+				manifest.Artifacts = manifest.Artifacts[:len(manifest.Artifacts)-1]
+			}
+			result = BackupResult{Database: database, Error: interruptedError(ctx)}
+			stats = dumpStats{}
+			driveID = ""
+			locations = nil
+			if errors.Is(ctx.Err(), context.Canceled) {
+				status = "cancelled"
 			}
 		}
 
 		// Add log entry
-		s.config.AddBackupLog(config.BackupLog{
-			Timestamp: time.Now(),
-			MachineID: machine.ID,
-			TableName: database,
-			FileName:  result.FileName,
-			FileSize:  result.FileSize,
-			Success:   result.Success,
-			Error:     result.Error,
-		})
+		logManifest := ""
+		if result.Success {
+			logManifest = manifestName
+		}
+		if _, err := s.history.Add(config.BackupLog{
+			Timestamp:        startedAt,
+			MachineID:        machine.ID,
+			ScheduleID:       opts.ScheduleID,
+			TableName:        database,
+			FileName:         result.FileName,
+			FileSize:         result.FileSize,
+			UncompressedSize: stats.Uncompressed,
+			DurationMs:       time.Since(startedAt).Milliseconds(),
+			Checksum:         stats.Checksum,
+			Encrypted:        recipients != nil,
+			Manifest:         logManifest,
+			Success:          result.Success,
+			Status:           status,
+			Error:            result.Error,
+			DriveID:          driveID,
+			Locations:        locations,
+			Attempts:         attempts,
+			CatchUp:          opts.CatchUp,
+		}); err != nil {
+			fmt.Printf("WARNING: Failed to record backup history: %v\n", err)
+		}
 
 		results = append(results, result)
+		progress.done(result)
 		fmt.Printf("=== Completed database: %s (Success: %v) ===\n", database, result.Success)
 	}
 
+	if len(manifest.Artifacts) > 0 {
+		manifest.FinishedAt = time.Now()
+		// Databases finished before an interruption still get their manifest
+		s.storeManifest(context.WithoutCancel(ctx), machine, manifest, filepath.Join(backupPath, manifestName), destinations)
+	}
+
 	fmt.Printf("\nBackup process completed. Results: %d total\n", len(results))
 	return results, nil
 }
 
-func (s *Service) createSSHTunnel(machine *config.Machine) (string, func(), error) {
+// discardBackup removes what an interrupted backup left behind: the local file,
+// a pending Drive upload session and the copies already uploaded.
+func (s *Service) discardBackup(filePath string, locations []config.BackupLocation, destinations []destination) {
+	os.Remove(filePath)
+	os.Remove(filePath + ".upload")
+
+	// ctx is already done; the cleanup gets its own deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	for _, location := range locations {
+		if location.Path == filePath {
+			continue
+		}
+		for _, dest := range destinations {
+			if dest.Name() != location.Storage {
+				continue
+			}
+			if err := dest.Delete(ctx, location.Path); err != nil {
+				fmt.Printf("WARNING: Failed to discard %s from storage %s: %v\n", location.Path, location.Storage, err)
+			}
+		}
+	}
+}
+
+// interruptedError describes why ctx stopped a backup.
+func interruptedError(ctx context.Context) string {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return "backup timed out"
+	}
+	return "backup cancelled"
+}
+
+// storeManifest writes the run manifest locally and copies it next to the
+// backup files in every destination. Failures are logged only: the backups
+// themselves are already stored.
+func (s *Service) storeManifest(ctx context.Context, machine *config.Machine, manifest *Manifest, manifestPath string, destinations []destination) {
+	if err := manifest.WriteFile(manifestPath); err != nil {
+		fmt.Printf("WARNING: %v\n", err)
+		return
+	}
+
+	manifestName := filepath.Base(manifestPath)
+	uploadErrors := 0
+	for _, dest := range destinations {
+		// With a {database} or {date} template the files of a run end up in
+		// several directories; each one gets a copy
+		keys := make(map[string]bool)
+		for _, artifact := range manifest.Artifacts {
+			keys[storage.KeyFor(dest.pathTemplate, machine.ID, artifact.Database, artifact.StartedAt, manifestName)] = true
+		}
+
+		for key := range keys {
+			if _, err := dest.Put(ctx, key, manifestPath); err != nil {
+				fmt.Printf("WARNING: Failed to upload manifest %s to storage %s: %v\n", key, dest.Name(), err)
+				uploadErrors++
+			}
+		}
+	}
+
+	if len(destinations) > 0 && uploadErrors == 0 && !s.config.Backup.KeepLocal {
+		os.Remove(manifestPath)
+	}
+}
+
+// openMachineDB connects to a machine's MySQL server, through an SSH tunnel
+// for remote machines. The returned cleanup closes both.
+func (s *Service) openMachineDB(ctx context.Context, machine *config.Machine) (*sql.DB, func(), error) {
+	mysqlHost := machine.MySQL.Host
+	mysqlPort := machine.MySQL.Port
+	tunnelCleanup := func() {}
+
+	if machine.Type == "remote" {
+		localPort, cleanup, err := s.createSSHTunnel(ctx, machine)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create SSH tunnel: %w", err)
+		}
+		tunnelCleanup = cleanup
+
+		mysqlHost = "localhost"
+		mysqlPort, _ = strconv.Atoi(localPort)
+	}
+
+	dsn := fmt.Sprintf("%s:%s@tcp(%s:%d)/", machine.MySQL.Username, machine.MySQL.Password, mysqlHost, mysqlPort)
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		tunnelCleanup()
+		return nil, nil, fmt.Errorf("failed to open MySQL connection: %w", err)
+	}
+
+	db.SetMaxOpenConns(1)
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		tunnelCleanup()
+		return nil, nil, fmt.Errorf("failed to ping MySQL server: %w", err)
+	}
+
+	return db, func() {
+		db.Close()
+		tunnelCleanup()
+	}, nil
+}
+
+// openMetadataConnection connects to the server being backed up to read
+// version and replication details, returning nil when that is not possible.
+func (s *Service) openMetadataConnection(machine *config.Machine, mysqlHost string, mysqlPort int) *sql.DB {
+	dsn := fmt.Sprintf("%s:%s@tcp(%s:%d)/", machine.MySQL.Username, machine.MySQL.Password, mysqlHost, mysqlPort)
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		fmt.Printf("WARNING: Failed to open MySQL connection for manifest: %v\n", err)
+		return nil
+	}
+
+	db.SetMaxOpenConns(1)
+	if err := db.Ping(); err != nil {
+		fmt.Printf("WARNING: Failed to connect to MySQL for manifest: %v\n", err)
+		db.Close()
+		return nil
+	}
+	return db
+}
+
+// resolveDestinations returns the backends a backup should be copied to: the
+// storages selected in opts, then the machine's, falling back to Google Drive
+// when authenticated. Storages that cannot be opened are skipped.
+func (s *Service) resolveDestinations(machine *config.Machine, opts BackupOptions) []destination {
+	storageIDs := opts.StorageIDs
+	if len(storageIDs) == 0 {
+		storageIDs = machine.StorageIDs
+	}
+
+	var destinations []destination
+	if len(storageIDs) == 0 {
+		if s.config.IsGoogleAuthenticated() {
+			if backend, err := storage.NewDriveBackend("drive", s.config); err == nil {
+				destinations = append(destinations, destination{Backend: backend, kind: "drive"})
+			}
+		} else {
+			fmt.Printf("No storage configured, keeping file locally\n")
+		}
+		return destinations
+	}
+
+	for _, id := range storageIDs {
+		storageConfig, err := s.config.GetStorage(id)
+		if err != nil {
+			fmt.Printf("WARNING: Storage %s not found, skipping\n", id)
+			continue
+		}
+		if !storageConfig.Enabled {
+			fmt.Printf("Storage %s is disabled, skipping\n", storageConfig.Name)
+			continue
+		}
+
+		backend, err := storage.New(s.config, *storageConfig)
+		if err != nil {
+			fmt.Printf("WARNING: Failed to open storage %s: %v\n", storageConfig.Name, err)
+			continue
+		}
+		destinations = append(destinations, destination{Backend: backend, kind: storageConfig.Type, pathTemplate: storageConfig.PathTemplate})
+	}
+
+	return destinations
+}
+
+func (s *Service) createSSHTunnel(ctx context.Context, machine *config.Machine) (string, func(), error) {
 	fmt.Printf("Creating SSH tunnel to %s@%s:%d\n", machine.SSH.Username, machine.SSH.Host, machine.SSH.Port)
 
 	sshClient := ssh.NewClient(&machine.SSH)
@@ -439,19 +811,27 @@ func (s *Service) createSSHTunnel(machine *config.Machine) (string, func(), erro
 
 	// Wait longer for tunnel to be ready
 	fmt.Printf("Waiting for SSH tunnel to be ready...\n")
-	time.Sleep(3 * time.Second)
+	select {
+	case <-ctx.Done():
+		cleanup()
+		return "", nil, ctx.Err()
+	case <-time.After(3 * time.Second):
+	}
 
 	fmt.Printf("SSH tunnel established: localhost:%s -> %s:%d\n", localPort, machine.MySQL.Host, machine.MySQL.Port)
 	return localPort, cleanup, nil
 }
 
-func (s *Service) dumpDatabaseForMachine(machine *config.Machine, database, filePath string, mysqlHost string, mysqlPort int) error {
+// dumpDatabaseForMachine streams mysqldump output through an in-process gzip
+// writer straight into filePath, so memory use stays bounded regardless of the
+// database size. It returns the uncompressed size and the SHA-256 of the file.
+func (s *Service) dumpDatabaseForMachine(ctx context.Context, machine *config.Machine, database, filePath string, mysqlHost string, mysqlPort int, recipients openpgp.EntityList, progress *progressReporter) (dumpStats, error) {
 	fmt.Printf("Creating COMPLETE backup for database: %s on machine: %s\n", database, machine.Name)
 	fmt.Printf("Output file: %s\n", filePath)
 	fmt.Printf("MySQL connection: %s@%s:%d\n", machine.MySQL.Username, mysqlHost, mysqlPort)
 
 	if _, err := exec.LookPath("mysqldump"); err != nil {
-		return fmt.Errorf("mysqldump not found in PATH: %w", err)
+		return dumpStats{}, fmt.Errorf("mysqldump not found in PATH: %w", err)
 	}
 
 	args := []string{
@@ -468,40 +848,125 @@ func (s *Service) dumpDatabaseForMachine(machine *config.Machine, database, file
 		"--skip-triggers",
 	}
 
-	cmd := exec.Command("mysqldump", args...)
+	// Cancelling ctx kills mysqldump, which ends the stream below
+	cmd := exec.CommandContext(ctx, "mysqldump", args...)
 	fmt.Println("Executing mysqldump with the following parameters:")
 	fmt.Println(strings.Join(args, " "))
 
-	var stdout, stderr strings.Builder
-	cmd.Stdout = &stdout
+	var stderr strings.Builder
 	cmd.Stderr = &stderr
 
-	err := cmd.Run()
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return dumpStats{}, fmt.Errorf("failed to open mysqldump output: %w", err)
+	}
+
+	file, err := os.Create(filePath)
+	if err != nil {
+		return dumpStats{}, fmt.Errorf("failed to create dump file: %w", err)
+	}
+
+	if err := cmd.Start(); err != nil {
+		file.Close()
+		os.Remove(filePath)
+		return dumpStats{}, fmt.Errorf("failed to start mysqldump: %w", err)
+	}
+
+	hash := sha256.New()
+	var output io.Writer = io.MultiWriter(file, hash)
+	var dump io.Reader = stdout
+	if progress != nil {
+		output = progressWriter{Writer: output, progress: progress}
+		dump = progressReader{Reader: stdout, progress: progress}
+	}
+	var encrypter io.WriteCloser
+	if recipients != nil {
+		if encrypter, err = encryption.EncryptWriter(output, recipients); err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			file.Close()
+			os.Remove(filePath)
+			return dumpStats{}, err
+		}
+		output = encrypter
+	}
+
+	written, err := writeCompressedDump(output, dump, func() { progress.phase(PhaseCompressing, "") })
+	if encrypter != nil {
+		if closeErr := encrypter.Close(); err == nil {
+			err = closeErr
+		}
+	}
+
+	// Always reap the process, even if the pipeline failed midway
+	waitErr := cmd.Wait()
 
 	if stderr.Len() > 0 {
 		fmt.Printf("mysqldump warnings/errors: %s\n", stderr.String())
 	}
 
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	switch {
+	case ctx.Err() != nil:
+		err = ctx.Err()
+	case err != nil:
+		err = fmt.Errorf("failed to write dump file: %w", err)
+	case waitErr != nil:
+		err = fmt.Errorf("mysqldump failed: %w: %s", waitErr, lastLine(stderr.String()))
+	case written == 0:
+		err = fmt.Errorf("mysqldump produced empty output")
+	}
 	if err != nil {
-		return fmt.Errorf("mysqldump failed: %w", err)
+		os.Remove(filePath)
+		return dumpStats{}, err
 	}
 
-	output := stdout.String()
-	fmt.Printf("mysqldump output size: %d bytes\n", len(output))
+	fmt.Printf("mysqldump output size: %d bytes\n", written)
+	fmt.Printf("Backup completed successfully. Dump file saved at: %s\n", filePath)
+	return dumpStats{Uncompressed: written, Checksum: hex.EncodeToString(hash.Sum(nil))}, nil
+}
 
-	if len(output) == 0 {
-		return fmt.Errorf("mysqldump produced empty output")
-	}
+// lastLine returns the last non-empty line of a command's output, where
+// mysqldump puts the error that stopped it.
+func lastLine(output string) string {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+// writeCompressedDump copies a mysqldump stream into dst as gzip, wrapping it
+// with the foreign_key_checks statements. The returned count only covers the
+// dump itself, not the injected header and footer. dumped is called once the
+// dump stream has been consumed.
+func writeCompressedDump(dst io.Writer, dump io.Reader, dumped func()) (int64, error) {
+	buffered := bufio.NewWriterSize(dst, 1<<20)
+	gz := gzip.NewWriter(buffered)
 
 	// Adding the disable foreign key check to the output
-	filteredOutput := "SET foreign_key_checks = 0;\n" + output + "\nSET foreign_key_checks = 1;"
+	if _, err := io.WriteString(gz, "SET foreign_key_checks = 0;\n"); err != nil {
+		return 0, err
+	}
 
-	if err := os.WriteFile(filePath, []byte(filteredOutput), 0644); err != nil {
-		return fmt.Errorf("failed to write dump file: %w", err)
+	written, err := io.Copy(gz, dump)
+	if err != nil {
+		// Drain the pipe so mysqldump is not left blocked on a full buffer
+		io.Copy(io.Discard, dump)
+		return written, err
 	}
 
-	fmt.Printf("Backup completed successfully. Dump file saved at: %s\n", filePath)
-	return nil
+	dumped()
+
+	if _, err := io.WriteString(gz, "\nSET foreign_key_checks = 1;"); err != nil {
+		return written, err
+	}
+
+	if err := gz.Close(); err != nil {
+		return written, err
+	}
+
+	return written, buffered.Flush()
 }
 
 // Backward compatibility methods
@@ -533,43 +998,7 @@ func (s *Service) CreateBackup(ctx context.Context, databases []string) ([]Backu
 	if err != nil {
 		return nil, err
 	}
-	return s.createBackupForMachine(ctx, localMachine, databases)
-}
-
-func (s *Service) compressFileGzip(srcPath, dstPath string) error {
-	fmt.Printf("Compressing file: %s -> %s\n", srcPath, dstPath)
-
-	// Verificar se gzip está disponível
-	if _, err := exec.LookPath("gzip"); err != nil {
-		fmt.Printf("gzip not found, skipping compression\n")
-		// Se gzip não estiver disponível, apenas renomeie o arquivo
-		return os.Rename(srcPath, strings.TrimSuffix(dstPath, ".gz"))
-	}
-
-	srcFile, err := os.Open(srcPath)
-	if err != nil {
-		return fmt.Errorf("failed to open source file: %w", err)
-	}
-	defer srcFile.Close()
-
-	dstFile, err := os.Create(dstPath)
-	if err != nil {
-		return fmt.Errorf("failed to create destination file: %w", err)
-	}
-	defer dstFile.Close()
-
-	// Use gzip compression with maximum compression (-9)
-	cmd := exec.Command("gzip", "-c")
-	cmd.Stdin = srcFile
-	cmd.Stdout = dstFile
-	cmd.Stderr = os.Stderr
-
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("gzip compression failed: %w", err)
-	}
-
-	fmt.Printf("Compression completed successfully\n")
-	return nil
+	return s.createBackupForMachine(ctx, localMachine, databases, BackupOptions{})
 }
 
 func (s *Service) compressFile(srcPath, dstPath string) error {
@@ -597,7 +1026,34 @@ func (s *Service) compressFile(srcPath, dstPath string) error {
 	return err
 }
 
-func (s *Service) CleanupOldBackups() error {
+// CleanupOldBackups applies the retention of every machine and storage.
+// Passes must not overlap; the job manager runs them one at a time.
+func (s *Service) CleanupOldBackups(ctx context.Context) error {
+	// GFS retention replaces the age-based cleanup once configured anywhere
+	var err error
+	if s.gfsConfigured() {
+		_, err = s.ApplyRetention(ctx)
+	} else {
+		s.cleanupStorages(ctx)
+		err = s.cleanupLocal()
+	}
+
+	// The Drive folder is swept on its own since it also holds backups the
+	// history does not know about
+	if s.config.IsGoogleAuthenticated() {
+		if _, driveErr := s.ApplyDriveRetention(ctx); driveErr != nil {
+			fmt.Printf("WARNING: Drive retention failed: %v\n", driveErr)
+			if err == nil {
+				err = driveErr
+			}
+		}
+	}
+
+	return err
+}
+
+// cleanupLocal removes working copies older than Backup.RetentionDays.
+func (s *Service) cleanupLocal() error {
 	if s.config.Backup.RetentionDays <= 0 {
 		return nil
 	}
@@ -610,7 +1066,9 @@ func (s *Service) CleanupOldBackups() error {
 		}
 
 		if !info.IsDir() && info.ModTime().Before(cutoff) {
-			if strings.HasSuffix(path, ".sql") || strings.HasSuffix(path, ".gz") || strings.HasSuffix(path, ".zip") {
+			// .upload files hold Drive upload sessions for files that failed to upload
+			if strings.HasSuffix(path, ".sql") || strings.HasSuffix(path, ".gz") || strings.HasSuffix(path, ".zip") || strings.HasSuffix(path, encryption.Extension) ||
+				strings.HasSuffix(path, ".upload") || strings.HasSuffix(path, ManifestExtension) {
 				fmt.Printf("Removing old backup: %s\n", path)
 				return os.Remove(path)
 			}
@@ -619,3 +1077,28 @@ func (s *Service) CleanupOldBackups() error {
 		return nil
 	})
 }
+
+// cleanupStorages applies each storage's own retention to the files it holds.
+// Failures are logged so one unreachable server does not block the others.
+func (s *Service) cleanupStorages(ctx context.Context) {
+	for _, storageConfig := range s.config.Storages {
+		if !storageConfig.Enabled || storageConfig.RetentionDays <= 0 {
+			continue
+		}
+
+		backend, err := storage.New(s.config, storageConfig)
+		if err != nil {
+			fmt.Printf("WARNING: Failed to open storage %s for cleanup: %v\n", storageConfig.Name, err)
+			continue
+		}
+
+		cutoff := time.Now().AddDate(0, 0, -storageConfig.RetentionDays)
+		removed, err := storage.Prune(ctx, backend, "", cutoff)
+		for _, obj := range removed {
+			fmt.Printf("Removed old backup %s from storage %s\n", obj.Key, storageConfig.Name)
+		}
+		if err != nil {
+			fmt.Printf("WARNING: Cleanup of storage %s failed: %v\n", storageConfig.Name, err)
+		}
+	}
+}
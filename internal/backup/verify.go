@@ -0,0 +1,323 @@
+package backup
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"mysql-backup/internal/config"
+	"mysql-backup/internal/history"
+	"mysql-backup/internal/storage"
+)
+
+// VerifyService runs restore drills: it restores the latest backups into a
+// scratch machine, checks the result against the run manifest and drops the
+// scratch database again. Outcomes are recorded in the history with kind
+// "verify".
+type VerifyService struct {
+	config         *config.Config
+	backupService  *Service
+	restoreService *RestoreService
+	history        *history.Store
+}
+
+type VerifyResult struct {
+	Database string `json:"database"`
+	BackupID string `json:"backup_id,omitempty"`
+	FileName string `json:"file_name,omitempty"`
+	Success  bool   `json:"success"`
+	Error    string `json:"error,omitempty"`
+	Tables   int    `json:"tables"`
+	Rows     int64  `json:"rows"`
+	// Diferenças de linhas em relação ao manifesto, que não reprovam a verificação
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// VerifyOptions tags the history entries of a verification run.
+type VerifyOptions struct {
+	ScheduleID string
+	CatchUp    bool // Recovers a run missed while the process was down
+}
+
+func NewVerifyService(cfg *config.Config, backupService *Service, restoreService *RestoreService, historyStore *history.Store) *VerifyService {
+	return &VerifyService{
+		config:         cfg,
+		backupService:  backupService,
+		restoreService: restoreService,
+		history:        historyStore,
+	}
+}
+
+// VerifyLatestBackups checks the newest successful backup of each database of
+// machineID by restoring it into scratchMachineID.
+func (v *VerifyService) VerifyLatestBackups(ctx context.Context, machineID string, databases []string, scratchMachineID string, opts VerifyOptions) ([]VerifyResult, error) {
+	if _, err := v.config.GetMachine(machineID); err != nil {
+		return nil, err
+	}
+	scratch, err := v.config.GetMachine(scratchMachineID)
+	if err != nil {
+		return nil, fmt.Errorf("scratch machine: %w", err)
+	}
+
+	var results []VerifyResult
+	for _, database := range databases {
+		if ctx.Err() != nil {
+			break
+		}
+
+		startedAt := time.Now()
+		result := VerifyResult{Database: database}
+
+		page := v.history.Query(history.Filter{MachineID: machineID, Database: database, Kind: "backup", Status: "success", Limit: 1})
+		if len(page.Logs) == 0 {
+			result.Error = "no successful backup found"
+		} else {
+			entry := page.Logs[0]
+			result.BackupID = entry.ID
+			result.FileName = entry.FileName
+
+			fmt.Printf("Verifying backup %s of %s on scratch machine %s\n", entry.FileName, database, scratch.Name)
+			if err := v.verify(ctx, entry, scratch, &result); err != nil {
+				result.Error = err.Error()
+			} else {
+				result.Success = true
+			}
+		}
+
+		for _, warning := range result.Warnings {
+			fmt.Printf("WARNING: Verification of %s: %s\n", database, warning)
+		}
+		if result.Success {
+			fmt.Printf("Verification of %s passed: %d tables, %d rows\n", database, result.Tables, result.Rows)
+		} else {
+			fmt.Printf("ERROR: Verification of %s failed: %s\n", database, result.Error)
+		}
+
+		if _, err := v.history.Add(config.BackupLog{
+			Timestamp:  startedAt,
+			MachineID:  machineID,
+			ScheduleID: opts.ScheduleID,
+			CatchUp:    opts.CatchUp,
+			Kind:       "verify",
+			VerifiedID: result.BackupID,
+			TableName:  database,
+			FileName:   result.FileName,
+			DurationMs: time.Since(startedAt).Milliseconds(),
+			Success:    result.Success,
+			Error:      result.Error,
+		}); err != nil {
+			fmt.Printf("WARNING: Failed to record verification history: %v\n", err)
+		}
+
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+func (v *VerifyService) verify(ctx context.Context, entry config.BackupLog, scratch *config.Machine, result *VerifyResult) error {
+	backend, key, err := v.openLocation(entry)
+	if err != nil {
+		return err
+	}
+
+	var artifact *ManifestArtifact
+	if entry.Manifest != "" {
+		manifest, err := readStoredManifest(ctx, backend, path.Join(path.Dir(key), entry.Manifest))
+		if err != nil {
+			return err
+		}
+		if artifact = manifest.Artifact(entry.FileName); artifact == nil {
+			return fmt.Errorf("manifest %s does not list %s", entry.Manifest, entry.FileName)
+		}
+	}
+
+	reader, err := backend.Get(ctx, key)
+	if err != nil {
+		return fmt.Errorf("failed to open backup: %w", err)
+	}
+	defer reader.Close()
+
+	hash := sha256.New()
+	input := io.TeeReader(reader, hash)
+
+	// The private key never lives on this host, so only the checksum can be checked
+	if entry.Encrypted {
+		if _, err := io.Copy(io.Discard, input); err != nil {
+			return fmt.Errorf("failed to read backup: %w", err)
+		}
+		if err := checkChecksum(entry, hash.Sum(nil)); err != nil {
+			return err
+		}
+		return fmt.Errorf("checksum ok, but encrypted backups cannot be restored without the private key")
+	}
+
+	scratchDatabase := fmt.Sprintf("verify_%s_%d", sanitizeName(entry.TableName), time.Now().Unix())
+	run := &restoreRun{
+		status: RestoreStatus{
+			ID:             "verify_" + entry.ID,
+			MachineID:      scratch.ID,
+			Source:         entry.FileName,
+			TargetDatabase: scratchDatabase,
+			Status:         "running",
+			StartedAt:      time.Now(),
+		},
+	}
+
+	db, cleanup, err := v.backupService.openMachineDB(ctx, scratch)
+	if err != nil {
+		return fmt.Errorf("failed to connect to scratch machine: %w", err)
+	}
+	defer cleanup()
+
+	defer func() {
+		if _, err := db.Exec("DROP DATABASE IF EXISTS " + quoteIdentifier(scratchDatabase)); err != nil {
+			fmt.Printf("WARNING: Failed to drop scratch database %s: %v\n", scratchDatabase, err)
+		}
+	}()
+
+	restoreErr := v.restoreService.restore(ctx, run, scratch, input, RestoreRequest{TargetDatabase: scratchDatabase})
+	if restoreErr != nil {
+		return fmt.Errorf("restore failed: %w", restoreErr)
+	}
+
+	// Hash whatever the restore did not need to read
+	if _, err := io.Copy(io.Discard, input); err != nil {
+		return fmt.Errorf("failed to read backup: %w", err)
+	}
+	if err := checkChecksum(entry, hash.Sum(nil)); err != nil {
+		return err
+	}
+
+	return checkRestoredDatabase(db, scratchDatabase, artifact, result)
+}
+
+// openLocation picks a place the backup can be read from, preferring the
+// local working copy.
+func (v *VerifyService) openLocation(entry config.BackupLog) (storage.Backend, string, error) {
+	locations := entryLocations(entry)
+
+	var lastErr error = fmt.Errorf("backup has no stored copy")
+	for _, preferLocal := range []bool{true, false} {
+		for _, location := range locations {
+			if (location.Storage == "local") != preferLocal {
+				continue
+			}
+
+			backend, key, err := locationBackend(v.config, location)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			if _, err := backend.Stat(context.Background(), key); err != nil {
+				lastErr = fmt.Errorf("backup not found in storage %s: %w", backend.Name(), err)
+				continue
+			}
+			return backend, key, nil
+		}
+	}
+
+	return nil, "", lastErr
+}
+
+func readStoredManifest(ctx context.Context, backend storage.Backend, key string) (*Manifest, error) {
+	reader, err := backend.Get(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open manifest %s: %w", key, err)
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest %s: %w", key, err)
+	}
+	return ReadManifest(data)
+}
+
+func checkChecksum(entry config.BackupLog, sum []byte) error {
+	if entry.Checksum == "" {
+		return nil
+	}
+	if actual := hex.EncodeToString(sum); actual != entry.Checksum {
+		return fmt.Errorf("checksum mismatch: expected %s, got %s", entry.Checksum, actual)
+	}
+	return nil
+}
+
+// checkRestoredDatabase compares tables and row counts with the manifest
+// (when there is one) and runs CHECK TABLE on every table. The manifest's
+// counts were taken outside the dump's snapshot, so differences in rows are
+// only warnings.
+func checkRestoredDatabase(db *sql.DB, database string, artifact *ManifestArtifact, result *VerifyResult) error {
+	tables, err := readTableStats(db, database, true)
+	if err != nil {
+		return err
+	}
+	if len(tables) == 0 {
+		return fmt.Errorf("restored database has no tables")
+	}
+
+	var problems []string
+	if artifact != nil && artifact.Tables != nil {
+		restored := make(map[string]int64, len(tables))
+		for _, table := range tables {
+			restored[table.Name] = table.Rows
+		}
+
+		for _, expected := range artifact.Tables {
+			rows, ok := restored[expected.Name]
+			switch {
+			case !ok:
+				problems = append(problems, fmt.Sprintf("table %s missing", expected.Name))
+			case rows != expected.Rows && expected.Estimated:
+				result.Warnings = append(result.Warnings, fmt.Sprintf("table %s has %d rows, about %d estimated at backup time", expected.Name, rows, expected.Rows))
+			case rows != expected.Rows:
+				result.Warnings = append(result.Warnings, fmt.Sprintf("table %s has %d rows, %d counted before the dump", expected.Name, rows, expected.Rows))
+			}
+			delete(restored, expected.Name)
+		}
+		for name := range restored {
+			problems = append(problems, fmt.Sprintf("unexpected table %s", name))
+		}
+	}
+
+	for _, table := range tables {
+		result.Tables++
+		result.Rows += table.Rows
+
+		if problem := checkTable(db, database, table.Name); problem != "" {
+			problems = append(problems, problem)
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// checkTable runs CHECK TABLE and describes any error it reports.
+func checkTable(db *sql.DB, database, table string) string {
+	rows, err := db.Query(fmt.Sprintf("CHECK TABLE %s.%s", quoteIdentifier(database), quoteIdentifier(table)))
+	if err != nil {
+		return fmt.Sprintf("CHECK TABLE %s failed: %v", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name, op, msgType, msgText string
+		if err := rows.Scan(&name, &op, &msgType, &msgText); err != nil {
+			return fmt.Sprintf("CHECK TABLE %s failed: %v", table, err)
+		}
+		if strings.EqualFold(msgType, "error") || (strings.EqualFold(msgType, "status") && !strings.EqualFold(msgText, "OK")) {
+			return fmt.Sprintf("CHECK TABLE %s: %s", table, msgText)
+		}
+	}
+	return ""
+}
@@ -1,38 +1,104 @@
 package config
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/rand"
-	"crypto/sha256"
+	"bytes"
 	"encoding/json"
 	"fmt"
-	"io"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 )
 
 type Config struct {
 	Machines  []Machine       `json:"machines"`
+	Storages  []StorageConfig `json:"storages"`
 	Google    GoogleConfig    `json:"google"`
+	S3        S3Config        `json:"s3"`
 	Scheduler SchedulerConfig `json:"scheduler"`
 	Backup    BackupConfig    `json:"backup"`
+	Jobs      JobsConfig      `json:"jobs"`
 	Service   ServiceConfig   `json:"service"`
+	Auth      AuthConfig      `json:"auth"`
 	filePath  string
-	logs      []BackupLog
+
+	keyOptions KeyOptions
+	master     *masterKey
+	// Set by Load for files in a format older than the versioned header
+	legacyFormat string
+
+	// authMu guards Auth, which request goroutines read and change
+	// concurrently; saveMu serializes writes of the file.
+	authMu sync.RWMutex
+	saveMu sync.Mutex
+}
+
+// AuthConfig holds the local accounts of the web UI and REST API. It lives in
+// the encrypted config file and is never returned by the config endpoints.
+type AuthConfig struct {
+	Users  []User     `json:"users"`
+	Tokens []APIToken `json:"tokens,omitempty"`
+}
+
+type User struct {
+	ID           string `json:"id"`
+	Username     string `json:"username"`
+	PasswordHash string `json:"password_hash"` // bcrypt
+	// "admin", "operator" ou "viewer"; vazio = admin (contas criadas antes dos papéis)
+	Role string `json:"role"`
+	// Máquinas que operadores e leitores acessam; vazio = todas
+	MachineIDs  []string `json:"machine_ids,omitempty"`
+	CreatedAt   string   `json:"created_at"`
+	UpdatedAt   string   `json:"updated_at"`
+	LastLoginAt string   `json:"last_login_at,omitempty"`
+}
+
+// APIToken lets scripts call the REST API as a user, limited to Scopes and
+// to the permissions of the user's role. Only the SHA-256 of the token is
+// kept.
+type APIToken struct {
+	ID         string   `json:"id"`
+	Name       string   `json:"name"`
+	UserID     string   `json:"user_id"`              // Dono do token
+	TokenHash  string   `json:"token_hash"`           // SHA-256 (hex)
+	Prefix     string   `json:"prefix"`               // Início do token, para identificá-lo na interface
+	Scopes     []string `json:"scopes"`               // Ex: "backup:run", "history:read"
+	ExpiresAt  string   `json:"expires_at,omitempty"` // Vazio = não expira
+	CreatedAt  string   `json:"created_at"`
+	LastUsedAt string   `json:"last_used_at,omitempty"`
+}
+
+// Expired reports whether the token is past its expiry.
+func (t APIToken) Expired(now time.Time) bool {
+	if t.ExpiresAt == "" {
+		return false
+	}
+	expiresAt, err := time.Parse(time.RFC3339, t.ExpiresAt)
+	return err != nil || !now.Before(expiresAt)
+}
+
+// EffectiveRole returns the user's role, treating accounts created before
+// roles existed as admins.
+func (u User) EffectiveRole() string {
+	if u.Role == "" {
+		return "admin"
+	}
+	return u.Role
 }
 
 type Machine struct {
-	ID          string      `json:"id"`
-	Name        string      `json:"name"`
-	Type        string      `json:"type"` // "local" or "remote"
-	Description string      `json:"description"`
-	MySQL       MySQLConfig `json:"mysql"`
-	SSH         SSHConfig   `json:"ssh,omitempty"`
-	Enabled     bool        `json:"enabled"`
-	CreatedAt   string      `json:"created_at"`
-	UpdatedAt   string      `json:"updated_at"`
+	ID          string           `json:"id"`
+	Name        string           `json:"name"`
+	Type        string           `json:"type"` // "local" or "remote"
+	Description string           `json:"description"`
+	MySQL       MySQLConfig      `json:"mysql"`
+	SSH         SSHConfig        `json:"ssh,omitempty"`
+	StorageIDs  []string         `json:"storage_ids,omitempty"` // Destinos dos backups desta máquina
+	Retention   *RetentionPolicy `json:"retention,omitempty"`   // Sobrescreve Backup.Retention
+	Enabled     bool             `json:"enabled"`
+	CreatedAt   string           `json:"created_at"`
+	UpdatedAt   string           `json:"updated_at"`
 }
 
 type MySQLConfig struct {
@@ -63,9 +129,31 @@ type GoogleConfig struct {
 	TokenExpiry  string `json:"token_expiry"`
 }
 
+// S3Config holds the connection to an S3-compatible object store (AWS S3,
+// MinIO, ...). Storages of type "s3" use it unless they carry their own.
+type S3Config struct {
+	Endpoint             string `json:"endpoint"` // Vazio = AWS (https://s3.<region>.amazonaws.com)
+	Region               string `json:"region"`
+	Bucket               string `json:"bucket"`
+	Prefix               string `json:"prefix,omitempty"`
+	AccessKeyID          string `json:"access_key_id"`
+	SecretAccessKey      string `json:"secret_access_key"`
+	PathStyle            bool   `json:"path_style"`                       // Obrigatório para a maioria das instalações MinIO
+	ServerSideEncryption string `json:"server_side_encryption,omitempty"` // "AES256" or "aws:kms"
+	KMSKeyID             string `json:"kms_key_id,omitempty"`
+	PartSizeMB           int    `json:"part_size_mb,omitempty"` // Tamanho das partes do multipart upload (padrão 64)
+}
+
+func (c *S3Config) IsConfigured() bool {
+	return c.Bucket != "" && c.AccessKeyID != "" && c.SecretAccessKey != ""
+}
+
 type SchedulerConfig struct {
 	Enabled   bool       `json:"enabled"`
 	Schedules []Schedule `json:"schedules"`
+	// Ao iniciar, executa uma vez os agendamentos que perderam um horário há até
+	// este número de minutos (processo fora do ar); 0 desativa
+	CatchUpGraceMinutes int `json:"catch_up_grace_minutes"`
 }
 
 type Schedule struct {
@@ -75,10 +163,50 @@ type Schedule struct {
 	Enabled     bool     `json:"enabled"`
 	MachineID   string   `json:"machine_id"` // ID da máquina
 	Databases   []string `json:"databases"`
-	DaysOfWeek  []int    `json:"days_of_week"` // 0=Domingo, 1=Segunda, ..., 6=Sábado
-	Times       []string `json:"times"`        // Horários no formato "15:04"
-	CreatedAt   string   `json:"created_at"`
-	UpdatedAt   string   `json:"updated_at"`
+	DaysOfWeek  []int    `json:"days_of_week"`   // 0=Domingo, 1=Segunda, ..., 6=Sábado
+	Times       []string `json:"times"`          // Horários no formato "15:04"
+	Type        string   `json:"type,omitempty"` // "backup" (padrão) ou "verify"
+	// Dias do mês (1-31); quando informados substituem DaysOfWeek
+	DaysOfMonth []int `json:"days_of_month,omitempty"`
+	// Semanas do mês (1-5, -1 = última) em que DaysOfWeek vale, ex: primeiro domingo
+	WeeksOfMonth []int `json:"weeks_of_month,omitempty"`
+	// Expressão cron completa, com segundos opcionais ou "@every 6h"; substitui dias e horários
+	CronExpression string `json:"cron_expression,omitempty"`
+	// Fuso horário IANA dos horários, ex: "America/Sao_Paulo"; vazio usa o fuso do servidor
+	TimeZone string `json:"time_zone,omitempty"`
+	// "skip" ou "queue" quando a execução anterior ainda não terminou; vazio usa Jobs.OverlapPolicy
+	OverlapPolicy string `json:"overlap_policy,omitempty"`
+	// Máquina de teste onde os backups são restaurados nos agendamentos "verify"
+	ScratchMachineID string   `json:"scratch_machine_id,omitempty"`
+	StorageIDs       []string `json:"storage_ids,omitempty"` // Sobrescreve os destinos da máquina
+	CreatedAt        string   `json:"created_at"`
+	UpdatedAt        string   `json:"updated_at"`
+}
+
+// StorageConfig describes a destination backups are copied to. Machines and
+// schedules reference storages by ID; with none selected, backups go to
+// Google Drive when authenticated and otherwise stay in Backup.LocalPath.
+type StorageConfig struct {
+	ID            string           `json:"id"`
+	Name          string           `json:"name"`
+	Type          string           `json:"type"`                     // "local", "drive", "s3" or "sftp"
+	Path          string           `json:"path,omitempty"`           // Diretório de destino (local e sftp)
+	PathTemplate  string           `json:"path_template,omitempty"`  // Ex: "{machine}/{database}/{date}"
+	S3            *S3Config        `json:"s3,omitempty"`             // Sobrescreve Config.S3
+	SSH           *SSHConfig       `json:"ssh,omitempty"`            // Servidor de destino (sftp)
+	RetentionDays int              `json:"retention_days,omitempty"` // 0 = manter tudo
+	Retention     *RetentionPolicy `json:"retention,omitempty"`      // Sobrescreve a retenção da máquina e a global
+	Enabled       bool             `json:"enabled"`
+	CreatedAt     string           `json:"created_at"`
+	UpdatedAt     string           `json:"updated_at"`
+}
+
+// JobsConfig limits how many backup jobs run at once. A scheduled run whose
+// previous run is still queued or running follows OverlapPolicy.
+type JobsConfig struct {
+	MaxConcurrent int    `json:"max_concurrent"`  // Jobs simultâneos no total
+	MaxPerMachine int    `json:"max_per_machine"` // Jobs simultâneos por máquina
+	OverlapPolicy string `json:"overlap_policy"`  // "skip" or "queue"
 }
 
 type ServiceConfig struct {
@@ -86,25 +214,102 @@ type ServiceConfig struct {
 }
 
 type BackupConfig struct {
-	LocalPath     string `json:"local_path"`
-	Compression   bool   `json:"compression"`
-	KeepLocal     bool   `json:"keep_local"`
-	RetentionDays int    `json:"retention_days"`
+	LocalPath     string           `json:"local_path"`
+	Compression   bool             `json:"compression"`
+	KeepLocal     bool             `json:"keep_local"`
+	RetentionDays int              `json:"retention_days"`
+	Encryption    EncryptionConfig `json:"encryption"`
+	Retry         RetryConfig      `json:"retry"`
+	// Retenção GFS; quando configurada em qualquer nível substitui RetentionDays
+	Retention RetentionPolicy `json:"retention"`
+}
+
+// RetentionPolicy is a grandfather-father-son policy: for each database it
+// keeps the newest backup of each of the last Daily days, Weekly weeks,
+// Monthly months and Yearly years that have backups. All zero disables it.
+type RetentionPolicy struct {
+	Daily   int `json:"daily"`
+	Weekly  int `json:"weekly"`
+	Monthly int `json:"monthly"`
+	Yearly  int `json:"yearly"`
+}
+
+func (p RetentionPolicy) Enabled() bool {
+	return p.Daily > 0 || p.Weekly > 0 || p.Monthly > 0 || p.Yearly > 0
+}
+
+// RetryConfig holds the retry policies of the two stages of a backup that
+// depend on the network: reaching the server and dumping each database, and
+// copying each file to a destination.
+type RetryConfig struct {
+	Dump   RetryPolicy `json:"dump"`   // Túnel SSH e mysqldump
+	Upload RetryPolicy `json:"upload"` // Envio para cada destino
+}
+
+// RetryPolicy retries a failed stage with exponential backoff: the n-th retry
+// waits InitialBackoff * 2^(n-1) seconds, at most MaxBackoff.
+type RetryPolicy struct {
+	MaxAttempts    int      `json:"max_attempts"`    // Total de tentativas; 1 desativa
+	InitialBackoff int      `json:"initial_backoff"` // Segundos antes da segunda tentativa
+	MaxBackoff     int      `json:"max_backoff"`     // Espera máxima entre tentativas, em segundos
+	RetryOn        []string `json:"retry_on"`        // Classes de erro: "network", "timeout", "server", "dump"
+}
+
+// EncryptionConfig lists the OpenPGP public keys (ASCII-armored) backups are
+// encrypted to. The matching private keys are only supplied when restoring.
+type EncryptionConfig struct {
+	Enabled    bool     `json:"enabled"`
+	Recipients []string `json:"recipients,omitempty"`
 }
 
 type BackupLog struct {
-	ID        string    `json:"id"`
-	Timestamp time.Time `json:"timestamp"`
-	MachineID string    `json:"machine_id"`
-	TableName string    `json:"table_name"`
-	FileName  string    `json:"file_name"`
-	FileSize  int64     `json:"file_size"`
-	Success   bool      `json:"success"`
-	Error     string    `json:"error,omitempty"`
-	DriveID   string    `json:"drive_id,omitempty"`
-}
-
-func NewConfig(configPath string) (*Config, error) {
+	ID               string           `json:"id"`
+	Timestamp        time.Time        `json:"timestamp"`
+	MachineID        string           `json:"machine_id"`
+	ScheduleID       string           `json:"schedule_id,omitempty"`
+	Kind             string           `json:"kind,omitempty"`        // "backup", "verify" or "prune"
+	VerifiedID       string           `json:"verified_id,omitempty"` // Backup conferido (kind "verify")
+	PrunedID         string           `json:"pruned_id,omitempty"`   // Backup removido pela retenção (kind "prune")
+	TableName        string           `json:"table_name"`            // Nome do banco de dados
+	FileName         string           `json:"file_name"`
+	FileSize         int64            `json:"file_size"`
+	UncompressedSize int64            `json:"uncompressed_size,omitempty"`
+	DurationMs       int64            `json:"duration_ms"`
+	Checksum         string           `json:"checksum,omitempty"` // SHA-256 do arquivo final
+	Encrypted        bool             `json:"encrypted,omitempty"`
+	Manifest         string           `json:"manifest,omitempty"` // Manifesto da execução, ao lado do arquivo
+	Status           string           `json:"status"`             // "success", "failed" or "cancelled"
+	Success          bool             `json:"success"`
+	Error            string           `json:"error,omitempty"`
+	DriveID          string           `json:"drive_id,omitempty"`
+	Locations        []BackupLocation `json:"locations,omitempty"`
+	Attempts         []BackupAttempt  `json:"attempts,omitempty"`  // Somente quando houve nova tentativa
+	CatchUp          bool             `json:"catch_up,omitempty"`  // Execução perdida, recuperada ao reiniciar
+	PrunedAt         *time.Time       `json:"pruned_at,omitempty"` // Todas as cópias removidas pela retenção
+}
+
+// BackupAttempt is one try of a backup stage. Stages that succeed at the
+// first try leave none; once a stage fails, all its tries are recorded.
+type BackupAttempt struct {
+	Stage      string    `json:"stage"`             // "connect", "dump" or "upload"
+	Storage    string    `json:"storage,omitempty"` // Destino, na fase "upload"
+	Attempt    int       `json:"attempt"`
+	Class      string    `json:"class,omitempty"` // Classe do erro; vazio = não repetível
+	Error      string    `json:"error,omitempty"` // Vazio na tentativa que funcionou
+	StartedAt  time.Time `json:"started_at"`
+	DurationMs int64     `json:"duration_ms"`
+}
+
+type BackupLocation struct {
+	Storage string `json:"storage"`      // Storage ID, or "local" for the working directory
+	Type    string `json:"type"`         // Storage type
+	Path    string `json:"path"`         // Key or path inside the storage
+	ID      string `json:"id,omitempty"` // Backend object ID (e.g. Drive file ID)
+}
+
+// NewConfig loads the config file, encrypted with the master key described
+// by keyOptions, or creates it with the defaults.
+func NewConfig(configPath string, keyOptions KeyOptions) (*Config, error) {
 	cfg := &Config{
 		Machines: []Machine{
 			{
@@ -121,23 +326,44 @@ func NewConfig(configPath string) (*Config, error) {
 				UpdatedAt: time.Now().Format(time.RFC3339),
 			},
 		},
+		Storages: []StorageConfig{},
 		Scheduler: SchedulerConfig{
-			Enabled:   false,
-			Schedules: []Schedule{},
+			Enabled:             false,
+			Schedules:           []Schedule{},
+			CatchUpGraceMinutes: 360,
 		},
 		Backup: BackupConfig{
 			LocalPath:     getDefaultBackupPath(),
 			Compression:   true,
 			KeepLocal:     false,
 			RetentionDays: 30,
+			Retry: RetryConfig{
+				Dump: RetryPolicy{
+					MaxAttempts:    3,
+					InitialBackoff: 30,
+					MaxBackoff:     300,
+					RetryOn:        []string{"network", "timeout"},
+				},
+				Upload: RetryPolicy{
+					MaxAttempts:    3,
+					InitialBackoff: 10,
+					MaxBackoff:     120,
+					RetryOn:        []string{"network", "timeout", "server"},
+				},
+			},
+		},
+		Jobs: JobsConfig{
+			MaxConcurrent: 2,
+			MaxPerMachine: 1,
+			OverlapPolicy: "skip",
 		},
-		logs: make([]BackupLog, 0),
 	}
 
 	if configPath == "" {
 		configPath = getDefaultConfigPath()
 	}
 	cfg.filePath = configPath
+	cfg.keyOptions = keyOptions
 
 	// Try to load existing config
 	if err := cfg.Load(); err != nil {
@@ -151,6 +377,13 @@ func NewConfig(configPath string) (*Config, error) {
 		}
 	}
 
+	if cfg.legacyFormat != "" {
+		if err := cfg.Save(); err != nil {
+			return nil, fmt.Errorf("failed to migrate config: %w", err)
+		}
+		fmt.Printf("Config file migrated from %s to the versioned format\n", cfg.legacyFormat)
+	}
+
 	return cfg, nil
 }
 
@@ -160,17 +393,40 @@ func (c *Config) Load() error {
 		return err
 	}
 
-	// Decrypt data
+	if !isVersioned(data) {
+		return c.loadLegacy(data)
+	}
+
 	decrypted, err := c.decrypt(data)
 	if err != nil {
-		// If decryption fails, try to load as plain JSON (for backward compatibility)
-		if err := json.Unmarshal(data, c); err != nil {
-			return fmt.Errorf("failed to decrypt and parse config: %w", err)
+		return err
+	}
+
+	return json.Unmarshal(decrypted, c)
+}
+
+// loadLegacy reads a config file written before the versioned header: plain
+// JSON, or encrypted with the key derived from the hostname. NewConfig then
+// saves it in the current format.
+func (c *Config) loadLegacy(data []byte) error {
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		if err := json.Unmarshal(trimmed, c); err != nil {
+			return fmt.Errorf("failed to parse plain config: %w", err)
 		}
+		c.legacyFormat = "plain JSON"
 		return nil
 	}
 
-	return json.Unmarshal(decrypted, c)
+	decrypted, err := decryptLegacy(data)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt config with the legacy host-derived key (if the host was renamed, set %s to its old name): %w",
+			EnvLegacyHostname, err)
+	}
+	if err := json.Unmarshal(decrypted, c); err != nil {
+		return fmt.Errorf("failed to parse config: %w", err)
+	}
+	c.legacyFormat = "the host-derived key"
+	return nil
 }
 
 func (c *Config) Save() error {
@@ -179,7 +435,12 @@ func (c *Config) Save() error {
 		return fmt.Errorf("failed to create config directory: %w", err)
 	}
 
+	c.saveMu.Lock()
+	defer c.saveMu.Unlock()
+
+	c.authMu.RLock()
 	data, err := json.MarshalIndent(c, "", "  ")
+	c.authMu.RUnlock()
 	if err != nil {
 		return fmt.Errorf("failed to marshal config: %w", err)
 	}
@@ -190,59 +451,21 @@ func (c *Config) Save() error {
 		return fmt.Errorf("failed to encrypt config: %w", err)
 	}
 
-	return os.WriteFile(c.filePath, encrypted, 0600)
-}
-
-func (c *Config) encrypt(data []byte) ([]byte, error) {
-	key := c.getEncryptionKey()
-
-	block, err := aes.NewCipher(key)
+	// Replace the file at once, so a crash never leaves it half written
+	tmp, err := os.CreateTemp(filepath.Dir(c.filePath), filepath.Base(c.filePath)+".tmp-*")
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("failed to write config: %w", err)
 	}
+	defer os.Remove(tmp.Name())
 
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return nil, err
+	if _, err := tmp.Write(encrypted); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write config: %w", err)
 	}
-
-	nonce := make([]byte, gcm.NonceSize())
-	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
-		return nil, err
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write config: %w", err)
 	}
-
-	ciphertext := gcm.Seal(nonce, nonce, data, nil)
-	return ciphertext, nil
-}
-
-func (c *Config) decrypt(data []byte) ([]byte, error) {
-	key := c.getEncryptionKey()
-
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return nil, err
-	}
-
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return nil, err
-	}
-
-	nonceSize := gcm.NonceSize()
-	if len(data) < nonceSize {
-		return nil, fmt.Errorf("ciphertext too short")
-	}
-
-	nonce, ciphertext := data[:nonceSize], data[nonceSize:]
-	return gcm.Open(nil, nonce, ciphertext, nil)
-}
-
-func (c *Config) getEncryptionKey() []byte {
-	// Generate key based on machine-specific information
-	hostname, _ := os.Hostname()
-	keyString := fmt.Sprintf("mysql-backup-%s", hostname)
-	hash := sha256.Sum256([]byte(keyString))
-	return hash[:]
+	return os.Rename(tmp.Name(), c.filePath)
 }
 
 func (c *Config) IsGoogleConfigured() bool {
@@ -253,25 +476,10 @@ func (c *Config) IsGoogleAuthenticated() bool {
 	return c.Google.AccessToken != "" && c.Google.RefreshToken != ""
 }
 
-func (c *Config) AddBackupLog(log BackupLog) error {
-	log.ID = fmt.Sprintf("%d", time.Now().UnixNano())
-	c.logs = append(c.logs, log)
-
-	// Keep only last 1000 logs
-	if len(c.logs) > 1000 {
-		c.logs = c.logs[len(c.logs)-1000:]
-	}
-
-	return c.Save()
-}
-
-func (c *Config) GetBackupLogs() ([]BackupLog, error) {
-	// Return logs in reverse chronological order
-	logs := make([]BackupLog, len(c.logs))
-	for i, log := range c.logs {
-		logs[len(c.logs)-1-i] = log
-	}
-	return logs, nil
+// Dir returns the directory holding the config file, where other persistent
+// state (such as the backup history) is stored alongside it.
+func (c *Config) Dir() string {
+	return filepath.Dir(c.filePath)
 }
 
 // Machine management methods
@@ -341,6 +549,67 @@ func (c *Config) GetEnabledMachines() []Machine {
 	return enabled
 }
 
+// Storage management methods
+func (c *Config) AddStorage(storage StorageConfig) error {
+	storage.ID = fmt.Sprintf("storage_%d", time.Now().UnixNano())
+	storage.CreatedAt = time.Now().Format(time.RFC3339)
+	storage.UpdatedAt = time.Now().Format(time.RFC3339)
+
+	c.Storages = append(c.Storages, storage)
+	return c.Save()
+}
+
+func (c *Config) UpdateStorage(storageID string, storage StorageConfig) error {
+	for i, st := range c.Storages {
+		if st.ID == storageID {
+			storage.ID = storageID
+			storage.CreatedAt = st.CreatedAt
+			storage.UpdatedAt = time.Now().Format(time.RFC3339)
+			c.Storages[i] = storage
+			return c.Save()
+		}
+	}
+	return fmt.Errorf("storage not found")
+}
+
+func (c *Config) DeleteStorage(storageID string) error {
+	for i, st := range c.Storages {
+		if st.ID == storageID {
+			c.Storages = append(c.Storages[:i], c.Storages[i+1:]...)
+
+			// Remove references from machines and schedules
+			for j := range c.Machines {
+				c.Machines[j].StorageIDs = removeID(c.Machines[j].StorageIDs, storageID)
+			}
+			for j := range c.Scheduler.Schedules {
+				c.Scheduler.Schedules[j].StorageIDs = removeID(c.Scheduler.Schedules[j].StorageIDs, storageID)
+			}
+
+			return c.Save()
+		}
+	}
+	return fmt.Errorf("storage not found")
+}
+
+func (c *Config) GetStorage(storageID string) (*StorageConfig, error) {
+	for _, st := range c.Storages {
+		if st.ID == storageID {
+			return &st, nil
+		}
+	}
+	return nil, fmt.Errorf("storage not found")
+}
+
+func removeID(ids []string, id string) []string {
+	var kept []string
+	for _, existing := range ids {
+		if existing != id {
+			kept = append(kept, existing)
+		}
+	}
+	return kept
+}
+
 // Schedule management methods
 func (c *Config) AddSchedule(schedule Schedule) error {
 	schedule.ID = fmt.Sprintf("schedule_%d", time.Now().UnixNano())
@@ -403,6 +672,183 @@ func (c *Config) GetSchedulesForMachine(machineID string) []Schedule {
 	return schedules
 }
 
+// HasUsers reports whether any account exists; until one does, the web UI
+// only offers the first-run setup.
+func (c *Config) HasUsers() bool {
+	c.authMu.RLock()
+	defer c.authMu.RUnlock()
+	return len(c.Auth.Users) > 0
+}
+
+// GetUsers returns a copy of the accounts.
+func (c *Config) GetUsers() []User {
+	c.authMu.RLock()
+	defer c.authMu.RUnlock()
+	return append([]User(nil), c.Auth.Users...)
+}
+
+func (c *Config) AddUser(user User) (User, error) {
+	c.authMu.Lock()
+	if c.findUserByUsername(user.Username) != nil {
+		c.authMu.Unlock()
+		return User{}, fmt.Errorf("username already exists")
+	}
+
+	user.ID = fmt.Sprintf("user_%d", time.Now().UnixNano())
+	user.CreatedAt = time.Now().Format(time.RFC3339)
+	user.UpdatedAt = time.Now().Format(time.RFC3339)
+
+	c.Auth.Users = append(c.Auth.Users, user)
+	c.authMu.Unlock()
+	return user, c.Save()
+}
+
+func (c *Config) UpdateUser(userID string, user User) error {
+	c.authMu.Lock()
+	for i, u := range c.Auth.Users {
+		if u.ID == userID {
+			user.ID = userID
+			user.CreatedAt = u.CreatedAt
+			user.UpdatedAt = time.Now().Format(time.RFC3339)
+			c.Auth.Users[i] = user
+			c.authMu.Unlock()
+			return c.Save()
+		}
+	}
+	c.authMu.Unlock()
+	return fmt.Errorf("user not found")
+}
+
+// AdminCount returns how many users have the admin role.
+func (c *Config) AdminCount() int {
+	c.authMu.RLock()
+	defer c.authMu.RUnlock()
+
+	count := 0
+	for _, u := range c.Auth.Users {
+		if u.EffectiveRole() == "admin" {
+			count++
+		}
+	}
+	return count
+}
+
+// DeleteUser removes a user along with their API tokens.
+func (c *Config) DeleteUser(userID string) error {
+	c.authMu.Lock()
+	for i, u := range c.Auth.Users {
+		if u.ID == userID {
+			c.Auth.Users = append(c.Auth.Users[:i], c.Auth.Users[i+1:]...)
+
+			var tokens []APIToken
+			for _, t := range c.Auth.Tokens {
+				if t.UserID != userID {
+					tokens = append(tokens, t)
+				}
+			}
+			c.Auth.Tokens = tokens
+			c.authMu.Unlock()
+			return c.Save()
+		}
+	}
+	c.authMu.Unlock()
+	return fmt.Errorf("user not found")
+}
+
+func (c *Config) GetUser(userID string) (*User, error) {
+	c.authMu.RLock()
+	defer c.authMu.RUnlock()
+
+	for _, u := range c.Auth.Users {
+		if u.ID == userID {
+			return &u, nil
+		}
+	}
+	return nil, fmt.Errorf("user not found")
+}
+
+// GetUserByUsername finds a user ignoring case.
+func (c *Config) GetUserByUsername(username string) (*User, error) {
+	c.authMu.RLock()
+	defer c.authMu.RUnlock()
+
+	if u := c.findUserByUsername(username); u != nil {
+		return u, nil
+	}
+	return nil, fmt.Errorf("user not found")
+}
+
+// findUserByUsername returns a copy of the user; callers hold authMu.
+func (c *Config) findUserByUsername(username string) *User {
+	for _, u := range c.Auth.Users {
+		if strings.EqualFold(u.Username, username) {
+			return &u
+		}
+	}
+	return nil
+}
+
+// GetAPITokens returns a copy of the API tokens.
+func (c *Config) GetAPITokens() []APIToken {
+	c.authMu.RLock()
+	defer c.authMu.RUnlock()
+	return append([]APIToken(nil), c.Auth.Tokens...)
+}
+
+func (c *Config) AddAPIToken(token APIToken) (APIToken, error) {
+	token.ID = fmt.Sprintf("token_%d", time.Now().UnixNano())
+	token.CreatedAt = time.Now().Format(time.RFC3339)
+
+	c.authMu.Lock()
+	c.Auth.Tokens = append(c.Auth.Tokens, token)
+	c.authMu.Unlock()
+	return token, c.Save()
+}
+
+// TouchAPITokens records when tokens were last used, keyed by token ID, in
+// a single write of the file. Tokens deleted meanwhile are skipped.
+func (c *Config) TouchAPITokens(lastUsed map[string]string) error {
+	c.authMu.Lock()
+	touched := false
+	for i, t := range c.Auth.Tokens {
+		if at, ok := lastUsed[t.ID]; ok {
+			c.Auth.Tokens[i].LastUsedAt = at
+			touched = true
+		}
+	}
+	c.authMu.Unlock()
+
+	if !touched {
+		return nil
+	}
+	return c.Save()
+}
+
+func (c *Config) DeleteAPIToken(tokenID string) error {
+	c.authMu.Lock()
+	for i, t := range c.Auth.Tokens {
+		if t.ID == tokenID {
+			c.Auth.Tokens = append(c.Auth.Tokens[:i], c.Auth.Tokens[i+1:]...)
+			c.authMu.Unlock()
+			return c.Save()
+		}
+	}
+	c.authMu.Unlock()
+	return fmt.Errorf("token not found")
+}
+
+func (c *Config) GetAPIToken(tokenID string) (*APIToken, error) {
+	c.authMu.RLock()
+	defer c.authMu.RUnlock()
+
+	for _, t := range c.Auth.Tokens {
+		if t.ID == tokenID {
+			return &t, nil
+		}
+	}
+	return nil, fmt.Errorf("token not found")
+}
+
 func getDefaultConfigPath() string {
 	homeDir, err := os.UserHomeDir()
 	if err != nil {
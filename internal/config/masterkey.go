@@ -0,0 +1,403 @@
+package config
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// The config file starts with a versioned header:
+//
+//	"MBKC" | version (1 byte) | KDF (1 byte) | KDF parameters | nonce | ciphertext
+//
+// With kdfArgon2id the parameters are the time cost (uint32), the memory in
+// KiB (uint32), the threads (1 byte), the salt length (1 byte) and the salt.
+// The header is authenticated along with the ciphertext (AES-256-GCM).
+const (
+	fileMagic   = "MBKC"
+	fileVersion = 1
+
+	kdfNone     = 0 // 32-byte key from an env var or a key file
+	kdfArgon2id = 1 // Key derived from a passphrase
+)
+
+// Prefixes of the environment variables holding the master key. The
+// EnvNewPrefix variables name the new key when rotating.
+const (
+	EnvPrefix    = "MYSQL_BACKUP_"
+	EnvNewPrefix = "MYSQL_BACKUP_NEW_"
+
+	// Hostname of a config file written with the old host-derived key,
+	// needed to migrate it after the host was renamed
+	EnvLegacyHostname = "MYSQL_BACKUP_LEGACY_HOSTNAME"
+
+	// Set to true to accept a key file kept in the config directory
+	EnvInsecureKeyFile = "MYSQL_BACKUP_INSECURE_KEY_FILE"
+)
+
+// defaultKeyFileName is the key file created next to the config file when
+// InsecureKeyFile is set and no master key is supplied.
+const defaultKeyFileName = ".mysql-backup-key"
+
+// KeyOptions tells where the master key of the config file comes from. The
+// first one set wins. With none, the config cannot be opened: a key kept in
+// the config directory would travel with every copy of the encrypted file,
+// so that is only accepted when InsecureKeyFile is set.
+type KeyOptions struct {
+	Key        string // 32 bytes, hex or base64
+	KeyFile    string // Arquivo com a chave, em hex ou base64; criado se não existir
+	Passphrase string // Derivada com Argon2id
+
+	// Aceitar a chave no diretório da configuração (inseguro)
+	InsecureKeyFile bool
+}
+
+// KeyOptionsFromEnv reads the <prefix>MASTER_KEY, <prefix>MASTER_KEY_FILE
+// and <prefix>PASSPHRASE environment variables, along with
+// EnvInsecureKeyFile.
+func KeyOptionsFromEnv(prefix string) KeyOptions {
+	insecure, _ := strconv.ParseBool(os.Getenv(EnvInsecureKeyFile))
+	return KeyOptions{
+		Key:             os.Getenv(prefix + "MASTER_KEY"),
+		KeyFile:         os.Getenv(prefix + "MASTER_KEY_FILE"),
+		Passphrase:      os.Getenv(prefix + "PASSPHRASE"),
+		InsecureKeyFile: insecure,
+	}
+}
+
+func (o KeyOptions) empty() bool {
+	return o.Key == "" && o.KeyFile == "" && o.Passphrase == ""
+}
+
+type argon2Params struct {
+	Time    uint32
+	Memory  uint32 // KiB
+	Threads uint8
+}
+
+var defaultArgon2Params = argon2Params{Time: 3, Memory: 64 * 1024, Threads: 4}
+
+// masterKey is the AES-256 key of the config file.
+type masterKey struct {
+	source string // Where the key came from, for messages
+	file   string // Key file, if the key was read from one
+	kdf    byte
+	key    []byte
+	salt   []byte       // kdfArgon2id
+	params argon2Params // kdfArgon2id
+}
+
+// header returns the file header for data encrypted with the key.
+func (k *masterKey) header() []byte {
+	header := []byte(fileMagic)
+	header = append(header, fileVersion, k.kdf)
+	if k.kdf == kdfArgon2id {
+		header = binary.BigEndian.AppendUint32(header, k.params.Time)
+		header = binary.BigEndian.AppendUint32(header, k.params.Memory)
+		header = append(header, k.params.Threads, byte(len(k.salt)))
+		header = append(header, k.salt...)
+	}
+	return header
+}
+
+func passphraseKey(passphrase string, salt []byte, params argon2Params) *masterKey {
+	return &masterKey{
+		source: "passphrase",
+		kdf:    kdfArgon2id,
+		key:    argon2.IDKey([]byte(passphrase), salt, params.Time, params.Memory, params.Threads, 32),
+		salt:   salt,
+		params: params,
+	}
+}
+
+// parseKey decodes a 32-byte key written in hex or base64.
+func parseKey(value string) ([]byte, error) {
+	value = strings.TrimSpace(value)
+	if key, err := hex.DecodeString(value); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	for _, encoding := range []*base64.Encoding{base64.StdEncoding, base64.URLEncoding, base64.RawStdEncoding, base64.RawURLEncoding} {
+		if key, err := encoding.DecodeString(value); err == nil && len(key) == 32 {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("master key must be 32 bytes, hex or base64 encoded")
+}
+
+func readKeyFile(path string) (*masterKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := parseKey(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid key file %s: %w", path, err)
+	}
+	return &masterKey{source: "file " + path, file: path, kdf: kdfNone, key: key}, nil
+}
+
+// writeKeyFile stores a new random key in path, readable by the owner only.
+func writeKeyFile(path string) (*masterKey, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, fmt.Errorf("failed to generate master key: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create key directory: %w", err)
+	}
+	if err := os.WriteFile(path, []byte(hex.EncodeToString(key)+"\n"), 0600); err != nil {
+		return nil, fmt.Errorf("failed to write key file: %w", err)
+	}
+	return &masterKey{source: "file " + path, file: path, kdf: kdfNone, key: key}, nil
+}
+
+func (c *Config) defaultKeyFile() string {
+	return filepath.Join(filepath.Dir(c.filePath), defaultKeyFileName)
+}
+
+// inConfigDir reports whether path lies in the directory of the config file.
+func (c *Config) inConfigDir(path string) bool {
+	dir, err := filepath.Abs(filepath.Dir(c.filePath))
+	if err != nil {
+		return false
+	}
+	file, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(dir, file)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// newMasterKey returns the key to encrypt a new file with. A passphrase gets
+// a fresh salt; a missing key file is created if create is set. Key files in
+// the config directory, including the default one used when no key is
+// supplied, are refused unless opts.InsecureKeyFile is set.
+func (c *Config) newMasterKey(opts KeyOptions, create bool) (*masterKey, error) {
+	switch {
+	case opts.Key != "":
+		key, err := parseKey(opts.Key)
+		if err != nil {
+			return nil, err
+		}
+		return &masterKey{source: "environment", kdf: kdfNone, key: key}, nil
+	case opts.KeyFile != "":
+		return c.keyFile(opts.KeyFile, opts.InsecureKeyFile, create)
+	case opts.Passphrase != "":
+		salt := make([]byte, 16)
+		if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+			return nil, fmt.Errorf("failed to generate salt: %w", err)
+		}
+		return passphraseKey(opts.Passphrase, salt, defaultArgon2Params), nil
+	}
+
+	if !opts.InsecureKeyFile {
+		return nil, fmt.Errorf("no master key for the config file: set %sMASTER_KEY, %sPASSPHRASE or %sMASTER_KEY_FILE (or -master-key-file) "+
+			"to a file outside %s; to keep using %s, set %s=true",
+			EnvPrefix, EnvPrefix, EnvPrefix, filepath.Dir(c.filePath), c.defaultKeyFile(), EnvInsecureKeyFile)
+	}
+	return c.keyFile(c.defaultKeyFile(), true, create)
+}
+
+// keyFile reads the key in path, creating it if missing and create is set.
+func (c *Config) keyFile(path string, insecure, create bool) (*masterKey, error) {
+	if c.inConfigDir(path) {
+		if !insecure {
+			return nil, fmt.Errorf("master key file %s is in the config directory, so every copy of the config carries its key: "+
+				"move it elsewhere, or set %s=true to accept this", path, EnvInsecureKeyFile)
+		}
+		fmt.Printf("WARNING: INSECURE master key: %s is kept next to the encrypted config file, so anyone with a copy of %s can decrypt the stored passwords. "+
+			"Move the key out of that directory and point %sMASTER_KEY_FILE at it\n", path, filepath.Dir(c.filePath), EnvPrefix)
+	}
+
+	key, err := readKeyFile(path)
+	if os.IsNotExist(err) {
+		if !create {
+			return nil, fmt.Errorf("master key file %s not found: restore it or set %sMASTER_KEY, %sMASTER_KEY_FILE or %sPASSPHRASE",
+				path, EnvPrefix, EnvPrefix, EnvPrefix)
+		}
+		fmt.Printf("Generated a new master key in %s; keep a copy of it, the config cannot be opened without it\n", path)
+		return writeKeyFile(path)
+	}
+	return key, err
+}
+
+// headerKey returns the key for a file with the given header, which must
+// match how the master key is supplied.
+func (c *Config) headerKey(kdf byte, rest []byte) (*masterKey, []byte, error) {
+	switch kdf {
+	case kdfNone:
+		if c.keyOptions.Key == "" && c.keyOptions.KeyFile == "" && c.keyOptions.Passphrase != "" {
+			return nil, nil, fmt.Errorf("config file is encrypted with a key, not a passphrase")
+		}
+		key, err := c.newMasterKey(c.keyOptions, false)
+		return key, rest, err
+	case kdfArgon2id:
+		if len(rest) < 10 || len(rest) < 10+int(rest[9]) {
+			return nil, nil, fmt.Errorf("config file header is truncated")
+		}
+		if c.keyOptions.Passphrase == "" || c.keyOptions.Key != "" || c.keyOptions.KeyFile != "" {
+			return nil, nil, fmt.Errorf("config file is encrypted with a passphrase: set %sPASSPHRASE", EnvPrefix)
+		}
+		params := argon2Params{
+			Time:    binary.BigEndian.Uint32(rest[0:4]),
+			Memory:  binary.BigEndian.Uint32(rest[4:8]),
+			Threads: rest[8],
+		}
+		salt := append([]byte(nil), rest[10:10+int(rest[9])]...)
+		return passphraseKey(c.keyOptions.Passphrase, salt, params), rest[10+len(salt):], nil
+	default:
+		return nil, nil, fmt.Errorf("unknown key derivation %d in config file", kdf)
+	}
+}
+
+func (c *Config) encrypt(data []byte) ([]byte, error) {
+	if c.master == nil {
+		key, err := c.newMasterKey(c.keyOptions, true)
+		if err != nil {
+			return nil, err
+		}
+		c.master = key
+	}
+
+	gcm, err := newGCM(c.master.key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	header := c.master.header()
+	out := append(append([]byte(nil), header...), nonce...)
+	return gcm.Seal(out, nonce, data, header), nil
+}
+
+func (c *Config) decrypt(data []byte) ([]byte, error) {
+	if len(data) < len(fileMagic)+2 {
+		return nil, fmt.Errorf("config file header is truncated")
+	}
+	if version := data[len(fileMagic)]; version != fileVersion {
+		return nil, fmt.Errorf("unsupported config file version %d", version)
+	}
+
+	key, rest, err := c.headerKey(data[len(fileMagic)+1], data[len(fileMagic)+2:])
+	if err != nil {
+		return nil, err
+	}
+	header := data[:len(data)-len(rest)]
+
+	gcm, err := newGCM(key.key)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) < gcm.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+
+	nonce, ciphertext := rest[:gcm.NonceSize()], rest[gcm.NonceSize():]
+	plain, err := gcm.Open(nil, nonce, ciphertext, header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt config with the master key from %s: wrong key or corrupted file", key.source)
+	}
+
+	c.master = key
+	return plain, nil
+}
+
+// decryptLegacy opens a config file written before the versioned header,
+// encrypted with a key derived from the hostname.
+func decryptLegacy(data []byte) ([]byte, error) {
+	hostname := os.Getenv(EnvLegacyHostname)
+	if hostname == "" {
+		hostname, _ = os.Hostname()
+	}
+	key := sha256.Sum256([]byte(fmt.Sprintf("mysql-backup-%s", hostname)))
+
+	gcm, err := newGCM(key[:])
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+
+	nonce, ciphertext := data[:gcm.NonceSize()], data[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func isVersioned(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(fileMagic))
+}
+
+// MasterKeySource tells where the master key of the config file came from.
+func (c *Config) MasterKeySource() string {
+	if c.master == nil {
+		return "none"
+	}
+	return c.master.source
+}
+
+// RotateMasterKey re-encrypts the config file with a new master key. With
+// empty options, a key read from a file is replaced in that file by a new
+// random key.
+func (c *Config) RotateMasterKey(opts KeyOptions) error {
+	var next *masterKey
+	var err error
+	if opts.empty() {
+		if c.master == nil || c.master.file == "" {
+			return fmt.Errorf("the master key does not come from a file: set %sMASTER_KEY, %sMASTER_KEY_FILE or %sPASSPHRASE",
+				EnvNewPrefix, EnvNewPrefix, EnvNewPrefix)
+		}
+		// The current key file is only replaced once the config is re-encrypted
+		next, err = writeKeyFile(c.master.file + ".new")
+	} else {
+		opts.InsecureKeyFile = c.keyOptions.InsecureKeyFile
+		next, err = c.newMasterKey(opts, false)
+	}
+	if err != nil {
+		return err
+	}
+
+	previous := c.master
+	c.master = next
+	if err := c.Save(); err != nil {
+		c.master = previous
+		if opts.empty() {
+			os.Remove(next.file)
+		}
+		return err
+	}
+
+	if opts.empty() {
+		if err := os.Rename(next.file, previous.file); err != nil {
+			return fmt.Errorf("config re-encrypted, but failed to replace the key file (the new key is in %s): %w", next.file, err)
+		}
+		c.master.file = previous.file
+		c.master.source = previous.source
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package encryption
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+
+	// openpgp.Encrypt requires its fallback hash to be linked in even though
+	// unsigned messages never use it
+	_ "golang.org/x/crypto/ripemd160"
+)
+
+// Backups are encrypted as binary OpenPGP messages to one or more public keys,
+// so they can also be opened with standard tools (gpg --decrypt). Only the
+// public keys live on the backup host.
+const Extension = ".gpg"
+
+// ParseRecipients reads ASCII-armored public keys, each of which must be able
+// to receive encrypted messages.
+func ParseRecipients(armoredKeys []string) (openpgp.EntityList, error) {
+	var recipients openpgp.EntityList
+
+	for i, armored := range armoredKeys {
+		if strings.TrimSpace(armored) == "" {
+			continue
+		}
+
+		entities, err := openpgp.ReadArmoredKeyRing(strings.NewReader(armored))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read public key %d: %w", i+1, err)
+		}
+
+		for _, entity := range entities {
+			if !canEncryptTo(entity) {
+				return nil, fmt.Errorf("public key %d (%s) has no usable encryption key", i+1, entityName(entity))
+			}
+			recipients = append(recipients, entity)
+		}
+	}
+
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("no public keys configured")
+	}
+
+	return recipients, nil
+}
+
+// EncryptWriter returns a writer whose output to dst is readable only by the
+// recipients. Closing it flushes the message but does not close dst.
+func EncryptWriter(dst io.Writer, recipients openpgp.EntityList) (io.WriteCloser, error) {
+	config := &packet.Config{
+		DefaultCipher:          packet.CipherAES256,
+		DefaultCompressionAlgo: packet.CompressionNone, // Input is already gzip
+	}
+
+	writer, err := openpgp.Encrypt(dst, recipients, nil, &openpgp.FileHints{IsBinary: true}, config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start encryption: %w", err)
+	}
+	return writer, nil
+}
+
+// DecryptReader opens an encrypted backup with an ASCII-armored private key,
+// unlocking it with passphrase when the key is protected. The integrity of
+// the message is checked when the returned reader reaches EOF.
+func DecryptReader(src io.Reader, armoredPrivateKey, passphrase string) (io.Reader, error) {
+	keyring, err := openpgp.ReadArmoredKeyRing(strings.NewReader(armoredPrivateKey))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private key: %w", err)
+	}
+
+	if err := unlockKeys(keyring, passphrase); err != nil {
+		return nil, err
+	}
+
+	message, err := openpgp.ReadMessage(src, keyring, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt backup: %w", err)
+	}
+	return message.UnverifiedBody, nil
+}
+
+// IsEncrypted reports whether the stream starts with an OpenPGP packet rather
+// than the gzip magic number. The returned reader yields the full stream.
+func IsEncrypted(src io.Reader) (bool, io.Reader, error) {
+	reader := bufio.NewReader(src)
+	header, err := reader.Peek(2)
+	if err != nil && err != io.EOF {
+		return false, reader, err
+	}
+
+	if len(header) == 2 && header[0] == 0x1f && header[1] == 0x8b {
+		return false, reader, nil
+	}
+	// Every OpenPGP packet header has the high bit set
+	return len(header) > 0 && header[0]&0x80 != 0, reader, nil
+}
+
+func unlockKeys(keyring openpgp.EntityList, passphrase string) error {
+	found := false
+
+	for _, entity := range keyring {
+		keys := []*packet.PrivateKey{entity.PrivateKey}
+		for _, subkey := range entity.Subkeys {
+			keys = append(keys, subkey.PrivateKey)
+		}
+
+		for _, key := range keys {
+			if key == nil {
+				continue
+			}
+			found = true
+			if key.Encrypted {
+				if passphrase == "" {
+					return fmt.Errorf("private key is protected, passphrase required")
+				}
+				if err := key.Decrypt([]byte(passphrase)); err != nil {
+					return fmt.Errorf("failed to unlock private key: %w", err)
+				}
+			}
+		}
+	}
+
+	if !found {
+		return fmt.Errorf("no private key found, a public key was supplied")
+	}
+	return nil
+}
+
+func canEncryptTo(entity *openpgp.Entity) bool {
+	if entity.PrimaryKey.PubKeyAlgo.CanEncrypt() {
+		return true
+	}
+	for _, subkey := range entity.Subkeys {
+		if subkey.PublicKey.PubKeyAlgo.CanEncrypt() {
+			return true
+		}
+	}
+	return false
+}
+
+func entityName(entity *openpgp.Entity) string {
+	for name := range entity.Identities {
+		return name
+	}
+	return entity.PrimaryKey.KeyIdString()
+}
@@ -2,13 +2,16 @@ package google
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"mime/multipart"
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"mysql-backup/internal/config"
@@ -26,8 +29,33 @@ type TokenResponse struct {
 }
 
 type DriveFile struct {
-	ID   string `json:"id"`
-	Name string `json:"name"`
+	ID           string    `json:"id"`
+	Name         string    `json:"name"`
+	Size         int64     `json:"size,string,omitempty"`
+	CreatedTime  time.Time `json:"createdTime,omitempty"`
+	ModifiedTime time.Time `json:"modifiedTime,omitempty"`
+}
+
+const driveFileFields = "id,name,size,createdTime,modifiedTime"
+
+// API endpoints. They are only changed by tests, to reach a fake server.
+var (
+	DriveEndpoint  = "https://www.googleapis.com"
+	SheetsEndpoint = "https://sheets.googleapis.com"
+	TokenEndpoint  = "https://oauth2.googleapis.com/token"
+)
+
+// ErrFileNotFound is returned when Drive does not know a file ID.
+var ErrFileNotFound = fmt.Errorf("file not found")
+
+// APIError is a non-2xx response from a Google API.
+type APIError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("status %d - %s", e.StatusCode, e.Body)
 }
 
 func NewClient(cfg *config.Config) *Client {
@@ -49,10 +77,23 @@ func (c *Client) GetAuthURL() string {
 	return baseURL + "?" + params.Encode()
 }
 
+// driveURL returns the URL of a Drive API path such as "/drive/v3/files".
+func (c *Client) driveURL(path string) string {
+	return DriveEndpoint + path
+}
+
+func (c *Client) sheetsURL(path string) string {
+	return SheetsEndpoint + path
+}
+
+func (c *Client) tokenURL() string {
+	return TokenEndpoint
+}
+
 func (c *Client) ExchangeCode(code string) error {
 	fmt.Printf("Exchanging Google OAuth code: %s\n", code[:10]+"...")
 
-	tokenURL := "https://oauth2.googleapis.com/token"
+	tokenURL := c.tokenURL()
 
 	data := url.Values{}
 	data.Set("client_id", c.config.Google.ClientID)
@@ -94,7 +135,7 @@ func (c *Client) RefreshToken() error {
 
 	fmt.Println("Refreshing Google access token...")
 
-	tokenURL := "https://oauth2.googleapis.com/token"
+	tokenURL := c.tokenURL()
 
 	data := url.Values{}
 	data.Set("client_id", c.config.Google.ClientID)
@@ -127,7 +168,30 @@ func (c *Client) RefreshToken() error {
 	return c.config.Save()
 }
 
-func (c *Client) UploadFile(filePath, fileName string) (string, error) {
+// Resumable uploads send the file in chunks, which must be multiples of
+// 256 KiB. A failed chunk is retried after asking Drive how much it received.
+const (
+	uploadChunkSize  = 8 * 1024 * 1024
+	uploadMaxRetries = 5
+	uploadSessionTTL = 6 * 24 * time.Hour // Drive keeps sessions for a week
+)
+
+// uploadSession is saved next to the file being uploaded so that a later
+// attempt continues where the previous one stopped instead of starting over.
+type uploadSession struct {
+	URI       string    `json:"uri"`
+	FileName  string    `json:"file_name"`
+	Size      int64     `json:"size"`
+	ModTime   time.Time `json:"mod_time"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// errSessionExpired means Drive no longer knows the saved session URI.
+var errSessionExpired = fmt.Errorf("upload session expired")
+
+// UploadFile uploads a file through a resumable session, resuming a previous
+// one when possible. Cancelling ctx aborts the session on Drive.
+func (c *Client) UploadFile(ctx context.Context, filePath, fileName string) (string, error) {
 	// Check if token needs refresh
 	if err := c.ensureValidToken(); err != nil {
 		return "", fmt.Errorf("failed to ensure valid token: %w", err)
@@ -147,7 +211,43 @@ func (c *Client) UploadFile(filePath, fileName string) (string, error) {
 
 	fmt.Printf("Uploading file: %s (%.2f MB)\n", fileName, float64(fileInfo.Size())/(1024*1024))
 
-	// Create metadata
+	sessionPath := filePath + ".upload"
+	session := loadUploadSession(sessionPath, fileName, fileInfo)
+	if session != nil {
+		fmt.Printf("Resuming previous upload session for %s\n", fileName)
+	} else {
+		session, err = c.startUploadSession(ctx, fileName, fileInfo, sessionPath)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	driveFile, err := c.uploadChunks(ctx, file, session)
+	if err == errSessionExpired {
+		fmt.Printf("Upload session for %s expired, starting over\n", fileName)
+		if session, err = c.startUploadSession(ctx, fileName, fileInfo, sessionPath); err != nil {
+			return "", err
+		}
+		driveFile, err = c.uploadChunks(ctx, file, session)
+	}
+	if err != nil && ctx.Err() != nil {
+		// A cancelled upload is not resumed: drop what Drive holds so far
+		c.cancelUploadSession(session)
+		os.Remove(sessionPath)
+		return "", fmt.Errorf("upload of %s cancelled: %w", fileName, ctx.Err())
+	}
+	if err != nil {
+		// The session file stays behind so the next attempt can resume
+		return "", err
+	}
+
+	os.Remove(sessionPath)
+	fmt.Printf("File uploaded successfully to Google Drive: %s\n", driveFile.ID)
+	return driveFile.ID, nil
+}
+
+// startUploadSession asks Drive for a resumable session URI and saves it.
+func (c *Client) startUploadSession(ctx context.Context, fileName string, fileInfo os.FileInfo, sessionPath string) (*uploadSession, error) {
 	metadata := map[string]interface{}{
 		"name": fileName,
 	}
@@ -158,62 +258,380 @@ func (c *Client) UploadFile(filePath, fileName string) (string, error) {
 
 	metadataJSON, _ := json.Marshal(metadata)
 
-	// Create multipart form
-	var buf bytes.Buffer
-	writer := multipart.NewWriter(&buf)
+	req, err := http.NewRequestWithContext(ctx, "POST", c.driveURL("/upload/drive/v3/files?uploadType=resumable&fields="+driveFileFields), bytes.NewReader(metadataJSON))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create upload request: %w", err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+c.config.Google.AccessToken)
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	req.Header.Set("X-Upload-Content-Type", contentType(fileName))
+	req.Header.Set("X-Upload-Content-Length", strconv.FormatInt(fileInfo.Size(), 10))
+
+	client := &http.Client{Timeout: 60 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start upload session: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		fmt.Printf("Upload session failed. Status: %d, Body: %s\n", resp.StatusCode, string(body))
+		return nil, fmt.Errorf("upload session failed with status: %d - %s", resp.StatusCode, string(body))
+	}
+
+	session := &uploadSession{
+		URI:       resp.Header.Get("Location"),
+		FileName:  fileName,
+		Size:      fileInfo.Size(),
+		ModTime:   fileInfo.ModTime(),
+		CreatedAt: time.Now(),
+	}
+	if session.URI == "" {
+		return nil, fmt.Errorf("upload session response has no Location header")
+	}
+
+	if data, err := json.Marshal(session); err == nil {
+		if err := os.WriteFile(sessionPath, data, 0600); err != nil {
+			fmt.Printf("WARNING: Failed to save upload session: %v\n", err)
+		}
+	}
+
+	return session, nil
+}
+
+func contentType(fileName string) string {
+	switch {
+	case strings.HasSuffix(fileName, ".json"):
+		return "application/json"
+	case strings.HasSuffix(fileName, ".gz"):
+		return "application/gzip"
+	default:
+		return "application/octet-stream"
+	}
+}
+
+// loadUploadSession returns the saved session for this file, or nil when there
+// is none or it belongs to a different version of the file.
+func loadUploadSession(sessionPath, fileName string, fileInfo os.FileInfo) *uploadSession {
+	data, err := os.ReadFile(sessionPath)
+	if err != nil {
+		return nil
+	}
+
+	var session uploadSession
+	if err := json.Unmarshal(data, &session); err != nil {
+		return nil
+	}
+
+	if session.URI == "" || session.FileName != fileName || session.Size != fileInfo.Size() ||
+		!session.ModTime.Equal(fileInfo.ModTime()) || time.Since(session.CreatedAt) > uploadSessionTTL {
+		os.Remove(sessionPath)
+		return nil
+	}
+
+	return &session
+}
+
+// cancelUploadSession tells Drive to discard a resumable session. Best effort:
+// unfinished sessions also expire on their own.
+func (c *Client) cancelUploadSession(session *uploadSession) {
+	req, err := http.NewRequest("DELETE", session.URI, nil)
+	if err != nil {
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+c.config.Google.AccessToken)
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Printf("WARNING: Failed to cancel upload session of %s: %v\n", session.FileName, err)
+		return
+	}
+	resp.Body.Close()
+}
 
-	// Add metadata part
-	metadataPart, err := writer.CreatePart(map[string][]string{
-		"Content-Type": {"application/json; charset=UTF-8"},
-	})
+// uploadChunks sends the file from the offset Drive already has, retrying each
+// chunk with backoff.
+func (c *Client) uploadChunks(ctx context.Context, file *os.File, session *uploadSession) (*DriveFile, error) {
+	offset, driveFile, err := c.queryUploadOffset(ctx, session)
 	if err != nil {
-		return "", fmt.Errorf("failed to create metadata part: %w", err)
+		return nil, err
+	}
+	if driveFile != nil {
+		return driveFile, nil
 	}
-	metadataPart.Write(metadataJSON)
 
-	// Add file content part
-	filePart, err := writer.CreatePart(map[string][]string{
-		"Content-Type": {"application/gzip"},
-	})
+	for {
+		length := int64(uploadChunkSize)
+		if remaining := session.Size - offset; remaining < length {
+			length = remaining
+		}
+
+		var next int64
+		for attempt := 1; ; attempt++ {
+			next, driveFile, err = c.uploadChunk(ctx, file, session, offset, length)
+			if err == nil || err == errSessionExpired || attempt > uploadMaxRetries || ctx.Err() != nil {
+				break
+			}
+
+			wait := time.Duration(1<<uint(attempt-1)) * time.Second
+			fmt.Printf("WARNING: Chunk at %d of %s failed (attempt %d/%d): %v, retrying in %s\n",
+				offset, session.FileName, attempt, uploadMaxRetries, err, wait)
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(wait):
+			}
+
+			// Drive may have stored part of the chunk before the failure
+			resumed, done, queryErr := c.queryUploadOffset(ctx, session)
+			if queryErr == errSessionExpired {
+				return nil, queryErr
+			}
+			if queryErr == nil {
+				if done != nil {
+					return done, nil
+				}
+				offset = resumed
+				length = int64(uploadChunkSize)
+				if remaining := session.Size - offset; remaining < length {
+					length = remaining
+				}
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		if driveFile != nil {
+			return driveFile, nil
+		}
+
+		offset = next
+		if session.Size > 0 {
+			fmt.Printf("Uploaded %.2f/%.2f MB of %s (%.0f%%)\n", float64(offset)/(1024*1024),
+				float64(session.Size)/(1024*1024), session.FileName, float64(offset)*100/float64(session.Size))
+		}
+	}
+}
+
+// uploadChunk sends length bytes starting at offset. It returns the next
+// offset Drive expects, or the created file once the upload is complete.
+func (c *Client) uploadChunk(ctx context.Context, file *os.File, session *uploadSession, offset, length int64) (int64, *DriveFile, error) {
+	if err := c.ensureValidToken(); err != nil {
+		return 0, nil, fmt.Errorf("failed to ensure valid token: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "PUT", session.URI, io.NewSectionReader(file, offset, length))
 	if err != nil {
-		return "", fmt.Errorf("failed to create file part: %w", err)
+		return 0, nil, fmt.Errorf("failed to create chunk request: %w", err)
 	}
 
-	if _, err := io.Copy(filePart, file); err != nil {
-		return "", fmt.Errorf("failed to copy file content: %w", err)
+	req.ContentLength = length
+	req.Header.Set("Authorization", "Bearer "+c.config.Google.AccessToken)
+	if length > 0 {
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, session.Size))
+	} else {
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", session.Size))
 	}
 
-	writer.Close()
+	return c.doUploadRequest(req, offset)
+}
 
-	// Upload to Google Drive
-	req, err := http.NewRequest("POST", "https://www.googleapis.com/upload/drive/v3/files?uploadType=multipart", &buf)
+// queryUploadOffset asks Drive how many bytes of the session it has stored.
+func (c *Client) queryUploadOffset(ctx context.Context, session *uploadSession) (int64, *DriveFile, error) {
+	req, err := http.NewRequestWithContext(ctx, "PUT", session.URI, nil)
 	if err != nil {
-		return "", fmt.Errorf("failed to create upload request: %w", err)
+		return 0, nil, fmt.Errorf("failed to create status request: %w", err)
 	}
 
 	req.Header.Set("Authorization", "Bearer "+c.config.Google.AccessToken)
-	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", session.Size))
+
+	return c.doUploadRequest(req, 0)
+}
 
-	client := &http.Client{Timeout: 60 * time.Minute} // Timeout maior para arquivos grandes
+// doUploadRequest interprets the reply to a chunk or status request: 308 means
+// incomplete (Range reports what was stored), 200/201 carry the created file.
+func (c *Client) doUploadRequest(req *http.Request, offset int64) (int64, *DriveFile, error) {
+	client := &http.Client{Timeout: 10 * time.Minute}
 	resp, err := client.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("failed to upload file: %w", err)
+		return 0, nil, fmt.Errorf("failed to upload chunk: %w", err)
 	}
 	defer resp.Body.Close()
 
+	switch {
+	case resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusCreated:
+		var driveFile DriveFile
+		if err := json.NewDecoder(resp.Body).Decode(&driveFile); err != nil {
+			return 0, nil, fmt.Errorf("failed to decode response: %w", err)
+		}
+		return 0, &driveFile, nil
+	case resp.StatusCode == http.StatusPermanentRedirect:
+		// "Range: bytes=0-N" lists what Drive holds; absent means nothing yet
+		rangeHeader := resp.Header.Get("Range")
+		if rangeHeader == "" {
+			return 0, nil, nil
+		}
+		end, err := strconv.ParseInt(rangeHeader[strings.LastIndex(rangeHeader, "-")+1:], 10, 64)
+		if err != nil {
+			return 0, nil, fmt.Errorf("invalid Range header %q", rangeHeader)
+		}
+		return end + 1, nil, nil
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return 0, nil, errSessionExpired
+	default:
+		body, _ := io.ReadAll(resp.Body)
+		fmt.Printf("Upload chunk failed. Status: %d, Body: %s\n", resp.StatusCode, string(body))
+		return offset, nil, fmt.Errorf("upload failed with status: %d - %s", resp.StatusCode, string(body))
+	}
+}
+
+// DownloadFile opens the content of a Drive file for streaming. The caller must
+// close the returned reader; size is -1 when Drive does not report a length.
+func (c *Client) DownloadFile(ctx context.Context, fileID string) (io.ReadCloser, int64, error) {
+	if err := c.ensureValidToken(); err != nil {
+		return nil, 0, fmt.Errorf("failed to ensure valid token: %w", err)
+	}
+
+	downloadURL := c.driveURL(fmt.Sprintf("/drive/v3/files/%s?alt=media", url.PathEscape(fileID)))
+	req, err := http.NewRequestWithContext(ctx, "GET", downloadURL, nil)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to create download request: %w", err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+c.config.Google.AccessToken)
+
+	// No client timeout: the body is consumed while the restore is running, and
+	// ctx aborts it
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to download file: %w", err)
+	}
+
 	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
 		body, _ := io.ReadAll(resp.Body)
-		fmt.Printf("Upload failed. Status: %d, Body: %s\n", resp.StatusCode, string(body))
-		return "", fmt.Errorf("upload failed with status: %d - %s", resp.StatusCode, string(body))
+		fmt.Printf("Download failed. Status: %d, Body: %s\n", resp.StatusCode, string(body))
+		return nil, 0, fmt.Errorf("download failed with status: %d", resp.StatusCode)
 	}
 
-	var driveFile DriveFile
-	if err := json.NewDecoder(resp.Body).Decode(&driveFile); err != nil {
-		return "", fmt.Errorf("failed to decode response: %w", err)
+	fmt.Printf("Downloading file %s from Google Drive\n", fileID)
+	return resp.Body, resp.ContentLength, nil
+}
+
+// ListFiles returns the non-trashed files in the configured Drive folder whose
+// name starts with prefix (all files when prefix is empty).
+func (c *Client) ListFiles(prefix string) ([]DriveFile, error) {
+	if err := c.ensureValidToken(); err != nil {
+		return nil, fmt.Errorf("failed to ensure valid token: %w", err)
 	}
 
-	fmt.Printf("File uploaded successfully to Google Drive: %s\n", driveFile.ID)
-	return driveFile.ID, nil
+	query := "trashed = false"
+	if c.config.Google.DriveFolder != "" {
+		query += fmt.Sprintf(" and '%s' in parents", escapeQuery(c.config.Google.DriveFolder))
+	}
+	if prefix != "" {
+		// Drive only supports prefix matching on name, refined below
+		query += fmt.Sprintf(" and name contains '%s'", escapeQuery(prefix))
+	}
+
+	var files []DriveFile
+	pageToken := ""
+	for {
+		params := url.Values{}
+		params.Set("q", query)
+		params.Set("fields", "nextPageToken,files("+driveFileFields+")")
+		params.Set("pageSize", "1000")
+		if pageToken != "" {
+			params.Set("pageToken", pageToken)
+		}
+
+		var page struct {
+			NextPageToken string      `json:"nextPageToken"`
+			Files         []DriveFile `json:"files"`
+		}
+		if err := c.doJSON("GET", c.driveURL("/drive/v3/files?"+params.Encode()), &page); err != nil {
+			return nil, fmt.Errorf("failed to list files: %w", err)
+		}
+
+		for _, file := range page.Files {
+			if strings.HasPrefix(file.Name, prefix) {
+				files = append(files, file)
+			}
+		}
+
+		if page.NextPageToken == "" {
+			return files, nil
+		}
+		pageToken = page.NextPageToken
+	}
+}
+
+func (c *Client) GetFile(fileID string) (*DriveFile, error) {
+	if err := c.ensureValidToken(); err != nil {
+		return nil, fmt.Errorf("failed to ensure valid token: %w", err)
+	}
+
+	var file DriveFile
+	fileURL := c.driveURL(fmt.Sprintf("/drive/v3/files/%s?fields=%s", url.PathEscape(fileID), driveFileFields))
+	if err := c.doJSON("GET", fileURL, &file); err != nil {
+		return nil, fmt.Errorf("failed to get file: %w", err)
+	}
+	return &file, nil
+}
+
+func (c *Client) DeleteFile(fileID string) error {
+	if err := c.ensureValidToken(); err != nil {
+		return fmt.Errorf("failed to ensure valid token: %w", err)
+	}
+
+	fileURL := c.driveURL(fmt.Sprintf("/drive/v3/files/%s", url.PathEscape(fileID)))
+	if err := c.doJSON("DELETE", fileURL, nil); err != nil {
+		var apiErr *APIError
+		if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+			return ErrFileNotFound
+		}
+		return fmt.Errorf("failed to delete file: %w", err)
+	}
+
+	fmt.Printf("Deleted file %s from Google Drive\n", fileID)
+	return nil
+}
+
+// doJSON sends an authenticated Drive API request and decodes the JSON
+// response into out (when not nil).
+func (c *Client) doJSON(method, requestURL string, out interface{}) error {
+	req, err := http.NewRequest(method, requestURL, nil)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+c.config.Google.AccessToken)
+
+	client := &http.Client{Timeout: 60 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(resp.Body)
+		return &APIError{StatusCode: resp.StatusCode, Body: string(body)}
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func escapeQuery(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	return strings.ReplaceAll(value, "'", `\'`)
 }
 
 func (c *Client) LogToSheets(log config.BackupLog) error {
@@ -229,7 +647,13 @@ func (c *Client) LogToSheets(log config.BackupLog) error {
 	// Formato solicitado: STATUS | DATA/HORA | NOME_ARQUIVO | LOG
 	status := "ERRO"
 	logMessage := log.Error
-	if log.Success {
+	switch {
+	case log.Kind == "prune" && log.Success:
+		status = "REMOVIDO"
+		logMessage = fmt.Sprintf("Backup da database %s removido pela retenção", log.TableName)
+	case log.Kind == "prune":
+		logMessage = "Falha ao remover backup pela retenção: " + log.Error
+	case log.Success:
 		status = "SUCESSO"
 		logMessage = fmt.Sprintf("Backup da database %s criado com sucesso", log.TableName)
 	}
@@ -251,7 +675,7 @@ func (c *Client) LogToSheets(log config.BackupLog) error {
 		return err
 	}
 
-	url := fmt.Sprintf("https://sheets.googleapis.com/v4/spreadsheets/%s/values/A:D:append?valueInputOption=RAW", c.config.Google.SheetID)
+	url := c.sheetsURL(fmt.Sprintf("/v4/spreadsheets/%s/values/A:D:append?valueInputOption=RAW", c.config.Google.SheetID))
 
 	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
 	if err != nil {
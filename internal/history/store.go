@@ -0,0 +1,246 @@
+package history
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"mysql-backup/internal/config"
+)
+
+const FileName = "backup-history.jsonl"
+
+// Store keeps every backup log in an append-only JSON Lines file. Each line is
+// a full record; when an ID appears more than once the last line wins, which
+// lets entries be updated without rewriting the file.
+type Store struct {
+	path    string
+	mu      sync.RWMutex
+	entries []config.BackupLog
+	index   map[string]int
+}
+
+type Filter struct {
+	MachineID  string
+	MachineIDs []string // Quando informado, somente entradas destas máquinas
+	Database   string
+	ScheduleID string
+	Kind       string // "backup" also matches entries written before kinds existed
+	Status     string
+	Retried    bool // Somente entradas com novas tentativas
+	From       time.Time
+	To         time.Time
+	Offset     int
+	Limit      int
+}
+
+type Page struct {
+	Logs   []config.BackupLog `json:"logs"`
+	Total  int                `json:"total"`
+	Offset int                `json:"offset"`
+	Limit  int                `json:"limit"`
+}
+
+func NewStore(dir string) (*Store, error) {
+	s := &Store{
+		path:  filepath.Join(dir, FileName),
+		index: make(map[string]int),
+	}
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *Store) load() error {
+	file, err := os.Open(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to open history file: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var entry config.BackupLog
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// A torn last line from a crash should not make the history unreadable
+			fmt.Printf("WARNING: Skipping invalid history line %d: %v\n", line, err)
+			continue
+		}
+		s.put(entry)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read history file: %w", err)
+	}
+
+	fmt.Printf("Loaded %d backup history entries from %s\n", len(s.entries), s.path)
+	return nil
+}
+
+func (s *Store) put(entry config.BackupLog) {
+	if i, ok := s.index[entry.ID]; ok {
+		s.entries[i] = entry
+		return
+	}
+	s.index[entry.ID] = len(s.entries)
+	s.entries = append(s.entries, entry)
+}
+
+// Add assigns an ID to the log (when missing), persists it and returns the
+// stored entry.
+func (s *Store) Add(log config.BackupLog) (config.BackupLog, error) {
+	if log.ID == "" {
+		log.ID = fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	if log.Kind == "" {
+		log.Kind = "backup"
+	}
+	if log.Status == "" {
+		log.Status = "failed"
+		if log.Success {
+			log.Status = "success"
+		}
+	}
+
+	return log, s.write(log)
+}
+
+// Update replaces an existing entry by appending its new version.
+func (s *Store) Update(log config.BackupLog) error {
+	s.mu.RLock()
+	_, ok := s.index[log.ID]
+	s.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("history entry not found")
+	}
+
+	return s.write(log)
+}
+
+func (s *Store) write(log config.BackupLog) error {
+	data, err := json.Marshal(log)
+	if err != nil {
+		return fmt.Errorf("failed to marshal history entry: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return fmt.Errorf("failed to create history directory: %w", err)
+	}
+
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open history file: %w", err)
+	}
+	defer file.Close()
+
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to append history entry: %w", err)
+	}
+
+	s.put(log)
+	return nil
+}
+
+func (s *Store) Get(id string) (*config.BackupLog, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	i, ok := s.index[id]
+	if !ok {
+		return nil, fmt.Errorf("history entry not found")
+	}
+
+	entry := s.entries[i]
+	return &entry, nil
+}
+
+// Query returns matching entries in reverse chronological order.
+func (s *Store) Query(filter Filter) Page {
+	s.mu.RLock()
+	var matched []config.BackupLog
+	for _, entry := range s.entries {
+		if filter.matches(entry) {
+			matched = append(matched, entry)
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.SliceStable(matched, func(i, j int) bool {
+		return matched[i].Timestamp.After(matched[j].Timestamp)
+	})
+
+	page := Page{Total: len(matched), Offset: filter.Offset, Limit: filter.Limit}
+	if filter.Offset >= len(matched) {
+		page.Logs = []config.BackupLog{}
+		return page
+	}
+
+	end := len(matched)
+	if filter.Limit > 0 && filter.Offset+filter.Limit < end {
+		end = filter.Offset + filter.Limit
+	}
+	page.Logs = matched[filter.Offset:end]
+	return page
+}
+
+func (f Filter) matches(entry config.BackupLog) bool {
+	if f.MachineID != "" && entry.MachineID != f.MachineID {
+		return false
+	}
+	if f.MachineIDs != nil && !containsString(f.MachineIDs, entry.MachineID) {
+		return false
+	}
+	if f.Database != "" && entry.TableName != f.Database {
+		return false
+	}
+	if f.ScheduleID != "" && entry.ScheduleID != f.ScheduleID {
+		return false
+	}
+	if f.Kind != "" && entry.Kind != f.Kind && !(f.Kind == "backup" && entry.Kind == "") {
+		return false
+	}
+	if f.Status != "" && entry.Status != f.Status {
+		return false
+	}
+	if f.Retried && len(entry.Attempts) == 0 {
+		return false
+	}
+	if !f.From.IsZero() && entry.Timestamp.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && !entry.Timestamp.Before(f.To) {
+		return false
+	}
+	return true
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
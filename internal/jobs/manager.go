@@ -0,0 +1,618 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"mysql-backup/internal/backup"
+	"mysql-backup/internal/config"
+)
+
+// ErrFinished is returned when cancelling a job that is no longer queued or
+// running.
+var ErrFinished = fmt.Errorf("job already finished")
+
+// maxFinishedJobs bounds how many finished jobs are kept in memory; their
+// outcome is also recorded in the backup history.
+const maxFinishedJobs = 200
+
+// retentionTimeout bounds a retention pass, which runs outside any job.
+const retentionTimeout = time.Hour
+
+// Manager queues backup, verification and restore jobs and runs them within
+// the configured global and per-machine concurrency limits.
+type Manager struct {
+	config         *config.Config
+	backupService  *backup.Service
+	verifyService  *backup.VerifyService
+	restoreService *backup.RestoreService
+	mu             sync.Mutex
+	jobs           map[string]*Job
+	queue          []*Job
+	running        int
+	perMachine     map[string]int // Jobs em execução por máquina
+
+	retentionMu      sync.Mutex
+	retentionRunning bool // Uma passada de retenção em andamento
+	retentionPending bool // Pedida durante a passada atual; roda logo depois
+}
+
+// Request describes the work of a job.
+type Request struct {
+	Kind             string // "backup" (padrão), "verify" ou "restore"
+	Trigger          string // "manual" ou "schedule"
+	MachineID        string
+	ScheduleID       string
+	ScheduleName     string
+	Databases        []string
+	StorageIDs       []string
+	ScratchMachineID string
+	OverlapPolicy    string // Somente agendamentos; vazio usa Jobs.OverlapPolicy
+	CatchUp          bool   // Execução perdida enquanto o processo estava fora do ar
+	Timeout          time.Duration
+	// Restore is the source and target of a restore job. It may carry a
+	// private key, so the job forgets it once it finishes.
+	Restore *backup.RestoreRequest
+	// OnFinish, if set, is called with the final state of a job that ran,
+	// after its slot is released
+	OnFinish func(job Job)
+}
+
+type Job struct {
+	ID               string                `json:"id"`
+	Kind             string                `json:"kind"`
+	Trigger          string                `json:"trigger"`
+	MachineID        string                `json:"machine_id"`
+	ScheduleID       string                `json:"schedule_id,omitempty"`
+	ScheduleName     string                `json:"schedule_name,omitempty"`
+	Databases        []string              `json:"databases"`
+	ScratchMachineID string                `json:"scratch_machine_id,omitempty"`
+	CatchUp          bool                  `json:"catch_up,omitempty"`
+	Status           string                `json:"status"` // "queued", "running", "completed", "failed", "skipped" ou "cancelled"
+	Error            string                `json:"error,omitempty"`
+	Results          []backup.BackupResult `json:"results,omitempty"`
+	VerifyResults    []backup.VerifyResult `json:"verify_results,omitempty"`
+	Progress         []backup.Progress     `json:"progress,omitempty"` // Último estado de cada banco
+	Restore          *backup.RestoreStatus `json:"restore,omitempty"`  // Andamento de uma restauração
+	CreatedAt        time.Time             `json:"created_at"`
+	StartedAt        time.Time             `json:"started_at,omitempty"`
+	FinishedAt       time.Time             `json:"finished_at,omitempty"`
+
+	request     Request
+	cancel      context.CancelFunc
+	cancelled   bool
+	done        chan struct{}
+	subscribers []chan Event
+}
+
+// Event is sent to the subscribers of a job: "job" carries the job whenever
+// its status changes, "progress" an update of one of its databases or of its
+// restore.
+type Event struct {
+	Type      string                `json:"type"`
+	Job       *Job                  `json:"job,omitempty"`
+	Progress  *backup.Progress      `json:"progress,omitempty"`
+	Restore   *backup.RestoreStatus `json:"restore,omitempty"`
+	ElapsedMs int64                 `json:"elapsed_ms"`
+}
+
+func NewManager(cfg *config.Config, backupService *backup.Service, verifyService *backup.VerifyService, restoreService *backup.RestoreService) *Manager {
+	return &Manager{
+		config:         cfg,
+		backupService:  backupService,
+		verifyService:  verifyService,
+		restoreService: restoreService,
+		jobs:           make(map[string]*Job),
+		perMachine:     make(map[string]int),
+	}
+}
+
+// Submit queues a job. A scheduled run whose previous run of the same
+// schedule is still queued or running is skipped, or queued behind it when
+// the overlap policy is "queue"; at most one run per schedule waits.
+func (m *Manager) Submit(req Request) (*Job, error) {
+	if req.Kind == "" {
+		req.Kind = "backup"
+	}
+	if req.Trigger == "" {
+		req.Trigger = "manual"
+	}
+	if _, err := m.config.GetMachine(req.MachineID); err != nil {
+		return nil, err
+	}
+	if req.Kind == "verify" {
+		// A drill restores into the scratch machine, never into production
+		if req.ScratchMachineID == req.MachineID {
+			return nil, fmt.Errorf("scratch machine must not be the machine being verified")
+		}
+		if _, err := m.config.GetMachine(req.ScratchMachineID); err != nil {
+			return nil, fmt.Errorf("scratch machine: %w", err)
+		}
+	}
+	if req.Kind == "restore" && req.Restore == nil {
+		return nil, fmt.Errorf("restore request is required")
+	}
+
+	now := time.Now()
+	job := &Job{
+		ID:               fmt.Sprintf("job_%d", now.UnixNano()),
+		Kind:             req.Kind,
+		Trigger:          req.Trigger,
+		MachineID:        req.MachineID,
+		ScheduleID:       req.ScheduleID,
+		ScheduleName:     req.ScheduleName,
+		Databases:        req.Databases,
+		ScratchMachineID: req.ScratchMachineID,
+		CatchUp:          req.CatchUp,
+		Status:           "queued",
+		CreatedAt:        now,
+		request:          req,
+		done:             make(chan struct{}),
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if req.Trigger == "schedule" && req.ScheduleID != "" {
+		if reason := m.overlap(req); reason != "" {
+			job.Status = "skipped"
+			job.Error = reason
+			job.FinishedAt = now
+			close(job.done)
+			m.jobs[job.ID] = job
+			m.prune()
+
+			log.Printf("Skipping run of schedule '%s': %s", req.ScheduleName, reason)
+			return job.snapshot(), nil
+		}
+	}
+
+	m.jobs[job.ID] = job
+	m.queue = append(m.queue, job)
+	m.dispatch()
+
+	return job.snapshot(), nil
+}
+
+// overlap explains why a scheduled run must not be queued, or returns "".
+// Callers hold m.mu.
+func (m *Manager) overlap(req Request) string {
+	policy := req.OverlapPolicy
+	if policy == "" {
+		policy = m.config.Jobs.OverlapPolicy
+	}
+
+	for _, job := range m.jobs {
+		if job.ScheduleID != req.ScheduleID {
+			continue
+		}
+		switch job.Status {
+		case "queued":
+			return "previous run is still queued"
+		case "running":
+			if policy != "queue" {
+				return "previous run is still running"
+			}
+		}
+	}
+	return ""
+}
+
+// dispatch starts queued jobs, oldest first, while there is capacity.
+// Callers hold m.mu.
+func (m *Manager) dispatch() {
+	maxConcurrent, maxPerMachine := m.limits()
+
+	for i := 0; i < len(m.queue) && m.running < maxConcurrent; {
+		job := m.queue[i]
+		machineID := job.lockedMachine()
+		if m.perMachine[machineID] >= maxPerMachine {
+			i++
+			continue
+		}
+
+		m.queue = append(m.queue[:i], m.queue[i+1:]...)
+		m.running++
+		m.perMachine[machineID]++
+
+		ctx, cancel := context.WithTimeout(context.Background(), job.timeout())
+		job.cancel = cancel
+		job.Status = "running"
+		job.StartedAt = time.Now()
+		job.publish(Event{Type: "job", Job: job.snapshot()})
+		go m.run(ctx, job)
+	}
+}
+
+// Cancel stops a job: a queued one never starts, a running one has its
+// context cancelled and finishes as "cancelled" once the backup has cleaned
+// up after itself.
+func (m *Manager) Cancel(id string) (*Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	job, ok := m.jobs[id]
+	if !ok {
+		return nil, fmt.Errorf("job not found")
+	}
+
+	switch job.Status {
+	case "queued":
+		for i, queued := range m.queue {
+			if queued == job {
+				m.queue = append(m.queue[:i], m.queue[i+1:]...)
+				break
+			}
+		}
+		job.Status = "cancelled"
+		job.Error = "cancelled before it started"
+		job.FinishedAt = time.Now()
+		job.request.Restore = nil
+		close(job.done)
+		job.finish()
+		m.prune()
+		log.Printf("Cancelled queued job %s", job.ID)
+	case "running":
+		if !job.cancelled {
+			job.cancelled = true
+			job.cancel()
+			log.Printf("Cancelling running job %s", job.ID)
+		}
+	default:
+		return nil, ErrFinished
+	}
+
+	return job.snapshot(), nil
+}
+
+func (m *Manager) limits() (int, int) {
+	maxConcurrent := m.config.Jobs.MaxConcurrent
+	if maxConcurrent <= 0 {
+		maxConcurrent = 2
+	}
+	maxPerMachine := m.config.Jobs.MaxPerMachine
+	if maxPerMachine <= 0 {
+		maxPerMachine = 1
+	}
+	return maxConcurrent, maxPerMachine
+}
+
+// lockedMachine is the server the job puts load on: the source of a backup,
+// the scratch machine of a verification, the target of a restore.
+func (j *Job) lockedMachine() string {
+	if j.Kind == "verify" {
+		return j.ScratchMachineID
+	}
+	return j.MachineID
+}
+
+func (j *Job) timeout() time.Duration {
+	if j.request.Timeout > 0 {
+		return j.request.Timeout
+	}
+	if j.Kind == "verify" || j.Kind == "restore" {
+		return 6 * time.Hour
+	}
+	return 2 * time.Hour
+}
+
+func (m *Manager) run(ctx context.Context, job *Job) {
+	req := job.request
+	defer job.cancel()
+
+	if req.Kind == "restore" {
+		log.Printf("Starting job %s: restore into machine %s", job.ID, req.MachineID)
+	} else {
+		log.Printf("Starting job %s: %s of %d databases on machine %s", job.ID, req.Kind, len(req.Databases), req.MachineID)
+	}
+
+	var (
+		results       []backup.BackupResult
+		verifyResults []backup.VerifyResult
+		restoreStatus backup.RestoreStatus
+		err           error
+		failed        int
+	)
+	switch req.Kind {
+	case "restore":
+		restoreStatus, err = m.restoreService.Restore(ctx, job.ID, req.MachineID, *req.Restore, func(status backup.RestoreStatus) {
+			m.updateRestore(job, status)
+		})
+	case "verify":
+		verifyResults, err = m.verifyService.VerifyLatestBackups(ctx, req.MachineID, req.Databases, req.ScratchMachineID, backup.VerifyOptions{
+			ScheduleID: req.ScheduleID,
+			CatchUp:    req.CatchUp,
+		})
+		for _, result := range verifyResults {
+			if !result.Success {
+				failed++
+				log.Printf("Verification failed for database %s in job %s: %s", result.Database, job.ID, result.Error)
+			}
+		}
+	default:
+		results, err = m.backupService.CreateMachineBackup(ctx, req.MachineID, req.Databases, backup.BackupOptions{
+			ScheduleID: req.ScheduleID,
+			CatchUp:    req.CatchUp,
+			StorageIDs: req.StorageIDs,
+			Progress:   func(progress backup.Progress) { m.updateProgress(job, progress) },
+		})
+		for _, result := range results {
+			if !result.Success {
+				failed++
+				log.Printf("Backup failed for database %s in job %s: %s", result.Database, job.ID, result.Error)
+			}
+		}
+	}
+
+	total := len(results) + len(verifyResults)
+	status := "completed"
+	var errorMessage string
+	switch {
+	case err != nil:
+		status = "failed"
+		errorMessage = err.Error()
+		log.Printf("Job %s failed: %v", job.ID, err)
+	case failed > 0:
+		status = "failed"
+		errorMessage = fmt.Sprintf("%d of %d databases failed", failed, total)
+		log.Printf("Job %s completed: %d/%d databases successful", job.ID, total-failed, total)
+	case req.Kind == "restore":
+		log.Printf("Job %s completed", job.ID)
+	default:
+		log.Printf("Job %s completed: %d/%d databases successful", job.ID, total, total)
+	}
+
+	m.mu.Lock()
+
+	if job.cancelled {
+		status = "cancelled"
+		errorMessage = "cancelled while running"
+		log.Printf("Job %s cancelled", job.ID)
+	}
+
+	job.Status = status
+	job.Error = errorMessage
+	job.Results = results
+	job.VerifyResults = verifyResults
+	if req.Kind == "restore" {
+		job.Restore = &restoreStatus
+		job.request.Restore = nil
+	}
+	job.FinishedAt = time.Now()
+	close(job.done)
+	job.finish()
+
+	m.running--
+	m.perMachine[job.lockedMachine()]--
+	m.prune()
+	m.dispatch()
+	final := *job.snapshot()
+	m.mu.Unlock()
+
+	// Clean up old backups after successful scheduled runs, once the slot is free
+	if req.Kind == "backup" && req.Trigger == "schedule" && final.Status == "completed" {
+		m.requestRetention()
+	}
+
+	if req.OnFinish != nil {
+		req.OnFinish(final)
+	}
+}
+
+// requestRetention starts a retention pass in the background. Passes never
+// overlap: a request made during one runs a single further pass after it.
+func (m *Manager) requestRetention() {
+	m.retentionMu.Lock()
+	defer m.retentionMu.Unlock()
+
+	if m.retentionRunning {
+		m.retentionPending = true
+		return
+	}
+	m.retentionRunning = true
+	go m.runRetention()
+}
+
+func (m *Manager) runRetention() {
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), retentionTimeout)
+		if err := m.backupService.CleanupOldBackups(ctx); err != nil {
+			log.Printf("Failed to cleanup old backups: %v", err)
+		}
+		cancel()
+
+		m.retentionMu.Lock()
+		if !m.retentionPending {
+			m.retentionRunning = false
+			m.retentionMu.Unlock()
+			return
+		}
+		m.retentionPending = false
+		m.retentionMu.Unlock()
+	}
+}
+
+// prune forgets the oldest finished jobs beyond maxFinishedJobs. Callers
+// hold m.mu.
+func (m *Manager) prune() {
+	var finished []*Job
+	for _, job := range m.jobs {
+		if !job.FinishedAt.IsZero() {
+			finished = append(finished, job)
+		}
+	}
+	if len(finished) <= maxFinishedJobs {
+		return
+	}
+
+	sort.Slice(finished, func(i, j int) bool { return finished[i].FinishedAt.Before(finished[j].FinishedAt) })
+	for _, job := range finished[:len(finished)-maxFinishedJobs] {
+		delete(m.jobs, job.ID)
+	}
+}
+
+// Wait blocks until the job finishes or ctx is done.
+func (m *Manager) Wait(ctx context.Context, id string) (*Job, error) {
+	m.mu.Lock()
+	job, ok := m.jobs[id]
+	m.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("job not found")
+	}
+
+	select {
+	case <-job.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return job.snapshot(), nil
+}
+
+func (m *Manager) Get(id string) (*Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	job, ok := m.jobs[id]
+	if !ok {
+		return nil, fmt.Errorf("job not found")
+	}
+	return job.snapshot(), nil
+}
+
+// List returns all known jobs, newest first.
+func (m *Manager) List() []Job {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	jobs := make([]Job, 0, len(m.jobs))
+	for _, job := range m.jobs {
+		jobs = append(jobs, *job.snapshot())
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].CreatedAt.After(jobs[j].CreatedAt) })
+	return jobs
+}
+
+// Subscribe streams the events of a job. The channel starts with the current
+// progress and state of the job and is closed once the job finishes; call the
+// returned function to stop listening earlier.
+func (m *Manager) Subscribe(id string) (<-chan Event, func(), error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	job, ok := m.jobs[id]
+	if !ok {
+		return nil, nil, fmt.Errorf("job not found")
+	}
+
+	events := make(chan Event, 64)
+	for i := range job.Progress {
+		if len(events) == cap(events)-1 {
+			break
+		}
+		progress := job.Progress[i]
+		events <- Event{Type: "progress", Progress: &progress, ElapsedMs: job.elapsed()}
+	}
+	events <- Event{Type: "job", Job: job.snapshot(), ElapsedMs: job.elapsed()}
+
+	if !job.FinishedAt.IsZero() {
+		close(events)
+		return events, func() {}, nil
+	}
+	job.subscribers = append(job.subscribers, events)
+
+	unsubscribe := func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		for i, subscriber := range job.subscribers {
+			if subscriber == events {
+				job.subscribers = append(job.subscribers[:i], job.subscribers[i+1:]...)
+				close(events)
+				return
+			}
+		}
+	}
+	return events, unsubscribe, nil
+}
+
+func (m *Manager) updateProgress(job *Job, progress backup.Progress) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	updated := false
+	for i := range job.Progress {
+		if job.Progress[i].Database == progress.Database {
+			job.Progress[i] = progress
+			updated = true
+			break
+		}
+	}
+	if !updated {
+		job.Progress = append(job.Progress, progress)
+	}
+
+	job.publish(Event{Type: "progress", Progress: &progress, ElapsedMs: job.elapsed()})
+}
+
+func (m *Manager) updateRestore(job *Job, status backup.RestoreStatus) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	job.Restore = &status
+	job.publish(Event{Type: "progress", Restore: &status, ElapsedMs: job.elapsed()})
+}
+
+// publish hands an event to every subscriber without blocking the job; a
+// subscriber that falls behind misses progress updates. Callers hold m.mu.
+func (j *Job) publish(event Event) {
+	event.ElapsedMs = j.elapsed()
+	for _, subscriber := range j.subscribers {
+		select {
+		case subscriber <- event:
+		default:
+		}
+	}
+}
+
+// finish sends the final state and closes all subscriptions. Callers hold
+// m.mu.
+func (j *Job) finish() {
+	event := Event{Type: "job", Job: j.snapshot(), ElapsedMs: j.elapsed()}
+	for _, subscriber := range j.subscribers {
+		// Make room so the final state is never dropped
+		select {
+		case subscriber <- event:
+		default:
+			<-subscriber
+			subscriber <- event
+		}
+		close(subscriber)
+	}
+	j.subscribers = nil
+}
+
+func (j *Job) elapsed() int64 {
+	switch {
+	case j.StartedAt.IsZero():
+		return 0
+	case j.FinishedAt.IsZero():
+		return time.Since(j.StartedAt).Milliseconds()
+	default:
+		return j.FinishedAt.Sub(j.StartedAt).Milliseconds()
+	}
+}
+
+// snapshot copies the job so it can be read without holding m.mu.
+func (j *Job) snapshot() *Job {
+	snapshot := *j
+	snapshot.Progress = append([]backup.Progress(nil), j.Progress...)
+	snapshot.request = Request{}
+	snapshot.subscribers = nil
+	return &snapshot
+}
@@ -4,30 +4,36 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"reflect"
+	"strings"
 	"sync"
 	"time"
 
-	"mysql-backup/internal/backup"
 	"mysql-backup/internal/config"
+	"mysql-backup/internal/jobs"
 
 	"github.com/robfig/cron/v3"
 )
 
 type Service struct {
-	config        *config.Config
-	backupService *backup.Service
-	cron          *cron.Cron
-	running       bool
-	mu            sync.RWMutex
-	nextRuns      map[string]time.Time // ID do agendamento -> próxima execução
+	config     *config.Config
+	jobManager *jobs.Manager
+	cron       *cron.Cron
+	running    bool
+	stopped    bool // Parado manualmente; Reload não reinicia sozinho
+	mu         sync.RWMutex
+	entries    map[string][]cron.EntryID  // ID do agendamento -> entradas no cron
+	applied    map[string]config.Schedule // Definição usada para criar as entradas
+	state      *stateStore                // Última execução bem-sucedida de cada agendamento
 }
 
-func NewService(cfg *config.Config, backupService *backup.Service) *Service {
+func NewService(cfg *config.Config, jobManager *jobs.Manager) *Service {
 	return &Service{
-		config:        cfg,
-		backupService: backupService,
-		cron:          cron.New(),
-		nextRuns:      make(map[string]time.Time),
+		config:     cfg,
+		jobManager: jobManager,
+		entries:    make(map[string][]cron.EntryID),
+		applied:    make(map[string]config.Schedule),
+		state:      loadState(cfg.Dir()),
 	}
 }
 
@@ -45,8 +51,19 @@ func (s *Service) Start(ctx context.Context) error {
 		return fmt.Errorf("no enabled schedules found")
 	}
 
+	s.start(schedules)
+	return nil
+}
+
+// start creates a fresh cron with the given schedules; a stopped cron
+// cannot be reused. Callers hold s.mu.
+func (s *Service) start(schedules []config.Schedule) {
 	log.Printf("Starting scheduler with %d enabled schedules", len(schedules))
 
+	s.cron = cron.New(cron.WithParser(parser))
+	s.entries = make(map[string][]cron.EntryID)
+	s.applied = make(map[string]config.Schedule)
+
 	// Adicionar cada agendamento ao cron
 	for _, schedule := range schedules {
 		if err := s.addScheduleToCron(schedule); err != nil {
@@ -59,9 +76,9 @@ func (s *Service) Start(ctx context.Context) error {
 	// Start cron scheduler
 	s.cron.Start()
 	s.running = true
+	s.stopped = false
 
 	log.Println("Scheduler started successfully")
-	return nil
 }
 
 func (s *Service) Stop() {
@@ -74,115 +91,226 @@ func (s *Service) Stop() {
 
 	s.cron.Stop()
 	s.running = false
-	s.nextRuns = make(map[string]time.Time)
+	s.stopped = true
+	s.entries = make(map[string][]cron.EntryID)
+	s.applied = make(map[string]config.Schedule)
 
 	log.Println("Scheduler stopped")
 }
 
+// CatchUp runs once each enabled schedule that has an activation without a
+// successful run since, because the process was down or the run failed, was
+// skipped or never finished, provided the activation is no older than
+// Scheduler.CatchUpGraceMinutes. It is meant to be called once at startup,
+// after Start.
+func (s *Service) CatchUp() {
+	grace := time.Duration(s.config.Scheduler.CatchUpGraceMinutes) * time.Minute
+	schedules := s.config.GetEnabledSchedules()
+
+	known := make(map[string]bool)
+	for _, schedule := range s.config.Scheduler.Schedules {
+		known[schedule.ID] = true
+	}
+	s.state.retain(known)
+
+	if grace <= 0 {
+		return
+	}
+
+	now := time.Now()
+	for _, schedule := range schedules {
+		lastFire, ok := s.state.lastFire(schedule.ID)
+		if !ok {
+			continue
+		}
+
+		// Activations older than the grace period are not worth running anymore
+		from := lastFire
+		if windowStart := now.Add(-grace); from.Before(windowStart) {
+			from = windowStart
+		}
+
+		missed, err := LastRunBetween(schedule, from, now)
+		if err != nil || missed.IsZero() {
+			continue
+		}
+
+		log.Printf("Schedule '%s' missed its run at %s, catching up", schedule.Name, missed.Format(time.RFC3339))
+		s.runScheduledBackup(schedule, now, true)
+	}
+}
+
 func (s *Service) Restart() error {
 	s.Stop()
 	return s.Start(context.Background())
 }
 
+// Reload applies the current schedules to the running cron: entries of
+// removed or disabled schedules are dropped, changed ones are replaced and
+// new ones added, leaving untouched schedules alone. A scheduler that is not
+// running starts as soon as there is an enabled schedule, unless it was
+// stopped by hand.
+func (s *Service) Reload() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	schedules := s.config.GetEnabledSchedules()
+
+	if !s.running {
+		if s.stopped || len(schedules) == 0 {
+			return nil
+		}
+		s.start(schedules)
+		return nil
+	}
+
+	wanted := make(map[string]config.Schedule, len(schedules))
+	for _, schedule := range schedules {
+		wanted[schedule.ID] = schedule
+	}
+
+	for id, applied := range s.applied {
+		if schedule, ok := wanted[id]; ok && sameDefinition(applied, schedule) {
+			delete(wanted, id)
+			continue
+		}
+		s.removeScheduleFromCron(id)
+		log.Printf("Removed schedule: %s", applied.Name)
+	}
+
+	var errs []string
+	for _, schedule := range schedules {
+		if _, ok := wanted[schedule.ID]; !ok {
+			continue
+		}
+		if err := s.addScheduleToCron(schedule); err != nil {
+			log.Printf("Failed to add schedule %s to cron: %v", schedule.Name, err)
+			errs = append(errs, fmt.Sprintf("%s: %v", schedule.Name, err))
+			continue
+		}
+		log.Printf("Added schedule: %s", schedule.Name)
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to apply schedules: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
 func (s *Service) IsRunning() bool {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	return s.running
 }
 
+// GetNextRuns returns the next activation of each scheduled schedule, as
+// tracked by the running cron.
 func (s *Service) GetNextRuns() map[string]time.Time {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
 	result := make(map[string]time.Time)
-	for k, v := range s.nextRuns {
-		result[k] = v
+	if !s.running {
+		return result
+	}
+
+	scheduleOf := make(map[cron.EntryID]string)
+	for scheduleID, ids := range s.entries {
+		for _, id := range ids {
+			scheduleOf[id] = scheduleID
+		}
+	}
+
+	for _, entry := range s.cron.Entries() {
+		scheduleID, ok := scheduleOf[entry.ID]
+		if !ok || entry.Next.IsZero() {
+			continue
+		}
+		if next, ok := result[scheduleID]; !ok || entry.Next.Before(next) {
+			result[scheduleID] = entry.Next
+		}
 	}
 	return result
 }
 
 func (s *Service) addScheduleToCron(schedule config.Schedule) error {
-	// Para cada dia da semana e horário, criar uma entrada no cron
-	for _, dayOfWeek := range schedule.DaysOfWeek {
-		for _, timeStr := range schedule.Times {
-			cronExpr, err := s.buildCronExpression(dayOfWeek, timeStr)
-			if err != nil {
-				return fmt.Errorf("failed to build cron expression: %w", err)
-			}
+	entries, err := BuildEntries(schedule)
+	if err != nil {
+		return err
+	}
 
-			// Criar função de callback que captura o agendamento
-			scheduleFunc := func(sched config.Schedule) func() {
-				return func() {
-					s.runScheduledBackup(sched)
-				}
-			}(schedule)
+	// Activations before now are not missed runs of a newly tracked schedule
+	s.state.track(schedule.ID, time.Now())
 
-			entryID, err := s.cron.AddFunc(cronExpr, scheduleFunc)
-			if err != nil {
-				return fmt.Errorf("failed to add cron job: %w", err)
+	for _, entry := range entries {
+		// Criar função de callback que captura o agendamento
+		scheduleFunc := func(sched config.Schedule) func() {
+			return func() {
+				s.runScheduledBackup(sched, time.Now(), false)
 			}
+		}(schedule)
 
-			// Calcular próxima execução
-			entries := s.cron.Entries()
-			for _, entry := range entries {
-				if entry.ID == entryID {
-					s.nextRuns[fmt.Sprintf("%s_%d_%s", schedule.ID, dayOfWeek, timeStr)] = entry.Next
-					break
-				}
-			}
+		entryID := s.cron.Schedule(entry.Schedule, cron.FuncJob(scheduleFunc))
+		s.entries[schedule.ID] = append(s.entries[schedule.ID], entryID)
 
-			log.Printf("Added cron job for schedule '%s': %s (Day: %d, Time: %s)",
-				schedule.Name, cronExpr, dayOfWeek, timeStr)
-		}
+		log.Printf("Added cron job for schedule '%s': %s", schedule.Name, entry.Spec)
 	}
 
+	s.applied[schedule.ID] = schedule
 	return nil
 }
 
-func (s *Service) buildCronExpression(dayOfWeek int, timeStr string) (string, error) {
-	// Parse time string (formato "15:04")
-	t, err := time.Parse("15:04", timeStr)
-	if err != nil {
-		return "", fmt.Errorf("invalid time format: %s", timeStr)
+func (s *Service) removeScheduleFromCron(scheduleID string) {
+	for _, id := range s.entries[scheduleID] {
+		s.cron.Remove(id)
 	}
-
-	hour := t.Hour()
-	minute := t.Minute()
-
-	// Construir expressão cron: "minuto hora * * dia_da_semana"
-	cronExpr := fmt.Sprintf("%d %d * * %d", minute, hour, dayOfWeek)
-	return cronExpr, nil
+	delete(s.entries, scheduleID)
+	delete(s.applied, scheduleID)
 }
 
-func (s *Service) runScheduledBackup(schedule config.Schedule) {
-	log.Printf("Starting scheduled backup: %s (%d databases) on machine %s", schedule.Name, len(schedule.Databases), schedule.MachineID)
-
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Hour)
-	defer cancel()
+// sameDefinition reports whether two versions of a schedule would produce
+// the same cron entries and jobs.
+func sameDefinition(a, b config.Schedule) bool {
+	a.CreatedAt, a.UpdatedAt = "", ""
+	b.CreatedAt, b.UpdatedAt = "", ""
+	return reflect.DeepEqual(a, b)
+}
 
-	results, err := s.backupService.CreateMachineBackup(ctx, schedule.MachineID, schedule.Databases)
-	if err != nil {
-		log.Printf("Scheduled backup '%s' failed: %v", schedule.Name, err)
-		return
+// runScheduledBackup hands the run to the job manager, which applies the
+// concurrency limits and the schedule's overlap policy. The activation is
+// recorded once the job completes successfully, so anything else is caught
+// up after a restart. catchUp marks a run recovered by CatchUp.
+func (s *Service) runScheduledBackup(schedule config.Schedule, activation time.Time, catchUp bool) {
+	req := jobs.Request{
+		Kind:          "backup",
+		Trigger:       "schedule",
+		MachineID:     schedule.MachineID,
+		ScheduleID:    schedule.ID,
+		ScheduleName:  schedule.Name,
+		Databases:     schedule.Databases,
+		StorageIDs:    schedule.StorageIDs,
+		OverlapPolicy: schedule.OverlapPolicy,
+		CatchUp:       catchUp,
+		Timeout:       2 * time.Hour,
+		OnFinish: func(job jobs.Job) {
+			if job.Status == "completed" {
+				s.state.record(schedule.ID, activation)
+			}
+		},
 	}
-
-	successCount := 0
-	for _, result := range results {
-		if result.Success {
-			successCount++
-		} else {
-			log.Printf("Backup failed for database %s in schedule '%s': %s",
-				result.Database, schedule.Name, result.Error)
-		}
+	if schedule.Type == "verify" {
+		req.Kind = "verify"
+		req.StorageIDs = nil
+		req.ScratchMachineID = schedule.ScratchMachineID
+		req.Timeout = 6 * time.Hour
 	}
 
-	log.Printf("Scheduled backup '%s' completed: %d/%d databases successful",
-		schedule.Name, successCount, len(results))
-
-	// Clean up old backups
-	if err := s.backupService.CleanupOldBackups(); err != nil {
-		log.Printf("Failed to cleanup old backups: %v", err)
+	job, err := s.jobManager.Submit(req)
+	if err != nil {
+		log.Printf("Failed to queue scheduled run '%s': %v", schedule.Name, err)
+		return
 	}
+	log.Printf("Scheduled run '%s' queued as %s (%s)", schedule.Name, job.ID, job.Status)
 }
 
 // Métodos de compatibilidade com o sistema antigo
@@ -196,7 +324,8 @@ func (s *Service) GetNextRun() *time.Time {
 	var earliest *time.Time
 	for _, nextRun := range nextRuns {
 		if earliest == nil || nextRun.Before(*earliest) {
-			earliest = &nextRun
+			next := nextRun
+			earliest = &next
 		}
 	}
 
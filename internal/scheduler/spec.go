@@ -0,0 +1,204 @@
+package scheduler
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"mysql-backup/internal/config"
+
+	"github.com/robfig/cron/v3"
+)
+
+// parser accepts the usual five fields, an optional leading seconds field and
+// descriptors such as @daily or @every 6h.
+var parser = cron.NewParser(cron.SecondOptional | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
+
+// Entry is one cron schedule generated from a config.Schedule. Key tells the
+// entries of the same schedule apart.
+type Entry struct {
+	Key      string
+	Spec     string
+	Schedule cron.Schedule
+}
+
+// Location returns the time zone the schedule's wall-clock times refer to,
+// the process zone when none is set.
+func Location(schedule config.Schedule) (*time.Location, error) {
+	if schedule.TimeZone == "" {
+		return time.Local, nil
+	}
+
+	location, err := time.LoadLocation(schedule.TimeZone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid time zone %q: %w", schedule.TimeZone, err)
+	}
+	return location, nil
+}
+
+// BuildEntries turns a schedule into cron entries. A raw cron expression
+// takes precedence, then days of the month, then days of the week (optionally
+// limited to some weeks of the month); the last two fire at each of Times.
+// Entries run in the schedule's time zone through a CRON_TZ prefix.
+func BuildEntries(schedule config.Schedule) ([]Entry, error) {
+	location, err := Location(schedule)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := ""
+	if schedule.TimeZone != "" {
+		prefix = "CRON_TZ=" + schedule.TimeZone + " "
+	}
+
+	if expr := strings.TrimSpace(schedule.CronExpression); expr != "" {
+		// An explicit zone in the expression wins
+		if !strings.HasPrefix(expr, "TZ=") && !strings.HasPrefix(expr, "CRON_TZ=") {
+			expr = prefix + expr
+		}
+		parsed, err := parser.Parse(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron expression %q: %w", expr, err)
+		}
+		return []Entry{{Key: "cron", Spec: expr, Schedule: parsed}}, nil
+	}
+
+	if len(schedule.Times) == 0 {
+		return nil, fmt.Errorf("at least one time or a cron expression is required")
+	}
+
+	var days string
+	var weekly bool
+	switch {
+	case len(schedule.DaysOfMonth) > 0:
+		for _, day := range schedule.DaysOfMonth {
+			if day < 1 || day > 31 {
+				return nil, fmt.Errorf("invalid day of month: %d", day)
+			}
+		}
+		days = joinInts(schedule.DaysOfMonth) + " * *"
+	case len(schedule.DaysOfWeek) > 0:
+		for _, day := range schedule.DaysOfWeek {
+			if day < 0 || day > 6 {
+				return nil, fmt.Errorf("invalid day of week: %d", day)
+			}
+		}
+		for _, week := range schedule.WeeksOfMonth {
+			if week != -1 && (week < 1 || week > 5) {
+				return nil, fmt.Errorf("invalid week of month: %d", week)
+			}
+		}
+		days = "* * " + joinInts(schedule.DaysOfWeek)
+		weekly = true
+	default:
+		return nil, fmt.Errorf("at least one day or a cron expression is required")
+	}
+
+	var entries []Entry
+	for _, timeStr := range schedule.Times {
+		// Parse time string (formato "15:04")
+		t, err := time.Parse("15:04", timeStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid time format: %s", timeStr)
+		}
+
+		spec := fmt.Sprintf("%s%d %d %s", prefix, t.Minute(), t.Hour(), days)
+		parsed, err := parser.Parse(spec)
+		if err != nil {
+			return nil, fmt.Errorf("failed to build cron expression: %w", err)
+		}
+		if weekly && len(schedule.WeeksOfMonth) > 0 {
+			parsed = &weekOfMonthSchedule{Schedule: parsed, weeks: schedule.WeeksOfMonth, location: location}
+		}
+
+		entries = append(entries, Entry{Key: timeStr, Spec: spec, Schedule: parsed})
+	}
+
+	return entries, nil
+}
+
+// NextRuns returns the next count activations of the schedule after from.
+func NextRuns(schedule config.Schedule, from time.Time, count int) ([]time.Time, error) {
+	entries, err := BuildEntries(schedule)
+	if err != nil {
+		return nil, err
+	}
+
+	var runs []time.Time
+	for _, entry := range entries {
+		next := from
+		for i := 0; i < count; i++ {
+			next = entry.Schedule.Next(next)
+			if next.IsZero() {
+				break
+			}
+			runs = append(runs, next)
+		}
+	}
+
+	sort.Slice(runs, func(i, j int) bool { return runs[i].Before(runs[j]) })
+	if len(runs) > count {
+		runs = runs[:count]
+	}
+	return runs, nil
+}
+
+// LastRunBetween returns the latest activation of the schedule in
+// (after, before], or the zero time when there is none.
+func LastRunBetween(schedule config.Schedule, after, before time.Time) (time.Time, error) {
+	entries, err := BuildEntries(schedule)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var last time.Time
+	for _, entry := range entries {
+		for next := entry.Schedule.Next(after); !next.IsZero() && !next.After(before); next = entry.Schedule.Next(next) {
+			if next.After(last) {
+				last = next
+			}
+		}
+	}
+	return last, nil
+}
+
+// weekOfMonthSchedule keeps only the activations that fall in the given weeks
+// of the month (1-5, or -1 for the last one), e.g. "first Sunday".
+type weekOfMonthSchedule struct {
+	cron.Schedule
+	weeks    []int
+	location *time.Location
+}
+
+func (s *weekOfMonthSchedule) Next(t time.Time) time.Time {
+	// Each week of the month comes around at least every few months
+	for i := 0; i < 1000; i++ {
+		t = s.Schedule.Next(t)
+		if t.IsZero() || s.matches(t) {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (s *weekOfMonthSchedule) matches(t time.Time) bool {
+	t = t.In(s.location)
+	week := (t.Day()-1)/7 + 1
+	last := t.AddDate(0, 0, 7).Month() != t.Month()
+
+	for _, w := range s.weeks {
+		if w == week || (w == -1 && last) {
+			return true
+		}
+	}
+	return false
+}
+
+func joinInts(values []int) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = fmt.Sprint(v)
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,145 @@
+package scheduler
+
+import (
+	"strings"
+	"testing"
+	"time"
+	_ "time/tzdata" // Os fusos dos testes não dependem do sistema
+
+	"mysql-backup/internal/config"
+)
+
+var everyDay = []int{0, 1, 2, 3, 4, 5, 6}
+
+// checkNextRuns compares the next runs after from, in UTC, with want.
+func checkNextRuns(t *testing.T, schedule config.Schedule, from string, want ...string) {
+	t.Helper()
+
+	start, err := time.Parse(time.RFC3339, from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runs, err := NextRuns(schedule, start, len(want))
+	if err != nil {
+		t.Fatalf("NextRuns: %v", err)
+	}
+
+	got := make([]string, len(runs))
+	for i, run := range runs {
+		got[i] = run.UTC().Format(time.RFC3339)
+	}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("NextRuns = %v, want %v", got, want)
+	}
+}
+
+func TestNextRunsWeeksOfMonth(t *testing.T) {
+	tests := []struct {
+		name  string
+		days  []int
+		weeks []int
+		want  []string
+	}{
+		{
+			name:  "last Sunday",
+			days:  []int{0},
+			weeks: []int{-1},
+			want:  []string{"2024-01-28T03:00:00Z", "2024-02-25T03:00:00Z", "2024-03-31T03:00:00Z", "2024-04-28T03:00:00Z"},
+		},
+		{
+			name:  "first and last Sunday",
+			days:  []int{0},
+			weeks: []int{1, -1},
+			want:  []string{"2024-01-07T03:00:00Z", "2024-01-28T03:00:00Z", "2024-02-04T03:00:00Z", "2024-02-25T03:00:00Z"},
+		},
+		{
+			// The fifth week only exists in some months
+			name:  "fifth Friday",
+			days:  []int{5},
+			weeks: []int{5},
+			want:  []string{"2024-03-29T03:00:00Z", "2024-05-31T03:00:00Z", "2024-08-30T03:00:00Z"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schedule := config.Schedule{DaysOfWeek: tt.days, WeeksOfMonth: tt.weeks, Times: []string{"03:00"}, TimeZone: "UTC"}
+			checkNextRuns(t, schedule, "2024-01-01T00:00:00Z", tt.want...)
+		})
+	}
+}
+
+func TestNextRunsKeepsWallClockAcrossDST(t *testing.T) {
+	// Berlin moves from UTC+1 to UTC+2 at 02:00 on 2024-03-31
+	t.Run("time after the change", func(t *testing.T) {
+		schedule := config.Schedule{DaysOfWeek: everyDay, Times: []string{"03:00"}, TimeZone: "Europe/Berlin"}
+		checkNextRuns(t, schedule, "2024-03-29T12:00:00Z",
+			"2024-03-30T02:00:00Z", "2024-03-31T01:00:00Z", "2024-04-01T01:00:00Z")
+	})
+
+	t.Run("time skipped by the change", func(t *testing.T) {
+		schedule := config.Schedule{DaysOfWeek: everyDay, Times: []string{"02:30"}, TimeZone: "Europe/Berlin"}
+		checkNextRuns(t, schedule, "2024-03-29T12:00:00Z",
+			"2024-03-30T01:30:00Z", "2024-04-01T00:30:00Z", "2024-04-02T00:30:00Z")
+	})
+
+	t.Run("last Sunday on the day of the change", func(t *testing.T) {
+		schedule := config.Schedule{DaysOfWeek: []int{0}, WeeksOfMonth: []int{-1}, Times: []string{"23:30"}, TimeZone: "Europe/Berlin"}
+		checkNextRuns(t, schedule, "2024-03-01T00:00:00Z", "2024-03-31T21:30:00Z", "2024-04-28T21:30:00Z")
+	})
+}
+
+func TestNextRunsCronExpressionTimeZone(t *testing.T) {
+	tests := []struct {
+		name string
+		expr string
+		want []string
+	}{
+		{"schedule zone", "0 3 * * *", []string{"2024-01-01T08:00:00Z", "2024-01-02T08:00:00Z"}},
+		{"TZ prefix wins", "TZ=UTC 0 3 * * *", []string{"2024-01-02T03:00:00Z", "2024-01-03T03:00:00Z"}},
+		{"CRON_TZ prefix wins", "CRON_TZ=Asia/Tokyo 0 3 * * *", []string{"2024-01-01T18:00:00Z", "2024-01-02T18:00:00Z"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schedule := config.Schedule{CronExpression: tt.expr, TimeZone: "America/New_York"}
+			checkNextRuns(t, schedule, "2024-01-01T04:00:00Z", tt.want...)
+		})
+	}
+}
+
+func TestNextRunsDaysPrecedence(t *testing.T) {
+	tests := []struct {
+		name     string
+		schedule config.Schedule
+		want     []string
+	}{
+		{
+			name:     "days of the month replace days of the week",
+			schedule: config.Schedule{DaysOfMonth: []int{1, 15}, DaysOfWeek: []int{1}, Times: []string{"03:00"}},
+			want:     []string{"2024-01-15T03:00:00Z", "2024-02-01T03:00:00Z", "2024-02-15T03:00:00Z"},
+		},
+		{
+			name:     "weeks of the month only limit days of the week",
+			schedule: config.Schedule{DaysOfMonth: []int{10}, DaysOfWeek: []int{0}, WeeksOfMonth: []int{1}, Times: []string{"03:00"}},
+			want:     []string{"2024-01-10T03:00:00Z", "2024-02-10T03:00:00Z"},
+		},
+		{
+			name:     "cron expression replaces days and times",
+			schedule: config.Schedule{CronExpression: "30 5 * * *", DaysOfMonth: []int{1}, DaysOfWeek: []int{1}, Times: []string{"03:00"}},
+			want:     []string{"2024-01-02T05:30:00Z", "2024-01-03T05:30:00Z"},
+		},
+		{
+			name:     "each time is a run",
+			schedule: config.Schedule{DaysOfMonth: []int{15}, Times: []string{"18:00", "06:00"}},
+			want:     []string{"2024-01-15T06:00:00Z", "2024-01-15T18:00:00Z", "2024-02-15T06:00:00Z"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.schedule.TimeZone = "UTC"
+			checkNextRuns(t, tt.schedule, "2024-01-02T00:00:00Z", tt.want...)
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// StateFileName is the file, next to the config, where the scheduler keeps
+// the last successful run of each schedule so missed runs can be detected
+// after a restart.
+const StateFileName = "scheduler_state.json"
+
+type scheduleState struct {
+	LastFire time.Time `json:"last_fire"` // Ativação da última execução concluída com sucesso
+}
+
+// stateStore persists the scheduleState of every schedule.
+type stateStore struct {
+	path      string
+	mu        sync.Mutex
+	schedules map[string]scheduleState
+}
+
+func loadState(dir string) *stateStore {
+	s := &stateStore{
+		path:      filepath.Join(dir, StateFileName),
+		schedules: make(map[string]scheduleState),
+	}
+
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("WARNING: Failed to read scheduler state: %v", err)
+		}
+		return s
+	}
+
+	var file struct {
+		Schedules map[string]scheduleState `json:"schedules"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		log.Printf("WARNING: Ignoring invalid scheduler state: %v", err)
+		return s
+	}
+	if file.Schedules != nil {
+		s.schedules = file.Schedules
+	}
+	return s
+}
+
+func (s *stateStore) lastFire(scheduleID string) (time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state, ok := s.schedules[scheduleID]
+	return state.LastFire, ok
+}
+
+// record stores the activation of a successful run. Runs may finish out of
+// order, so an older activation never replaces a newer one.
+func (s *stateStore) record(scheduleID string, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if state, ok := s.schedules[scheduleID]; ok && !at.After(state.LastFire) {
+		return
+	}
+	s.schedules[scheduleID] = scheduleState{LastFire: at}
+	s.save()
+}
+
+// track starts following a schedule that has no state yet; activations
+// before at are not considered missed.
+func (s *stateStore) track(scheduleID string, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.schedules[scheduleID]; ok {
+		return
+	}
+	s.schedules[scheduleID] = scheduleState{LastFire: at}
+	s.save()
+}
+
+// retain forgets the schedules that no longer exist.
+func (s *stateStore) retain(scheduleIDs map[string]bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	changed := false
+	for id := range s.schedules {
+		if !scheduleIDs[id] {
+			delete(s.schedules, id)
+			changed = true
+		}
+	}
+	if changed {
+		s.save()
+	}
+}
+
+// save writes the state through a temporary file so a crash never leaves
+// it half written. Callers hold s.mu.
+func (s *stateStore) save() {
+	data, err := json.MarshalIndent(map[string]interface{}{"schedules": s.schedules}, "", "  ")
+	if err != nil {
+		log.Printf("WARNING: Failed to encode scheduler state: %v", err)
+		return
+	}
+
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		log.Printf("WARNING: Failed to save scheduler state: %v", err)
+		return
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		os.Remove(tmpPath)
+		log.Printf("WARNING: Failed to save scheduler state: %v", err)
+	}
+}
@@ -0,0 +1,23 @@
+package ssh
+
+import (
+	"fmt"
+
+	"github.com/pkg/sftp"
+)
+
+// NewSFTP connects (if needed) and starts an SFTP client on the connection.
+// Closing the SFTP client leaves the SSH connection open.
+func (c *Client) NewSFTP() (*sftp.Client, error) {
+	if c.client == nil {
+		if err := c.Connect(); err != nil {
+			return nil, err
+		}
+	}
+
+	client, err := sftp.NewClient(c.client)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start sftp subsystem: %w", err)
+	}
+	return client, nil
+}
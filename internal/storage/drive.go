@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+
+	"mysql-backup/internal/config"
+	"mysql-backup/internal/google"
+)
+
+// DriveBackend stores backups in the Google Drive folder from GoogleConfig.
+// Drive folders are flat, so only the base name of a key is used.
+type DriveBackend struct {
+	name   string
+	config *config.Config
+}
+
+func NewDriveBackend(name string, cfg *config.Config) (*DriveBackend, error) {
+	if !cfg.IsGoogleAuthenticated() {
+		return nil, fmt.Errorf("Google Drive not authenticated")
+	}
+
+	return &DriveBackend{
+		name:   name,
+		config: cfg,
+	}, nil
+}
+
+func (b *DriveBackend) Name() string {
+	return b.name
+}
+
+func (b *DriveBackend) client() *google.Client {
+	return google.NewClient(b.config)
+}
+
+func (b *DriveBackend) Put(ctx context.Context, key, localPath string) (Object, error) {
+	fileID, err := b.client().UploadFile(ctx, localPath, path.Base(key))
+	if err != nil {
+		return Object{}, err
+	}
+
+	file, err := b.client().GetFile(fileID)
+	if err != nil {
+		// The upload itself succeeded; metadata is best effort
+		return Object{Key: path.Base(key), ID: fileID}, nil
+	}
+	return driveObject(*file), nil
+}
+
+func (b *DriveBackend) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	file, err := b.find(key)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, _, err := b.client().DownloadFile(ctx, file.ID)
+	return reader, err
+}
+
+func (b *DriveBackend) List(ctx context.Context, prefix string) ([]Object, error) {
+	files, err := b.client().ListFiles(path.Base("/" + prefix))
+	if err != nil {
+		return nil, err
+	}
+
+	objects := make([]Object, 0, len(files))
+	for _, file := range files {
+		objects = append(objects, driveObject(file))
+	}
+	return objects, nil
+}
+
+func (b *DriveBackend) Delete(ctx context.Context, key string) error {
+	file, err := b.find(key)
+	if err != nil {
+		return err
+	}
+	if err := b.client().DeleteFile(file.ID); err != google.ErrFileNotFound {
+		return err
+	}
+	return ErrNotFound
+}
+
+func (b *DriveBackend) Stat(ctx context.Context, key string) (Object, error) {
+	file, err := b.find(key)
+	if err != nil {
+		return Object{}, err
+	}
+	return driveObject(*file), nil
+}
+
+func (b *DriveBackend) find(key string) (*google.DriveFile, error) {
+	files, err := b.client().ListFiles(path.Base(key))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		if file.Name == path.Base(key) {
+			return &file, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func driveObject(file google.DriveFile) Object {
+	return Object{
+		Key:     file.Name,
+		ID:      file.ID,
+		Size:    file.Size,
+		ModTime: file.ModifiedTime,
+	}
+}
@@ -0,0 +1,132 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// LocalBackend copies backups into a directory on this host, e.g. a mounted
+// NAS share. Keys map to paths relative to the directory.
+type LocalBackend struct {
+	name string
+	root string
+}
+
+func NewLocalBackend(name, root string) (*LocalBackend, error) {
+	if root == "" {
+		return nil, fmt.Errorf("local storage %s has no path", name)
+	}
+
+	return &LocalBackend{
+		name: name,
+		root: filepath.Clean(root),
+	}, nil
+}
+
+func (b *LocalBackend) Name() string {
+	return b.name
+}
+
+// path resolves a key inside the root, refusing keys that escape it.
+func (b *LocalBackend) path(key string) string {
+	return filepath.Join(b.root, filepath.FromSlash(filepath.Clean("/"+key)))
+}
+
+func (b *LocalBackend) Put(ctx context.Context, key, localPath string) (Object, error) {
+	dstPath := b.path(key)
+	if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil {
+		return Object{}, fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	src, err := os.Open(localPath)
+	if err != nil {
+		return Object{}, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer src.Close()
+
+	// Write to a temporary name so a partial copy is never mistaken for a backup
+	tmpPath := dstPath + ".partial"
+	dst, err := os.Create(tmpPath)
+	if err != nil {
+		return Object{}, fmt.Errorf("failed to create file: %w", err)
+	}
+
+	if _, err := io.Copy(dst, contextReader{ctx: ctx, reader: src}); err != nil {
+		dst.Close()
+		os.Remove(tmpPath)
+		return Object{}, fmt.Errorf("failed to copy file: %w", err)
+	}
+
+	if err := dst.Close(); err != nil {
+		os.Remove(tmpPath)
+		return Object{}, fmt.Errorf("failed to close file: %w", err)
+	}
+
+	if err := os.Rename(tmpPath, dstPath); err != nil {
+		os.Remove(tmpPath)
+		return Object{}, fmt.Errorf("failed to rename file: %w", err)
+	}
+
+	return b.Stat(ctx, key)
+}
+
+func (b *LocalBackend) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	file, err := os.Open(b.path(key))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return file, err
+}
+
+func (b *LocalBackend) List(ctx context.Context, prefix string) ([]Object, error) {
+	var objects []Object
+
+	err := filepath.Walk(b.root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == b.root {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if info.IsDir() || strings.HasSuffix(path, ".partial") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(b.root, path)
+		if err != nil {
+			return err
+		}
+
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, Object{Key: key, Size: info.Size(), ModTime: info.ModTime()})
+		}
+		return nil
+	})
+
+	return objects, err
+}
+
+func (b *LocalBackend) Delete(ctx context.Context, key string) error {
+	err := os.Remove(b.path(key))
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (b *LocalBackend) Stat(ctx context.Context, key string) (Object, error) {
+	info, err := os.Stat(b.path(key))
+	if os.IsNotExist(err) {
+		return Object{}, ErrNotFound
+	}
+	if err != nil {
+		return Object{}, err
+	}
+
+	return Object{Key: key, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
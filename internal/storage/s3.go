@@ -0,0 +1,556 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"mysql-backup/internal/config"
+)
+
+const (
+	defaultPartSizeMB = 64
+	minPartSize       = 5 << 20 // S3 rejects smaller non-final parts
+)
+
+// S3Backend stores backups in an S3-compatible bucket. Requests are signed
+// with AWS Signature Version 4; files larger than one part are sent with a
+// multipart upload so only a single part is ever held in memory.
+type S3Backend struct {
+	name     string
+	config   config.S3Config
+	endpoint *url.URL
+	partSize int64
+	client   *http.Client
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+		ETag         string    `xml:"ETag"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+type s3CompletedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type s3CompleteUpload struct {
+	XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletedPart `xml:"Part"`
+}
+
+func NewS3Backend(name string, s3Config config.S3Config) (*S3Backend, error) {
+	if !s3Config.IsConfigured() {
+		return nil, fmt.Errorf("S3 storage %s is missing bucket or credentials", name)
+	}
+	if s3Config.Region == "" {
+		s3Config.Region = "us-east-1"
+	}
+
+	rawEndpoint := s3Config.Endpoint
+	if rawEndpoint == "" {
+		rawEndpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", s3Config.Region)
+	}
+	endpoint, err := url.Parse(rawEndpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint: %s", rawEndpoint)
+	}
+
+	partSizeMB := s3Config.PartSizeMB
+	if partSizeMB <= 0 {
+		partSizeMB = defaultPartSizeMB
+	}
+	partSize := int64(partSizeMB) << 20
+	if partSize < minPartSize {
+		partSize = minPartSize
+	}
+
+	return &S3Backend{
+		name:     name,
+		config:   s3Config,
+		endpoint: endpoint,
+		partSize: partSize,
+		client:   &http.Client{Timeout: 60 * time.Minute},
+	}, nil
+}
+
+func (b *S3Backend) Name() string {
+	return b.name
+}
+
+func (b *S3Backend) objectKey(key string) string {
+	prefix := strings.Trim(b.config.Prefix, "/")
+	if prefix == "" {
+		return strings.TrimLeft(key, "/")
+	}
+	return prefix + "/" + strings.TrimLeft(key, "/")
+}
+
+func (b *S3Backend) relativeKey(objectKey string) string {
+	prefix := strings.Trim(b.config.Prefix, "/")
+	if prefix == "" {
+		return objectKey
+	}
+	return strings.TrimPrefix(objectKey, prefix+"/")
+}
+
+// objectURL builds the URL for an object key (or the bucket when key is empty)
+// using path-style or virtual-hosted-style addressing.
+func (b *S3Backend) objectURL(key string, query url.Values) *url.URL {
+	u := *b.endpoint
+	basePath := strings.TrimRight(u.Path, "/")
+
+	if b.config.PathStyle {
+		u.Path = basePath + "/" + b.config.Bucket + "/" + key
+	} else {
+		u.Host = b.config.Bucket + "." + u.Host
+		u.Path = basePath + "/" + key
+	}
+
+	// Keep the sent path identical to the canonical URI used for signing
+	u.RawPath = uriEncode(u.Path, false)
+
+	u.RawQuery = ""
+	if query != nil {
+		u.RawQuery = canonicalQuery(query)
+	}
+	return &u
+}
+
+func (b *S3Backend) Put(ctx context.Context, key, localPath string) (Object, error) {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return Object{}, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return Object{}, fmt.Errorf("failed to stat file: %w", err)
+	}
+
+	objectKey := b.objectKey(key)
+	fmt.Printf("S3: Uploading %s to s3://%s/%s (%.2f MB)\n", localPath, b.config.Bucket, objectKey, float64(info.Size())/(1024*1024))
+
+	if info.Size() <= b.partSize {
+		err = b.putObject(ctx, objectKey, file, info.Size())
+	} else {
+		err = b.multipartUpload(ctx, objectKey, file)
+	}
+	if err != nil {
+		return Object{}, err
+	}
+
+	return b.Stat(ctx, key)
+}
+
+func (b *S3Backend) putObject(ctx context.Context, objectKey string, file *os.File, size int64) error {
+	payloadHash, err := hashReader(file)
+	if err != nil {
+		return fmt.Errorf("failed to hash file: %w", err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to rewind file: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, b.objectURL(objectKey, nil).String(), file)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	b.setEncryptionHeaders(req)
+
+	resp, err := b.do(req, payloadHash)
+	if err != nil {
+		return fmt.Errorf("failed to upload object: %w", err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (b *S3Backend) multipartUpload(ctx context.Context, objectKey string, file *os.File) error {
+	uploadID, err := b.createMultipartUpload(ctx, objectKey)
+	if err != nil {
+		return err
+	}
+
+	parts, err := b.uploadParts(ctx, objectKey, uploadID, file)
+	if err == nil {
+		err = b.completeMultipartUpload(ctx, objectKey, uploadID, parts)
+	}
+
+	if err != nil {
+		// Abort so the bucket does not keep billing for orphaned parts
+		if abortErr := b.abortMultipartUpload(objectKey, uploadID); abortErr != nil {
+			fmt.Printf("S3: WARNING: Failed to abort multipart upload %s: %v\n", uploadID, abortErr)
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (b *S3Backend) createMultipartUpload(ctx context.Context, objectKey string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.objectURL(objectKey, url.Values{"uploads": {""}}).String(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	b.setEncryptionHeaders(req)
+
+	resp, err := b.do(req, emptyPayloadHash)
+	if err != nil {
+		return "", fmt.Errorf("failed to start multipart upload: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("failed to decode multipart upload response: %w", err)
+	}
+	return result.UploadID, nil
+}
+
+func (b *S3Backend) uploadParts(ctx context.Context, objectKey, uploadID string, file *os.File) ([]s3CompletedPart, error) {
+	var parts []s3CompletedPart
+	buf := make([]byte, b.partSize)
+
+	for partNumber := 1; ; partNumber++ {
+		n, readErr := io.ReadFull(file, buf)
+		if n == 0 {
+			break
+		}
+		if readErr != nil && readErr != io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("failed to read part %d: %w", partNumber, readErr)
+		}
+
+		part := buf[:n]
+		sum := sha256.Sum256(part)
+
+		query := url.Values{"partNumber": {strconv.Itoa(partNumber)}, "uploadId": {uploadID}}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPut, b.objectURL(objectKey, query).String(), bytes.NewReader(part))
+		if err != nil {
+			return nil, err
+		}
+		req.ContentLength = int64(n)
+
+		resp, err := b.do(req, hex.EncodeToString(sum[:]))
+		if err != nil {
+			return nil, fmt.Errorf("failed to upload part %d: %w", partNumber, err)
+		}
+		resp.Body.Close()
+
+		parts = append(parts, s3CompletedPart{PartNumber: partNumber, ETag: resp.Header.Get("ETag")})
+		fmt.Printf("S3: Uploaded part %d (%.2f MB)\n", partNumber, float64(n)/(1024*1024))
+
+		if readErr == io.ErrUnexpectedEOF {
+			break
+		}
+	}
+
+	return parts, nil
+}
+
+func (b *S3Backend) completeMultipartUpload(ctx context.Context, objectKey, uploadID string, parts []s3CompletedPart) error {
+	body, err := xml.Marshal(s3CompleteUpload{Parts: parts})
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(body)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.objectURL(objectKey, url.Values{"uploadId": {uploadID}}).String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/xml")
+
+	resp, err := b.do(req, hex.EncodeToString(sum[:]))
+	if err != nil {
+		return fmt.Errorf("failed to complete multipart upload: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// S3 may report an error inside a 200 response once the upload is assembled
+	respBody, _ := io.ReadAll(resp.Body)
+	if bytes.Contains(respBody, []byte("<Error>")) {
+		return fmt.Errorf("failed to complete multipart upload: %s", string(respBody))
+	}
+	return nil
+}
+
+func (b *S3Backend) abortMultipartUpload(objectKey, uploadID string) error {
+	// Use a fresh context: the upload context may be the reason we are aborting
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, b.objectURL(objectKey, url.Values{"uploadId": {uploadID}}).String(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := b.do(req, emptyPayloadHash)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (b *S3Backend) setEncryptionHeaders(req *http.Request) {
+	if b.config.ServerSideEncryption == "" {
+		return
+	}
+	req.Header.Set("X-Amz-Server-Side-Encryption", b.config.ServerSideEncryption)
+	if b.config.KMSKeyID != "" {
+		req.Header.Set("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id", b.config.KMSKeyID)
+	}
+}
+
+func (b *S3Backend) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.objectURL(b.objectKey(key), nil).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// The body is streamed by the caller, so the client timeout must not apply
+	resp, err := b.doWith(http.DefaultClient, req, emptyPayloadHash)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (b *S3Backend) List(ctx context.Context, prefix string) ([]Object, error) {
+	var objects []Object
+	token := ""
+
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {b.objectKey(prefix)}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.objectURL("", query).String(), nil)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := b.do(req, emptyPayloadHash)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list objects: %w", err)
+		}
+
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode object list: %w", err)
+		}
+
+		for _, content := range result.Contents {
+			objects = append(objects, Object{
+				Key:     b.relativeKey(content.Key),
+				Size:    content.Size,
+				ModTime: content.LastModified,
+			})
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (b *S3Backend) Delete(ctx context.Context, key string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, b.objectURL(b.objectKey(key), nil).String(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := b.do(req, emptyPayloadHash)
+	if err != nil {
+		return fmt.Errorf("failed to delete object: %w", err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (b *S3Backend) Stat(ctx context.Context, key string) (Object, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, b.objectURL(b.objectKey(key), nil).String(), nil)
+	if err != nil {
+		return Object{}, err
+	}
+
+	resp, err := b.do(req, emptyPayloadHash)
+	if err != nil {
+		return Object{}, err
+	}
+	resp.Body.Close()
+
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return Object{Key: key, Size: resp.ContentLength, ModTime: modTime}, nil
+}
+
+func (b *S3Backend) do(req *http.Request, payloadHash string) (*http.Response, error) {
+	return b.doWith(b.client, req, payloadHash)
+}
+
+// doWith signs and sends the request, turning non-2xx responses into errors.
+func (b *S3Backend) doWith(client *http.Client, req *http.Request, payloadHash string) (*http.Response, error) {
+	b.sign(req, payloadHash, time.Now().UTC())
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("S3 request failed with status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	return resp, nil
+}
+
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// sign adds AWS Signature Version 4 headers to the request.
+func (b *S3Backend) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	host := req.URL.Host
+	signed := map[string]string{"host": host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") || lower == "content-type" {
+			signed[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+
+	names := make([]string, 0, len(signed))
+	for name := range signed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + signed[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		encodePath(req.URL.EscapedPath()),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + b.config.Region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+b.config.SecretAccessKey), date)
+	key = hmacSHA256(key, b.config.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		b.config.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func hashReader(r io.Reader) (string, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// canonicalQuery encodes query parameters sorted by key, as SigV4 requires.
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, key := range keys {
+		for _, value := range query[key] {
+			parts = append(parts, uriEncode(key, true)+"="+uriEncode(value, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func encodePath(escapedPath string) string {
+	if escapedPath == "" {
+		return "/"
+	}
+	return escapedPath
+}
+
+// uriEncode implements the SigV4 URI encoding: everything except unreserved
+// characters is percent-encoded, and "/" is kept unless encodeSlash is set.
+func uriEncode(value string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,471 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"mysql-backup/internal/config"
+)
+
+const (
+	fakeS3Bucket    = "backups"
+	fakeS3AccessKey = "AKIDTEST"
+	fakeS3Secret    = "secret/key+with=specials"
+	fakeS3Region    = "sa-east-1"
+	fakeS3PageSize  = 2
+)
+
+// fakeS3 is an in-process S3 server for path-style requests. It checks the
+// SigV4 signature and payload hash of every request on its own and keeps
+// objects and multipart uploads in memory.
+type fakeS3 struct {
+	t *testing.T
+
+	mu        sync.Mutex
+	objects   map[string][]byte
+	uploads   map[string]map[int][]byte // uploadId -> parts
+	completed []string
+	aborted   []string
+	listCalls int
+	failPart  int // Número da parte respondida com 500; 0 = nenhuma
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *httptest.Server) {
+	fake := &fakeS3{
+		t:       t,
+		objects: make(map[string][]byte),
+		uploads: make(map[string]map[int][]byte),
+	}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	return fake, server
+}
+
+func newTestS3Backend(t *testing.T, server *httptest.Server, prefix string) *S3Backend {
+	backend, err := NewS3Backend("s3-test", config.S3Config{
+		Endpoint:        server.URL,
+		Region:          fakeS3Region,
+		Bucket:          fakeS3Bucket,
+		Prefix:          prefix,
+		AccessKeyID:     fakeS3AccessKey,
+		SecretAccessKey: fakeS3Secret,
+		PathStyle:       true,
+		PartSizeMB:      5,
+	})
+	if err != nil {
+		t.Fatalf("NewS3Backend: %v", err)
+	}
+	return backend
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if problem := f.checkSignature(r, body); problem != "" {
+		f.t.Errorf("%s %s: %s", r.Method, r.URL.RequestURI(), problem)
+		writeS3Error(w, http.StatusForbidden, "SignatureDoesNotMatch")
+		return
+	}
+
+	bucketPrefix := "/" + fakeS3Bucket + "/"
+	if r.URL.Path != "/"+fakeS3Bucket && !strings.HasPrefix(r.URL.Path, bucketPrefix) {
+		writeS3Error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, bucketPrefix)
+	query := r.URL.Query()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch {
+	case r.Method == http.MethodGet && query.Get("list-type") == "2":
+		f.list(w, query)
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		uploadID := fmt.Sprintf("upload-%d/%d", len(f.uploads)+1, time.Now().UnixNano())
+		f.uploads[uploadID] = make(map[int][]byte)
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>",
+			fakeS3Bucket, key, uploadID)
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		parts, ok := f.uploads[query.Get("uploadId")]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		if number == f.failPart {
+			writeS3Error(w, http.StatusInternalServerError, "InternalError")
+			return
+		}
+		parts[number] = body
+		w.Header().Set("ETag", fmt.Sprintf("\"etag-%d\"", number))
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		f.complete(w, key, query.Get("uploadId"), body)
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		if _, ok := f.uploads[query.Get("uploadId")]; !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		delete(f.uploads, query.Get("uploadId"))
+		f.aborted = append(f.aborted, key)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut:
+		f.objects[key] = body
+	case r.Method == http.MethodHead || r.Method == http.MethodGet:
+		data, ok := f.objects[key]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeS3Error(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+func (f *fakeS3) complete(w http.ResponseWriter, key, uploadID string, body []byte) {
+	parts, ok := f.uploads[uploadID]
+	if !ok {
+		writeS3Error(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+
+	var request s3CompleteUpload
+	if err := xml.Unmarshal(body, &request); err != nil {
+		writeS3Error(w, http.StatusBadRequest, "MalformedXML")
+		return
+	}
+
+	var assembled []byte
+	for i, part := range request.Parts {
+		data, ok := parts[part.PartNumber]
+		if part.PartNumber != i+1 || !ok || part.ETag != fmt.Sprintf("\"etag-%d\"", part.PartNumber) {
+			writeS3Error(w, http.StatusBadRequest, "InvalidPart")
+			return
+		}
+		if i < len(request.Parts)-1 && len(data) < minPartSize {
+			writeS3Error(w, http.StatusBadRequest, "EntityTooSmall")
+			return
+		}
+		assembled = append(assembled, data...)
+	}
+
+	f.objects[key] = assembled
+	delete(f.uploads, uploadID)
+	f.completed = append(f.completed, key)
+	fmt.Fprintf(w, "<CompleteMultipartUploadResult><Key>%s</Key></CompleteMultipartUploadResult>", key)
+}
+
+// list answers ListObjectsV2 with at most fakeS3PageSize keys per page.
+func (f *fakeS3) list(w http.ResponseWriter, query url.Values) {
+	f.listCalls++
+
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, query.Get("prefix")) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	start := 0
+	if token := query.Get("continuation-token"); token != "" {
+		// Tokens carry characters that must survive query encoding
+		n, err := strconv.Atoi(strings.TrimPrefix(token, "page/+="))
+		if err != nil {
+			writeS3Error(w, http.StatusBadRequest, "InvalidArgument")
+			return
+		}
+		start = n
+	}
+	end := start + fakeS3PageSize
+	if end > len(keys) {
+		end = len(keys)
+	}
+
+	var out bytes.Buffer
+	out.WriteString("<ListBucketResult>")
+	for _, key := range keys[start:end] {
+		var escaped bytes.Buffer
+		xml.EscapeText(&escaped, []byte(key))
+		fmt.Fprintf(&out, "<Contents><Key>%s</Key><Size>%d</Size><LastModified>%s</LastModified><ETag>\"x\"</ETag></Contents>",
+			escaped.String(), len(f.objects[key]), time.Now().UTC().Format(time.RFC3339))
+	}
+	if end < len(keys) {
+		fmt.Fprintf(&out, "<IsTruncated>true</IsTruncated><NextContinuationToken>page/+=%d</NextContinuationToken>", end)
+	} else {
+		out.WriteString("<IsTruncated>false</IsTruncated>")
+	}
+	out.WriteString("</ListBucketResult>")
+	w.Write(out.Bytes())
+}
+
+func writeS3Error(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code></Error>", code)
+}
+
+// checkSignature recomputes the SigV4 signature from the request as the
+// server received it and describes any mismatch.
+func (f *fakeS3) checkSignature(r *http.Request, body []byte) string {
+	payloadHash := r.Header.Get("X-Amz-Content-Sha256")
+	sum := sha256.Sum256(body)
+	if payloadHash != hex.EncodeToString(sum[:]) {
+		return "payload hash does not match the body"
+	}
+
+	authorization := strings.TrimPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ")
+	fields := make(map[string]string)
+	for _, field := range strings.Split(authorization, ", ") {
+		name, value, _ := strings.Cut(field, "=")
+		fields[name] = value
+	}
+
+	amzDate := r.Header.Get("X-Amz-Date")
+	if len(amzDate) != len("20060102T150405Z") {
+		return "missing X-Amz-Date"
+	}
+	scope := amzDate[:8] + "/" + fakeS3Region + "/s3/aws4_request"
+	if fields["Credential"] != fakeS3AccessKey+"/"+scope {
+		return "unexpected credential " + fields["Credential"]
+	}
+
+	var canonicalHeaders strings.Builder
+	for _, name := range strings.Split(fields["SignedHeaders"], ";") {
+		value := r.Header.Get(name)
+		if name == "host" {
+			value = r.Host
+		}
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+
+	// The canonical URI and query are rebuilt from the decoded values, so a
+	// path sent with another encoding than the one signed fails here
+	values, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		return "invalid query: " + err.Error()
+	}
+	var queryParts []string
+	for name, list := range values {
+		for _, value := range list {
+			queryParts = append(queryParts, awsEncode(name, true)+"="+awsEncode(value, true))
+		}
+	}
+	sort.Strings(queryParts)
+
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		awsEncode(r.URL.Path, false),
+		strings.Join(queryParts, "&"),
+		canonicalHeaders.String(),
+		fields["SignedHeaders"],
+		payloadHash,
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + fakeS3Secret)
+	for _, part := range []string{amzDate[:8], fakeS3Region, "s3", "aws4_request"} {
+		key = sum256HMAC(key, part)
+	}
+	if expected := hex.EncodeToString(sum256HMAC(key, stringToSign)); fields["Signature"] != expected {
+		return "signature mismatch for canonical request:\n" + canonicalRequest
+	}
+	return ""
+}
+
+func sum256HMAC(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// awsEncode is the URI encoding of the SigV4 documentation, written apart
+// from uriEncode so the test does not just repeat the code under test.
+func awsEncode(value string, encodeSlash bool) string {
+	const unreserved = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_.~"
+	var out strings.Builder
+	for _, c := range []byte(value) {
+		if strings.IndexByte(unreserved, c) >= 0 || (c == '/' && !encodeSlash) {
+			out.WriteByte(c)
+		} else {
+			out.WriteString("%" + strings.ToUpper(hex.EncodeToString([]byte{c})))
+		}
+	}
+	return out.String()
+}
+
+func writeTestFile(t *testing.T, size int) (string, []byte) {
+	t.Helper()
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 31)
+	}
+	path := filepath.Join(t.TempDir(), "backup.sql.gz")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path, data
+}
+
+func TestS3SignsKeysWithSpecialCharacters(t *testing.T) {
+	fake, server := newFakeS3(t)
+	backend := newTestS3Backend(t, server, "prefix with space")
+	localPath, data := writeTestFile(t, 1024)
+	ctx := context.Background()
+
+	keys := []string{
+		"machine 1/backup_app_20240101.sql.gz",
+		"machine_1/db+name=x&y/backup (1).sql.gz",
+		"máquina/ação;$@,:'!*.sql.gz",
+		"machine_1/100%/~tilde#hash?.sql.gz",
+	}
+	for _, key := range keys {
+		obj, err := backend.Put(ctx, key, localPath)
+		if err != nil {
+			t.Fatalf("Put(%q): %v", key, err)
+		}
+		if obj.Key != key || obj.Size != int64(len(data)) {
+			t.Errorf("Put(%q) = %+v", key, obj)
+		}
+		if _, ok := fake.objects["prefix with space/"+key]; !ok {
+			t.Errorf("object %q not stored under its decoded key", key)
+		}
+
+		reader, err := backend.Get(ctx, key)
+		if err != nil {
+			t.Fatalf("Get(%q): %v", key, err)
+		}
+		got, _ := io.ReadAll(reader)
+		reader.Close()
+		if !bytes.Equal(got, data) {
+			t.Errorf("Get(%q) returned other content", key)
+		}
+	}
+
+	objects, err := backend.List(ctx, "")
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	var listed []string
+	for _, obj := range objects {
+		listed = append(listed, obj.Key)
+	}
+	sort.Strings(listed)
+	sort.Strings(keys)
+	if strings.Join(listed, "\n") != strings.Join(keys, "\n") {
+		t.Errorf("List = %q, want %q", listed, keys)
+	}
+
+	for _, key := range keys {
+		if err := backend.Delete(ctx, key); err != nil {
+			t.Fatalf("Delete(%q): %v", key, err)
+		}
+	}
+	if len(fake.objects) != 0 {
+		t.Errorf("objects left after delete: %d", len(fake.objects))
+	}
+	if _, err := backend.Stat(ctx, keys[0]); err != ErrNotFound {
+		t.Errorf("Stat of a deleted object = %v, want ErrNotFound", err)
+	}
+}
+
+func TestS3MultipartUpload(t *testing.T) {
+	fake, server := newFakeS3(t)
+	backend := newTestS3Backend(t, server, "")
+	localPath, data := writeTestFile(t, 2*minPartSize+1234)
+
+	obj, err := backend.Put(context.Background(), "machine 1/big file.sql.gz", localPath)
+	if err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if obj.Size != int64(len(data)) {
+		t.Errorf("size = %d, want %d", obj.Size, len(data))
+	}
+	if !bytes.Equal(fake.objects["machine 1/big file.sql.gz"], data) {
+		t.Error("assembled object differs from the file")
+	}
+	if len(fake.completed) != 1 || len(fake.aborted) != 0 || len(fake.uploads) != 0 {
+		t.Errorf("completed %v, aborted %v, pending %d", fake.completed, fake.aborted, len(fake.uploads))
+	}
+}
+
+func TestS3MultipartUploadAbortsOnFailure(t *testing.T) {
+	fake, server := newFakeS3(t)
+	fake.failPart = 2
+	backend := newTestS3Backend(t, server, "")
+	localPath, _ := writeTestFile(t, 2*minPartSize+1234)
+
+	if _, err := backend.Put(context.Background(), "machine_1/big.sql.gz", localPath); err == nil {
+		t.Fatal("Put succeeded although a part failed")
+	} else if !strings.Contains(err.Error(), "part 2") || !strings.Contains(err.Error(), "500") {
+		t.Errorf("error = %v, want the failed part and status", err)
+	}
+
+	if len(fake.aborted) != 1 || fake.aborted[0] != "machine_1/big.sql.gz" {
+		t.Errorf("aborted = %v, want the failed upload", fake.aborted)
+	}
+	if len(fake.uploads) != 0 || len(fake.completed) != 0 {
+		t.Errorf("pending uploads %d, completed %v", len(fake.uploads), fake.completed)
+	}
+	if _, ok := fake.objects["machine_1/big.sql.gz"]; ok {
+		t.Error("failed upload left an object")
+	}
+}
+
+func TestS3ListPaginates(t *testing.T) {
+	fake, server := newFakeS3(t)
+	backend := newTestS3Backend(t, server, "root")
+
+	var want []string
+	for i := 0; i < 5; i++ {
+		key := fmt.Sprintf("machine_1/backup %d.sql.gz", i)
+		fake.objects["root/"+key] = []byte("x")
+		want = append(want, key)
+	}
+	fake.objects["root/machine_2/other.sql.gz"] = []byte("x")
+	fake.objects["elsewhere/machine_1/backup.sql.gz"] = []byte("x")
+
+	objects, err := backend.List(context.Background(), "machine_1/")
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+
+	var got []string
+	for _, obj := range objects {
+		got = append(got, obj.Key)
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("List = %q, want %q", got, want)
+	}
+	if fake.listCalls != 3 {
+		t.Errorf("list requests = %d, want 3 pages", fake.listCalls)
+	}
+}
@@ -0,0 +1,248 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pkg/sftp"
+
+	"mysql-backup/internal/config"
+	"mysql-backup/internal/ssh"
+)
+
+const (
+	posixRenameExtension = "posix-rename@openssh.com"
+
+	// Reads of this size are split into requests that are in flight together,
+	// so a download is not bound by the round-trip time
+	sftpReadBuffer = 1 << 20
+)
+
+// SFTPBackend copies backups to a remote server over SFTP, authenticating
+// the same way machines are reached. Keys map to paths below root.
+type SFTPBackend struct {
+	name string
+	ssh  config.SSHConfig
+	root string
+}
+
+func NewSFTPBackend(name string, sshConfig config.SSHConfig, root string) (*SFTPBackend, error) {
+	if sshConfig.Host == "" {
+		return nil, fmt.Errorf("sftp storage %s has no host", name)
+	}
+	if sshConfig.Port == 0 {
+		sshConfig.Port = 22
+	}
+	if root == "" {
+		root = "."
+	}
+
+	return &SFTPBackend{
+		name: name,
+		ssh:  sshConfig,
+		root: path.Clean(root),
+	}, nil
+}
+
+func (b *SFTPBackend) Name() string {
+	return b.name
+}
+
+// sftpSession is one SSH connection with its SFTP subsystem.
+type sftpSession struct {
+	*sftp.Client
+	conn *ssh.Client
+}
+
+func (s *sftpSession) Close() error {
+	s.Client.Close()
+	return s.conn.Close()
+}
+
+// replace moves oldPath to newPath, replacing newPath when the server supports
+// the OpenSSH posix-rename extension. Plain SFTP v3 renames fail if the
+// target exists, so it is removed first in that case.
+func (s *sftpSession) replace(oldPath, newPath string) error {
+	if _, ok := s.HasExtension(posixRenameExtension); ok {
+		return s.PosixRename(oldPath, newPath)
+	}
+
+	if err := s.Remove(newPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return s.Rename(oldPath, newPath)
+}
+
+func (b *SFTPBackend) connect() (*sftpSession, error) {
+	conn := ssh.NewClient(&b.ssh)
+	client, err := conn.NewSFTP()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to open sftp session to %s: %w", b.ssh.Host, err)
+	}
+	return &sftpSession{Client: client, conn: conn}, nil
+}
+
+// path resolves a key below the root, refusing keys that escape it.
+func (b *SFTPBackend) path(key string) string {
+	return path.Join(b.root, path.Clean("/"+key))
+}
+
+func (b *SFTPBackend) Put(ctx context.Context, key, localPath string) (Object, error) {
+	src, err := os.Open(localPath)
+	if err != nil {
+		return Object{}, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer src.Close()
+
+	session, err := b.connect()
+	if err != nil {
+		return Object{}, err
+	}
+	defer session.Close()
+
+	dstPath := b.path(key)
+	if err := session.MkdirAll(path.Dir(dstPath)); err != nil {
+		return Object{}, err
+	}
+
+	// Upload under a temporary name so a partial copy is never mistaken for a backup
+	tmpPath := dstPath + ".partial"
+	dst, err := session.Create(tmpPath)
+	if err != nil {
+		return Object{}, err
+	}
+
+	// Keep several writes in flight; the size of a contextReader is unknown,
+	// so ReadFrom would send them one at a time
+	if _, err := dst.ReadFromWithConcurrency(contextReader{ctx: ctx, reader: src}, 0); err != nil {
+		dst.Close()
+		session.Remove(tmpPath)
+		return Object{}, fmt.Errorf("failed to upload file: %w", err)
+	}
+
+	if err := dst.Close(); err != nil {
+		session.Remove(tmpPath)
+		return Object{}, fmt.Errorf("failed to close remote file: %w", err)
+	}
+
+	if err := session.replace(tmpPath, dstPath); err != nil {
+		session.Remove(tmpPath)
+		return Object{}, fmt.Errorf("failed to rename remote file: %w", err)
+	}
+
+	return b.stat(session, key)
+}
+
+func (b *SFTPBackend) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	session, err := b.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := session.Open(b.path(key))
+	if err != nil {
+		session.Close()
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	return &sftpReader{Reader: bufio.NewReaderSize(file, sftpReadBuffer), file: file, session: session}, nil
+}
+
+func (b *SFTPBackend) List(ctx context.Context, prefix string) ([]Object, error) {
+	session, err := b.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	var objects []Object
+	err = b.walk(session, "", func(key string, info os.FileInfo) {
+		if strings.HasPrefix(key, prefix) && !strings.HasSuffix(key, ".partial") {
+			objects = append(objects, Object{Key: key, Size: info.Size(), ModTime: info.ModTime()})
+		}
+	})
+	return objects, err
+}
+
+// walk visits every file below the root, recursing into directories.
+func (b *SFTPBackend) walk(session *sftpSession, dir string, fn func(key string, info os.FileInfo)) error {
+	entries, err := session.ReadDir(path.Join(b.root, dir))
+	if err != nil {
+		if dir == "" && errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	for _, entry := range entries {
+		key := path.Join(dir, entry.Name())
+		if entry.IsDir() {
+			if err := b.walk(session, key, fn); err != nil {
+				return err
+			}
+			continue
+		}
+		fn(key, entry)
+	}
+	return nil
+}
+
+func (b *SFTPBackend) Delete(ctx context.Context, key string) error {
+	session, err := b.connect()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	err = session.Remove(b.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (b *SFTPBackend) Stat(ctx context.Context, key string) (Object, error) {
+	session, err := b.connect()
+	if err != nil {
+		return Object{}, err
+	}
+	defer session.Close()
+
+	return b.stat(session, key)
+}
+
+func (b *SFTPBackend) stat(session *sftpSession, key string) (Object, error) {
+	info, err := session.Stat(b.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return Object{}, ErrNotFound
+	}
+	if err != nil {
+		return Object{}, err
+	}
+
+	return Object{Key: key, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+// sftpReader reads the remote file through a large buffer and closes the SSH
+// connection along with it.
+type sftpReader struct {
+	*bufio.Reader
+	file    *sftp.File
+	session *sftpSession
+}
+
+func (r *sftpReader) Close() error {
+	err := r.file.Close()
+	r.session.Close()
+	return err
+}
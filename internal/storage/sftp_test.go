@@ -0,0 +1,712 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"mysql-backup/internal/config"
+)
+
+const (
+	fakeSFTPUser     = "backup"
+	fakeSFTPPassword = "secret"
+)
+
+// SFTP v3 packet types and status codes answered by fakeSFTP.
+const (
+	sshFxpInit          = 1
+	sshFxpVersion       = 2
+	sshFxpOpen          = 3
+	sshFxpClose         = 4
+	sshFxpRead          = 5
+	sshFxpWrite         = 6
+	sshFxpOpendir       = 11
+	sshFxpReaddir       = 12
+	sshFxpRemove        = 13
+	sshFxpMkdir         = 14
+	sshFxpStat          = 17
+	sshFxpRename        = 18
+	sshFxpStatus        = 101
+	sshFxpHandle        = 102
+	sshFxpData          = 103
+	sshFxpName          = 104
+	sshFxpAttrs         = 105
+	sshFxpExtended      = 200
+	sshFxOK             = 0
+	sshFxEOF            = 1
+	sshFxNoSuchFile     = 2
+	sshFxPermission     = 3
+	sshFxFailure        = 4
+	sshFxOpUnsupported  = 8
+	sshFxfWrite         = 0x02
+	sshFxfCreat         = 0x08
+	sshFxfTrunc         = 0x10
+	fakeSFTPPosixRename = "posix-rename@openssh.com"
+)
+
+// fakeSFTP is an in-process SSH server with a minimal SFTP v3 subsystem that
+// serves a temporary directory. Paths are resolved below root, and every
+// change to the tree is recorded in ops.
+type fakeSFTP struct {
+	t           *testing.T
+	root        string
+	posixRename bool // Anunciar a extensão posix-rename@openssh.com
+
+	mu  sync.Mutex
+	ops []string
+}
+
+func newFakeSFTP(t *testing.T, posixRename bool) (*fakeSFTP, config.SSHConfig) {
+	t.Helper()
+
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverConfig := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if conn.User() == fakeSFTPUser && string(password) == fakeSFTPPassword {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("invalid credentials for %s", conn.User())
+		},
+	}
+	serverConfig.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fake := &fakeSFTP{t: t, root: t.TempDir(), posixRename: posixRename}
+
+	var wg sync.WaitGroup
+	t.Cleanup(func() {
+		listener.Close()
+		wg.Wait()
+	})
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				fake.serveConn(conn, serverConfig)
+			}()
+		}
+	}()
+
+	return fake, config.SSHConfig{
+		Host:     "127.0.0.1",
+		Port:     listener.Addr().(*net.TCPAddr).Port,
+		Username: fakeSFTPUser,
+		Password: fakeSFTPPassword,
+	}
+}
+
+func (f *fakeSFTP) serveConn(conn net.Conn, serverConfig *ssh.ServerConfig) {
+	defer conn.Close()
+
+	_, channels, requests, err := ssh.NewServerConn(conn, serverConfig)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range channelRequests {
+				// The payload of a subsystem request is the subsystem name as an SSH string
+				ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if ok {
+					go func() {
+						f.serve(channel)
+						channel.SendRequest("exit-status", false, []byte{0, 0, 0, 0})
+						channel.Close()
+					}()
+				}
+			}
+		}()
+	}
+}
+
+func (f *fakeSFTP) record(format string, args ...interface{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.ops = append(f.ops, fmt.Sprintf(format, args...))
+}
+
+func (f *fakeSFTP) recorded() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.ops...)
+}
+
+// local maps a remote path to the served directory, never escaping it.
+func (f *fakeSFTP) local(remotePath string) string {
+	return filepath.Join(f.root, filepath.FromSlash(path.Clean("/"+remotePath)))
+}
+
+// fakeSFTPDir is an open directory handle; entries are sent in one batch.
+type fakeSFTPDir struct {
+	path string
+	sent bool
+}
+
+func (f *fakeSFTP) serve(rw io.ReadWriter) {
+	files := make(map[string]*os.File)
+	dirs := make(map[string]*fakeSFTPDir)
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	nextHandle := 0
+	newHandle := func() string {
+		nextHandle++
+		return fmt.Sprintf("h%d", nextHandle)
+	}
+
+	for {
+		typ, req, err := readSFTPPacket(rw)
+		if err != nil {
+			return
+		}
+
+		if typ == sshFxpInit {
+			var reply sftpMsg
+			reply.putUint32(3)
+			if f.posixRename {
+				reply.putString(fakeSFTPPosixRename)
+				reply.putString("1")
+			}
+			writeSFTPPacket(rw, sshFxpVersion, reply)
+			continue
+		}
+
+		id := req.uint32()
+		status := func(err error) {
+			var reply sftpMsg
+			reply.putUint32(id)
+			reply.putUint32(sftpStatusCode(err))
+			if err != nil {
+				reply.putString(err.Error())
+			} else {
+				reply.putString("")
+			}
+			reply.putString("")
+			writeSFTPPacket(rw, sshFxpStatus, reply)
+		}
+		sendHandle := func(handle string) {
+			var reply sftpMsg
+			reply.putUint32(id)
+			reply.putString(handle)
+			writeSFTPPacket(rw, sshFxpHandle, reply)
+		}
+
+		switch typ {
+		case sshFxpOpen:
+			name, pflags := req.string(), req.uint32()
+			flags := os.O_RDONLY
+			if pflags&sshFxfWrite != 0 {
+				flags = os.O_WRONLY
+				if pflags&sshFxfCreat != 0 {
+					flags |= os.O_CREATE
+				}
+				if pflags&sshFxfTrunc != 0 {
+					flags |= os.O_TRUNC
+				}
+				f.record("create %s", name)
+			}
+			file, err := os.OpenFile(f.local(name), flags, 0644)
+			if err != nil {
+				status(err)
+				continue
+			}
+			handle := newHandle()
+			files[handle] = file
+			sendHandle(handle)
+
+		case sshFxpClose:
+			handle := req.string()
+			if file, ok := files[handle]; ok {
+				delete(files, handle)
+				status(file.Close())
+			} else if _, ok := dirs[handle]; ok {
+				delete(dirs, handle)
+				status(nil)
+			} else {
+				status(os.ErrInvalid)
+			}
+
+		case sshFxpRead:
+			handle, offset, length := req.string(), req.uint64(), req.uint32()
+			file, ok := files[handle]
+			if !ok {
+				status(os.ErrInvalid)
+				continue
+			}
+			buf := make([]byte, length)
+			n, err := file.ReadAt(buf, int64(offset))
+			if n == 0 {
+				status(err)
+				continue
+			}
+			var reply sftpMsg
+			reply.putUint32(id)
+			reply.putString(string(buf[:n]))
+			writeSFTPPacket(rw, sshFxpData, reply)
+
+		case sshFxpWrite:
+			handle, offset, data := req.string(), req.uint64(), req.string()
+			file, ok := files[handle]
+			if !ok {
+				status(os.ErrInvalid)
+				continue
+			}
+			_, err := file.WriteAt([]byte(data), int64(offset))
+			status(err)
+
+		case sshFxpOpendir:
+			name := req.string()
+			if info, err := os.Stat(f.local(name)); err != nil {
+				status(err)
+				continue
+			} else if !info.IsDir() {
+				status(fmt.Errorf("%s is not a directory", name))
+				continue
+			}
+			handle := newHandle()
+			dirs[handle] = &fakeSFTPDir{path: f.local(name)}
+			sendHandle(handle)
+
+		case sshFxpReaddir:
+			dir, ok := dirs[req.string()]
+			if !ok {
+				status(os.ErrInvalid)
+				continue
+			}
+			if dir.sent {
+				status(io.EOF)
+				continue
+			}
+			dir.sent = true
+			entries, err := os.ReadDir(dir.path)
+			if err != nil {
+				status(err)
+				continue
+			}
+			var reply sftpMsg
+			reply.putUint32(id)
+			reply.putUint32(uint32(len(entries) + 2))
+			for _, name := range []string{".", ".."} {
+				info, _ := os.Stat(dir.path)
+				reply.putString(name)
+				reply.putString(name)
+				reply.putAttrs(info)
+			}
+			for _, entry := range entries {
+				info, err := entry.Info()
+				if err != nil {
+					f.t.Errorf("stat %s: %v", entry.Name(), err)
+					return
+				}
+				reply.putString(entry.Name())
+				reply.putString(entry.Name())
+				reply.putAttrs(info)
+			}
+			writeSFTPPacket(rw, sshFxpName, reply)
+
+		case sshFxpRemove:
+			name := req.string()
+			f.record("remove %s", name)
+			status(os.Remove(f.local(name)))
+
+		case sshFxpMkdir:
+			name := req.string()
+			f.record("mkdir %s", name)
+			status(os.Mkdir(f.local(name), 0755))
+
+		case sshFxpStat:
+			info, err := os.Stat(f.local(req.string()))
+			if err != nil {
+				status(err)
+				continue
+			}
+			var reply sftpMsg
+			reply.putUint32(id)
+			reply.putAttrs(info)
+			writeSFTPPacket(rw, sshFxpAttrs, reply)
+
+		case sshFxpRename:
+			// Plain SFTP v3 renames never replace an existing file
+			oldName, newName := req.string(), req.string()
+			f.record("rename %s %s", oldName, newName)
+			if _, err := os.Lstat(f.local(newName)); err == nil {
+				status(fmt.Errorf("%s already exists", newName))
+				continue
+			}
+			status(os.Rename(f.local(oldName), f.local(newName)))
+
+		case sshFxpExtended:
+			if name := req.string(); name != fakeSFTPPosixRename || !f.posixRename {
+				status(errSFTPUnsupported)
+				continue
+			}
+			oldName, newName := req.string(), req.string()
+			f.record("posix-rename %s %s", oldName, newName)
+			status(os.Rename(f.local(oldName), f.local(newName)))
+
+		default:
+			status(errSFTPUnsupported)
+		}
+	}
+}
+
+var errSFTPUnsupported = errors.New("operation not supported")
+
+func sftpStatusCode(err error) uint32 {
+	switch {
+	case err == nil:
+		return sshFxOK
+	case errors.Is(err, io.EOF):
+		return sshFxEOF
+	case errors.Is(err, os.ErrNotExist):
+		return sshFxNoSuchFile
+	case errors.Is(err, os.ErrPermission):
+		return sshFxPermission
+	case errors.Is(err, errSFTPUnsupported):
+		return sshFxOpUnsupported
+	}
+	return sshFxFailure
+}
+
+func readSFTPPacket(r io.Reader) (byte, *sftpMsg, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	data := make([]byte, binary.BigEndian.Uint32(header)-1)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return 0, nil, err
+	}
+	msg := sftpMsg(data)
+	return header[4], &msg, nil
+}
+
+func writeSFTPPacket(w io.Writer, typ byte, payload sftpMsg) {
+	packet := binary.BigEndian.AppendUint32(nil, uint32(len(payload)+1))
+	packet = append(packet, typ)
+	w.Write(append(packet, payload...))
+}
+
+// sftpMsg builds and decodes packet payloads. Decoding a truncated payload
+// yields zero values, which the handlers treat as an unknown handle or path.
+type sftpMsg []byte
+
+func (m *sftpMsg) putUint32(v uint32) {
+	*m = binary.BigEndian.AppendUint32(*m, v)
+}
+
+func (m *sftpMsg) putString(v string) {
+	m.putUint32(uint32(len(v)))
+	*m = append(*m, v...)
+}
+
+func (m *sftpMsg) uint32() uint32 {
+	if len(*m) < 4 {
+		return 0
+	}
+	value := binary.BigEndian.Uint32(*m)
+	*m = (*m)[4:]
+	return value
+}
+
+func (m *sftpMsg) uint64() uint64 {
+	if len(*m) < 8 {
+		return 0
+	}
+	value := binary.BigEndian.Uint64(*m)
+	*m = (*m)[8:]
+	return value
+}
+
+func (m *sftpMsg) string() string {
+	length := int(m.uint32())
+	if length > len(*m) {
+		length = len(*m)
+	}
+	value := string((*m)[:length])
+	*m = (*m)[length:]
+	return value
+}
+
+func (m *sftpMsg) putAttrs(info os.FileInfo) {
+	perm := uint32(info.Mode().Perm()) | 0100000
+	if info.IsDir() {
+		perm = uint32(info.Mode().Perm()) | 0040000
+	}
+	m.putUint32(0x1 | 0x4 | 0x8) // size, permissions, acmodtime
+	*m = binary.BigEndian.AppendUint64(*m, uint64(info.Size()))
+	m.putUint32(perm)
+	m.putUint32(uint32(info.ModTime().Unix()))
+	m.putUint32(uint32(info.ModTime().Unix()))
+}
+
+func newTestSFTPBackend(t *testing.T, posixRename bool) (*fakeSFTP, *SFTPBackend) {
+	t.Helper()
+	fake, sshConfig := newFakeSFTP(t, posixRename)
+	backend, err := NewSFTPBackend("sftp-test", sshConfig, "backups")
+	if err != nil {
+		t.Fatalf("NewSFTPBackend: %v", err)
+	}
+	return fake, backend
+}
+
+func readRemote(t *testing.T, backend Backend, key string) []byte {
+	t.Helper()
+	reader, err := backend.Get(context.Background(), key)
+	if err != nil {
+		t.Fatalf("Get(%q): %v", key, err)
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("read %q: %v", key, err)
+	}
+	return data
+}
+
+func TestSFTPPutUploadsUnderTemporaryName(t *testing.T) {
+	for _, posixRename := range []bool{true, false} {
+		t.Run(fmt.Sprintf("posix-rename=%v", posixRename), func(t *testing.T) {
+			fake, backend := newTestSFTPBackend(t, posixRename)
+			ctx := context.Background()
+			key := "machine_1/backup_app.sql.gz"
+
+			// An older copy under the same key must be replaced
+			if err := os.MkdirAll(fake.local("backups/machine_1"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(fake.local("backups/"+key), []byte("old"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			// Larger than one 32 KiB request so the upload spans several writes
+			localPath, data := writeTestFile(t, 100*1024)
+			obj, err := backend.Put(ctx, key, localPath)
+			if err != nil {
+				t.Fatalf("Put: %v", err)
+			}
+			if obj.Key != key || obj.Size != int64(len(data)) || obj.ModTime.IsZero() {
+				t.Errorf("Put = %+v", obj)
+			}
+
+			rename := "posix-rename backups/" + key + ".partial backups/" + key
+			if !posixRename {
+				rename = "rename backups/" + key + ".partial backups/" + key
+			}
+			var want []string
+			want = append(want, "create backups/"+key+".partial")
+			if !posixRename {
+				want = append(want, "remove backups/"+key)
+			}
+			want = append(want, rename)
+			if got := fake.recorded(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+				t.Errorf("operations = %q, want %q", got, want)
+			}
+
+			if got := readRemote(t, backend, key); !bytes.Equal(got, data) {
+				t.Error("uploaded file differs from the local one")
+			}
+			if _, err := os.Stat(fake.local("backups/" + key + ".partial")); !os.IsNotExist(err) {
+				t.Errorf("temporary file left behind: %v", err)
+			}
+		})
+	}
+}
+
+func TestSFTPPutRemovesTemporaryFileOnFailure(t *testing.T) {
+	fake, backend := newTestSFTPBackend(t, true)
+	localPath, _ := writeTestFile(t, 1024)
+	key := "machine_1/backup_app.sql.gz"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := backend.Put(ctx, key, localPath); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Put with a cancelled context = %v, want context.Canceled", err)
+	}
+
+	want := []string{
+		"mkdir backups",
+		"mkdir backups/machine_1",
+		"create backups/" + key + ".partial",
+		"remove backups/" + key + ".partial",
+	}
+	if got := fake.recorded(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("operations = %q, want %q", got, want)
+	}
+	if _, err := backend.Stat(context.Background(), key); err != ErrNotFound {
+		t.Errorf("Stat after a failed upload = %v, want ErrNotFound", err)
+	}
+}
+
+func TestSFTPPutCreatesTemplateDirectories(t *testing.T) {
+	fake, backend := newTestSFTPBackend(t, true)
+	localPath, data := writeTestFile(t, 1024)
+	ctx := context.Background()
+	at := time.Date(2024, 3, 5, 2, 0, 0, 0, time.UTC)
+
+	key := KeyFor("{machine}/{database}/{date}", "machine_1", "app", at, "backup_app.sql.gz")
+	if key != "machine_1/app/2024-03-05/backup_app.sql.gz" {
+		t.Fatalf("KeyFor = %q", key)
+	}
+	if _, err := backend.Put(ctx, key, localPath); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	// A second database reuses the directories that already exist
+	other := KeyFor("{machine}/{database}/{date}", "machine_1", "shop", at, "backup_shop.sql.gz")
+	if _, err := backend.Put(ctx, other, localPath); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	var mkdirs []string
+	for _, op := range fake.recorded() {
+		if strings.HasPrefix(op, "mkdir ") {
+			mkdirs = append(mkdirs, strings.TrimPrefix(op, "mkdir "))
+		}
+	}
+	wantDirs := []string{
+		"backups",
+		"backups/machine_1",
+		"backups/machine_1/app",
+		"backups/machine_1/app/2024-03-05",
+		"backups/machine_1/shop",
+		"backups/machine_1/shop/2024-03-05",
+	}
+	if strings.Join(mkdirs, "\n") != strings.Join(wantDirs, "\n") {
+		t.Errorf("created directories = %q, want %q", mkdirs, wantDirs)
+	}
+
+	stored, err := os.ReadFile(fake.local("backups/" + key))
+	if err != nil || !bytes.Equal(stored, data) {
+		t.Errorf("file not stored at the template path: %v", err)
+	}
+
+	objects, err := backend.List(ctx, "machine_1/")
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	var listed []string
+	for _, obj := range objects {
+		listed = append(listed, obj.Key)
+	}
+	sort.Strings(listed)
+	if want := []string{key, other}; strings.Join(listed, "\n") != strings.Join(want, "\n") {
+		t.Errorf("List = %q, want %q", listed, want)
+	}
+}
+
+func TestSFTPPruneRemovesExpiredBackups(t *testing.T) {
+	fake, backend := newTestSFTPBackend(t, true)
+	ctx := context.Background()
+	now := time.Now()
+	cutoff := now.AddDate(0, 0, -7)
+
+	files := map[string]time.Time{
+		"machine_1/app/2024-01-01/backup_app.sql.gz":               now.AddDate(0, 0, -30),
+		"machine_1/app/2024-01-01/backup_app.sql.gz.manifest.json": now.AddDate(0, 0, -30),
+		"machine_1/app/2024-03-01/backup_app.sql.gz":               now.AddDate(0, 0, -1),
+		"machine_2/backup_shop.sql.gz.gpg":                         now.AddDate(0, 0, -8),
+		"machine_2/notes.txt":                                      now.AddDate(0, 0, -30),
+		"machine_2/backup_shop.sql.gz.partial":                     now.AddDate(0, 0, -30),
+	}
+	for key, modTime := range files {
+		localPath := fake.local("backups/" + key)
+		if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(localPath, []byte(key), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(localPath, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	removed, err := Prune(ctx, backend, "", cutoff)
+	if err != nil {
+		t.Fatalf("Prune: %v", err)
+	}
+
+	var removedKeys []string
+	for _, obj := range removed {
+		removedKeys = append(removedKeys, obj.Key)
+	}
+	sort.Strings(removedKeys)
+	wantRemoved := []string{
+		"machine_1/app/2024-01-01/backup_app.sql.gz",
+		"machine_1/app/2024-01-01/backup_app.sql.gz.manifest.json",
+		"machine_2/backup_shop.sql.gz.gpg",
+	}
+	if strings.Join(removedKeys, "\n") != strings.Join(wantRemoved, "\n") {
+		t.Errorf("removed = %q, want %q", removedKeys, wantRemoved)
+	}
+
+	for key := range files {
+		_, err := os.Stat(fake.local("backups/" + key))
+		expired := false
+		for _, removedKey := range wantRemoved {
+			expired = expired || removedKey == key
+		}
+		if expired && !os.IsNotExist(err) {
+			t.Errorf("%s was not deleted from the server", key)
+		}
+		if !expired && err != nil {
+			t.Errorf("%s should have been kept: %v", key, err)
+		}
+	}
+
+	// Deleting a key that is already gone reports ErrNotFound
+	if err := backend.Delete(ctx, wantRemoved[0]); err != ErrNotFound {
+		t.Errorf("Delete of a removed file = %v, want ErrNotFound", err)
+	}
+}
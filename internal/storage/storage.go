@@ -0,0 +1,123 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"mysql-backup/internal/config"
+)
+
+// Object describes a backup file stored in a backend. Keys are slash-separated
+// paths such as "machine_id/backup_x.sql.gz".
+type Object struct {
+	Key     string    `json:"key"`
+	ID      string    `json:"id,omitempty"` // Backend specific identifier, when different from the key
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// Backend is a destination backups can be copied to and read back from.
+type Backend interface {
+	// Name identifies the backend in logs and history entries.
+	Name() string
+	// Put uploads the local file at localPath under key.
+	Put(ctx context.Context, key, localPath string) (Object, error)
+	// Get opens the object stored under key for reading.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// List returns the objects whose key starts with prefix.
+	List(ctx context.Context, prefix string) ([]Object, error)
+	// Delete removes the object stored under key.
+	Delete(ctx context.Context, key string) error
+	// Stat returns metadata about the object stored under key.
+	Stat(ctx context.Context, key string) (Object, error)
+}
+
+// ErrNotFound is returned when a key does not exist in a backend.
+var ErrNotFound = fmt.Errorf("object not found")
+
+// New builds the backend described by a storage config.
+func New(cfg *config.Config, storage config.StorageConfig) (Backend, error) {
+	switch storage.Type {
+	case "local":
+		return NewLocalBackend(storage.ID, storage.Path)
+	case "drive":
+		return NewDriveBackend(storage.ID, cfg)
+	case "s3":
+		s3Config := cfg.S3
+		if storage.S3 != nil {
+			s3Config = *storage.S3
+		}
+		return NewS3Backend(storage.ID, s3Config)
+	case "sftp":
+		if storage.SSH == nil {
+			return nil, fmt.Errorf("sftp storage %s has no SSH settings", storage.Name)
+		}
+		return NewSFTPBackend(storage.ID, *storage.SSH, storage.Path)
+	default:
+		return nil, fmt.Errorf("unknown storage type: %s", storage.Type)
+	}
+}
+
+// DefaultPathTemplate keeps the layout used before templates existed: one
+// directory per machine.
+const DefaultPathTemplate = "{machine}"
+
+// KeyFor builds the key a backup file is stored under. The template may use
+// {machine}, {database} and {date} (YYYY-MM-DD).
+func KeyFor(template, machineID, database string, at time.Time, fileName string) string {
+	if template == "" {
+		template = DefaultPathTemplate
+	}
+
+	dir := strings.NewReplacer(
+		"{machine}", machineID,
+		"{database}", database,
+		"{date}", at.Format("2006-01-02"),
+	).Replace(template)
+
+	return path.Join(strings.Trim(path.Clean("/"+dir), "/"), fileName)
+}
+
+// Prune deletes the backup files under prefix last modified before cutoff and
+// returns the objects it removed.
+func Prune(ctx context.Context, backend Backend, prefix string, cutoff time.Time) ([]Object, error) {
+	objects, err := backend.List(ctx, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list storage %s: %w", backend.Name(), err)
+	}
+
+	var removed []Object
+	for _, obj := range objects {
+		if obj.ModTime.IsZero() || !obj.ModTime.Before(cutoff) || !isBackupFile(obj.Key) {
+			continue
+		}
+		if err := backend.Delete(ctx, obj.Key); err != nil {
+			return removed, fmt.Errorf("failed to delete %s from storage %s: %w", obj.Key, backend.Name(), err)
+		}
+		removed = append(removed, obj)
+	}
+
+	return removed, nil
+}
+
+func isBackupFile(key string) bool {
+	return strings.HasSuffix(key, ".sql") || strings.HasSuffix(key, ".gz") || strings.HasSuffix(key, ".zip") ||
+		strings.HasSuffix(key, ".gpg") || strings.HasSuffix(key, ".manifest.json")
+}
+
+// contextReader stops a copy once ctx is cancelled.
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.reader.Read(p)
+}
@@ -15,6 +15,8 @@ import (
 	"mysql-backup/internal/api"
 	"mysql-backup/internal/backup"
 	"mysql-backup/internal/config"
+	"mysql-backup/internal/history"
+	"mysql-backup/internal/jobs"
 	"mysql-backup/internal/scheduler"
 	"mysql-backup/internal/service"
 )
@@ -30,6 +32,9 @@ func main() {
 		configPath  = flag.String("config", "", "Path to config file")
 		showVersion = flag.Bool("version", false, "Show version information")
 		daemon      = flag.Bool("daemon", false, "Run as daemon (service mode)")
+		keyFile     = flag.String("master-key-file", "", "File holding the master key of the config file (overrides "+config.EnvPrefix+"MASTER_KEY_FILE)")
+		insecureKey = flag.Bool("insecure-key-file", false, "Accept a master key file in the config directory, creating .mysql-backup-key there when no key is set (same as "+config.EnvInsecureKeyFile+"=true). Anyone with a copy of the directory can then decrypt the config")
+		rotateKey   = flag.Bool("rotate-key", false, "Re-encrypt the config file with the key from the "+config.EnvNewPrefix+"* variables, or a new random key in the key file, and exit. Stop the service first")
 	)
 	flag.Parse()
 
@@ -42,24 +47,98 @@ func main() {
 	fmt.Println("Starting application...")
 
 	// Load configuration
-	cfg, err := config.NewConfig(*configPath)
+	keyOptions := config.KeyOptionsFromEnv(config.EnvPrefix)
+	if *keyFile != "" {
+		keyOptions = config.KeyOptions{KeyFile: *keyFile, InsecureKeyFile: keyOptions.InsecureKeyFile}
+	}
+	if *insecureKey {
+		keyOptions.InsecureKeyFile = true
+	}
+	cfg, err := config.NewConfig(*configPath, keyOptions)
 	if err != nil {
 		log.Fatalf("Failed to load config: %v", err)
 	}
 
+	if *rotateKey {
+		if err := cfg.RotateMasterKey(config.KeyOptionsFromEnv(config.EnvNewPrefix)); err != nil {
+			log.Fatalf("Failed to rotate master key: %v", err)
+		}
+		fmt.Printf("Config file re-encrypted with the master key from %s\n", cfg.MasterKeySource())
+		return
+	}
+	fmt.Printf("Config file encrypted with the master key from %s\n", cfg.MasterKeySource())
+
+	historyStore, err := history.NewStore(cfg.Dir())
+	if err != nil {
+		log.Fatalf("Failed to load backup history: %v", err)
+	}
+
 	// Initialize services
-	backupService := backup.NewService(cfg)
-	schedulerService := scheduler.NewService(cfg, backupService)
+	backupService := backup.NewService(cfg, historyStore)
+	restoreService := backup.NewRestoreService(cfg, backupService)
+	verifyService := backup.NewVerifyService(cfg, backupService, restoreService, historyStore)
+	jobManager := jobs.NewManager(cfg, backupService, verifyService, restoreService)
+	schedulerService := scheduler.NewService(cfg, jobManager)
 	serviceManager := service.NewManager()
 
 	// Initialize API handlers
-	handler := api.NewHandler(cfg, backupService, schedulerService, serviceManager)
+	handler := api.NewHandler(cfg, backupService, restoreService, historyStore, jobManager, schedulerService, serviceManager)
 
 	// Setup HTTP routes
 	mux := http.NewServeMux()
 
 	// Web interface
 	mux.HandleFunc("/", handler.IndexHandler)
+	mux.HandleFunc("/login", handler.LoginPageHandler)
+	mux.HandleFunc("/setup", handler.LoginPageHandler)
+
+	// Authentication and users
+	mux.HandleFunc("/api/auth/login", handler.LoginHandler)
+	mux.HandleFunc("/api/auth/logout", handler.LogoutHandler)
+	mux.HandleFunc("/api/auth/setup", handler.SetupHandler)
+	mux.HandleFunc("/api/auth/me", handler.CurrentUserHandler)
+	mux.HandleFunc("/api/auth/password", handler.ChangePasswordHandler)
+
+	mux.HandleFunc("/api/users", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			handler.GetUsersHandler(w, r)
+		case http.MethodPost:
+			handler.CreateUserHandler(w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	mux.HandleFunc("/api/users/", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPut:
+			handler.UpdateUserHandler(w, r)
+		case http.MethodDelete:
+			handler.DeleteUserHandler(w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	mux.HandleFunc("/api/tokens", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			handler.GetAPITokensHandler(w, r)
+		case http.MethodPost:
+			handler.CreateAPITokenHandler(w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	mux.HandleFunc("/api/tokens/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		handler.DeleteAPITokenHandler(w, r)
+	})
 
 	// API routes
 	mux.HandleFunc("/api/config", func(w http.ResponseWriter, r *http.Request) {
@@ -80,6 +159,21 @@ func main() {
 	mux.HandleFunc("/api/backup/manual", handler.CreateManualBackupHandler)
 	mux.HandleFunc("/api/backup/logs", handler.GetBackupLogsHandler)
 
+	mux.HandleFunc("/api/retention/dry-run", handler.RetentionDryRunHandler)
+
+	mux.HandleFunc("/api/jobs", handler.GetJobsHandler)
+	mux.HandleFunc("/api/jobs/", func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/events") {
+			handler.JobEventsHandler(w, r)
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/cancel") {
+			handler.CancelJobHandler(w, r)
+			return
+		}
+		handler.GetJobHandler(w, r)
+	})
+
 	// Novas rotas para agendamentos
 	mux.HandleFunc("/api/schedules", func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
@@ -151,6 +245,11 @@ func main() {
 			return
 		}
 
+		if strings.HasSuffix(r.URL.Path, "/restore") {
+			handler.CreateMachineRestoreHandler(w, r)
+			return
+		}
+
 		switch r.Method {
 		case http.MethodPut:
 			handler.UpdateMachineHandler(w, r)
@@ -161,10 +260,33 @@ func main() {
 		}
 	})
 
+	// Storage routes
+	mux.HandleFunc("/api/storages", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			handler.GetStoragesHandler(w, r)
+		case http.MethodPost:
+			handler.CreateStorageHandler(w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	mux.HandleFunc("/api/storages/", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPut:
+			handler.UpdateStorageHandler(w, r)
+		case http.MethodDelete:
+			handler.DeleteStorageHandler(w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
 	// Create HTTP server
 	server := &http.Server{
 		Addr:         fmt.Sprintf(":%d", *port),
-		Handler:      mux,
+		Handler:      handler.Authenticate(mux),
 		ReadTimeout:  30 * time.Second,
 		WriteTimeout: 30 * time.Second,
 		IdleTimeout:  120 * time.Second,
@@ -176,7 +298,9 @@ func main() {
 		go func() {
 			if err := schedulerService.Start(context.Background()); err != nil {
 				log.Printf("Failed to start scheduler: %v", err)
+				return
 			}
+			schedulerService.CatchUp()
 		}()
 	}
 
@@ -212,5 +336,8 @@ func main() {
 		log.Fatalf("Server failed to start: %v", err)
 	}
 
+	// Record the last use of API tokens seen since the last flush
+	handler.FlushTokenUses()
+
 	fmt.Println("Application stopped.")
 }